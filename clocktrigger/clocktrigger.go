@@ -0,0 +1,255 @@
+package clocktrigger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/barskern/paragliding/igcserver"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultInterval is how often the service is polled when no interval is
+	// configured
+	DefaultInterval = 10 * time.Minute
+
+	// DefaultStatePath is where the last seen timestamp is stored when no
+	// path is configured
+	DefaultStatePath = ".clocktrigger"
+
+	// pageLimit is the amount of tracks requested in each ticker report
+	pageLimit = 100
+)
+
+var (
+	// ErrMissingConfig is returned if a required configuration is not set
+	ErrMissingConfig = errors.New("missing required configuration")
+
+	// errNoContent is returned when the service has nothing to report
+	errNoContent = errors.New("no content")
+)
+
+// Config contains everything the clock trigger needs to poll a service and
+// notify a webhook
+type Config struct {
+	BaseURL    string
+	WebhookURL string
+	Interval   time.Duration
+	StatePath  string
+	HTTPClient *http.Client
+}
+
+// ConfigFromEnv reads the configuration from the environment variables
+// `CLOCKTRIGGER_URL` (eg. `https://example.com/paragliding/api`),
+// `CLOCKTRIGGER_WEBHOOK`, `CLOCKTRIGGER_INTERVAL` (eg. `10m`) and
+// `CLOCKTRIGGER_STATE`
+func ConfigFromEnv() (config Config, err error) {
+	config = Config{
+		Interval:   DefaultInterval,
+		StatePath:  DefaultStatePath,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	var ok bool
+	if config.BaseURL, ok = os.LookupEnv("CLOCKTRIGGER_URL"); !ok {
+		err = fmt.Errorf("%s: 'CLOCKTRIGGER_URL'", ErrMissingConfig)
+		return
+	}
+	if config.WebhookURL, ok = os.LookupEnv("CLOCKTRIGGER_WEBHOOK"); !ok {
+		err = fmt.Errorf("%s: 'CLOCKTRIGGER_WEBHOOK'", ErrMissingConfig)
+		return
+	}
+	if intervalStr, ok := os.LookupEnv("CLOCKTRIGGER_INTERVAL"); ok {
+		if config.Interval, err = time.ParseDuration(intervalStr); err != nil {
+			return
+		}
+		if config.Interval <= 0 {
+			err = errors.New("interval must be positive")
+			return
+		}
+	}
+	if statePath, ok := os.LookupEnv("CLOCKTRIGGER_STATE"); ok {
+		config.StatePath = statePath
+	}
+	return
+}
+
+// ClockTrigger periodically polls the ticker of a service and posts a
+// summary of the new tracks to a webhook
+type ClockTrigger struct {
+	config   Config
+	lastSeen time.Time
+}
+
+// New creates a clock trigger which continues from the timestamp stored in
+// the state file, if it exists
+func New(config Config) (trigger ClockTrigger, err error) {
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	trigger.config = config
+
+	content, err := ioutil.ReadFile(config.StatePath)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	trigger.lastSeen, err = time.Parse(time.RFC3339Nano, strings.TrimSpace(string(content)))
+	return
+}
+
+// LastSeen returns the timestamp of the last track which has been notified
+func (trigger *ClockTrigger) LastSeen() time.Time {
+	return trigger.lastSeen
+}
+
+// Run checks for new tracks every interval until stop is closed
+func (trigger *ClockTrigger) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(trigger.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := trigger.Check(); err != nil {
+			log.WithField("error", err).Error("unable to check for new tracks")
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check polls the service once and posts a summary to the webhook if there
+// are new tracks. The first check without a stored state only remembers the
+// latest timestamp, so that old tracks are not posted.
+func (trigger *ClockTrigger) Check() (err error) {
+	start := time.Now()
+
+	latest, err := trigger.getLatest()
+	if err == errNoContent {
+		log.Info("service has no tracks yet")
+		return nil
+	} else if err != nil {
+		return
+	}
+	if trigger.lastSeen.IsZero() {
+		// The report contains the latest timestamp with full precision
+		var report igcserver.TickerReport
+		if err = trigger.getJSON("/ticker?limit=1", &report); err != nil {
+			return
+		}
+		log.WithField("latest", report.Latest).Info("starting from latest timestamp of service")
+		return trigger.save(report.Latest)
+	}
+	// The latest timestamp is only given in seconds
+	if latest.Before(trigger.lastSeen.Truncate(time.Second)) {
+		log.WithField("latest", latest).Info("no new tracks")
+		return
+	}
+
+	var ids []igcserver.TrackID
+	var report igcserver.TickerReport
+	path := fmt.Sprintf("/ticker/%s?limit=%d", trigger.lastSeen.UTC().Format(time.RFC3339Nano), pageLimit)
+	for {
+		var page igcserver.TickerReport
+		err = trigger.getJSON(path, &page)
+		if err == errNoContent {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		report = page
+		ids = append(ids, page.Tracks...)
+		if len(page.Tracks) < pageLimit {
+			break
+		}
+		path = fmt.Sprintf("/ticker?cursor=%s&limit=%d", page.Cursor, pageLimit)
+	}
+	if len(ids) == 0 {
+		log.WithField("latest", latest).Info("no new tracks")
+		return
+	}
+
+	msg := igcserver.NewDiscordMsg(report.Latest, ids, time.Since(start))
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(msg)
+
+	log.WithField("msg", msg).Info("sending summary of new tracks to webhook")
+	res, err := trigger.config.HTTPClient.Post(trigger.config.WebhookURL, "application/json", b)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return trigger.save(report.End)
+}
+
+// getLatest gets the latest timestamp of the service
+func (trigger *ClockTrigger) getLatest() (latest time.Time, err error) {
+	body, err := trigger.get("/ticker/latest")
+	if err != nil {
+		return
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(body)))
+}
+
+// getJSON gets a path of the service and decodes the response as json
+func (trigger *ClockTrigger) getJSON(path string, v interface{}) (err error) {
+	body, err := trigger.get(path)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(body, v)
+}
+
+// get gets a path of the service, where a 404 is returned as errNoContent
+func (trigger *ClockTrigger) get(path string) (body []byte, err error) {
+	res, err := trigger.config.HTTPClient.Get(trigger.config.BaseURL + path)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		err = errNoContent
+		return
+	} else if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("service responded with status %d to '%s'", res.StatusCode, path)
+		return
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// save stores the last seen timestamp in the state file, replacing it
+// atomically so that a crash never leaves a corrupt state
+func (trigger *ClockTrigger) save(lastSeen time.Time) (err error) {
+	dir, name := filepath.Split(trigger.config.StatePath)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, name+".tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.WriteString(lastSeen.UTC().Format(time.RFC3339Nano) + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), trigger.config.StatePath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	trigger.lastSeen = lastSeen
+	return
+}
@@ -0,0 +1,182 @@
+package clocktrigger
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/barskern/paragliding/igcserver"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeTestService serves a ticker over the given timestamps, where the id of
+// a track is its index plus one
+func makeTestService(timestamps *[]time.Time) *httptest.Server {
+	report := func(w http.ResponseWriter, after func(i int) bool, limit int) {
+		var rep igcserver.TickerReport
+		for i, ts := range *timestamps {
+			if !after(i) || len(rep.Tracks) >= limit {
+				continue
+			}
+			if len(rep.Tracks) == 0 {
+				rep.Start = ts
+			}
+			rep.End = ts
+			rep.Cursor = igcserver.TickerCursor{Timestamp: ts, ID: igcserver.TrackID(i + 1)}
+			rep.Tracks = append(rep.Tracks, igcserver.TrackID(i+1))
+		}
+		if len(rep.Tracks) == 0 {
+			http.NotFound(w, nil)
+			return
+		}
+		rep.Latest = (*timestamps)[len(*timestamps)-1]
+		json.NewEncoder(w).Encode(rep)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ticker/latest", func(w http.ResponseWriter, r *http.Request) {
+		if len(*timestamps) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, (*timestamps)[len(*timestamps)-1].Format(time.RFC3339))
+	})
+	mux.HandleFunc("/ticker/", func(w http.ResponseWriter, r *http.Request) {
+		after, err := time.Parse(time.RFC3339, r.URL.Path[len("/ticker/"):])
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		report(w, func(i int) bool { return (*timestamps)[i].After(after) }, limit)
+	})
+	mux.HandleFunc("/ticker", func(w http.ResponseWriter, r *http.Request) {
+		var cursor igcserver.TickerCursor
+		if cursorStr := r.URL.Query().Get("cursor"); cursorStr != "" {
+			var err error
+			if cursor, err = igcserver.ParseTickerCursor(cursorStr); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		report(w, func(i int) bool { return igcserver.TrackID(i+1) > cursor.ID }, limit)
+	})
+	return httptest.NewServer(mux)
+}
+
+// Test that the clock trigger only posts new tracks, pages through large
+// reports and continues from its stored state
+func TestClockTrigger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clocktrigger")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var timestamps []time.Time
+	service := makeTestService(&timestamps)
+	defer service.Close()
+
+	var msgs []igcserver.DiscordMsg
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg igcserver.DiscordMsg
+		json.NewDecoder(r.Body).Decode(&msg)
+		msgs = append(msgs, msg)
+	}))
+	defer webhook.Close()
+
+	config := Config{
+		BaseURL:    service.URL + "/",
+		WebhookURL: webhook.URL,
+		Interval:   time.Minute,
+		StatePath:  filepath.Join(dir, "state"),
+		HTTPClient: http.DefaultClient,
+	}
+	trigger, err := New(config)
+	if err != nil {
+		t.Fatalf("unable to create clock trigger: %s", err)
+	}
+
+	start := time.Date(2018, 6, 1, 12, 0, 0, 500, time.UTC)
+	addTracks := func(count int) {
+		for i := 0; i < count; i++ {
+			timestamps = append(timestamps, start.Add(time.Duration(len(timestamps))*time.Minute))
+		}
+	}
+	check := func(exptMsgs int, exptLastSeen time.Time) {
+		if err := trigger.Check(); err != nil {
+			t.Fatalf("unable to check for new tracks: %s", err)
+		}
+		if len(msgs) != exptMsgs {
+			t.Fatalf("expected %d messages to be posted, got %d", exptMsgs, len(msgs))
+		}
+		if !trigger.LastSeen().Equal(exptLastSeen) {
+			t.Errorf("expected last seen to be '%s', got '%s'", exptLastSeen, trigger.LastSeen())
+		}
+	}
+
+	// Nothing is posted while the service is empty
+	check(0, time.Time{})
+
+	// The first check only remembers the latest timestamp
+	addTracks(2)
+	check(0, timestamps[1])
+
+	addTracks(pageLimit + 3)
+	check(1, timestamps[len(timestamps)-1])
+	if expt := fmt.Sprintf("the %d new tracks", pageLimit+3); !strings.Contains(msgs[0].Content, expt) {
+		t.Errorf("expected message to contain '%s', got '%s'", expt, msgs[0].Content)
+	}
+
+	// Nothing new since last check
+	check(1, timestamps[len(timestamps)-1])
+
+	// A new trigger continues from the stored state
+	trigger, err = New(config)
+	if err != nil {
+		t.Fatalf("unable to create clock trigger: %s", err)
+	}
+	if !trigger.LastSeen().Equal(timestamps[len(timestamps)-1]) {
+		t.Errorf("expected state to be loaded, got '%s'", trigger.LastSeen())
+	}
+	addTracks(1)
+	check(2, timestamps[len(timestamps)-1])
+}
+
+// Test that the configuration is read from the environment
+func TestConfigFromEnv(t *testing.T) {
+	for _, key := range []string{"CLOCKTRIGGER_URL", "CLOCKTRIGGER_WEBHOOK", "CLOCKTRIGGER_INTERVAL", "CLOCKTRIGGER_STATE"} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Unsetenv(key)
+	}
+
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Errorf("expected error when url is missing")
+	}
+	os.Setenv("CLOCKTRIGGER_URL", "http://example.com/paragliding/api")
+	os.Setenv("CLOCKTRIGGER_WEBHOOK", "http://example.com/webhook")
+
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("unable to get config: %s", err)
+	}
+	if config.Interval != DefaultInterval || config.StatePath != DefaultStatePath {
+		t.Errorf("expected default interval and state, got '%s' and '%s'", config.Interval, config.StatePath)
+	}
+
+	os.Setenv("CLOCKTRIGGER_INTERVAL", "-1m")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Errorf("expected error for negative interval")
+	}
+	os.Setenv("CLOCKTRIGGER_INTERVAL", "30s")
+	if config, err := ConfigFromEnv(); err != nil || config.Interval != 30*time.Second {
+		t.Errorf("expected interval of 30s, got '%s' (%v)", config.Interval, err)
+	}
+}
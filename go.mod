@@ -5,6 +5,7 @@ require (
 	github.com/google/go-cmp v0.2.0
 	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/mux v1.6.2
+	github.com/gorilla/websocket v1.2.0
 	github.com/marni/goigc v0.1.0
 	github.com/sirupsen/logrus v1.1.1
 )
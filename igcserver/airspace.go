@@ -0,0 +1,109 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/marni/goigc"
+	log "github.com/sirupsen/logrus"
+	"io"
+)
+
+const (
+	// airspaceQueueSize is how many stored tracks can wait to be checked
+	// for airspace infringements
+	airspaceQueueSize = 64
+)
+
+var (
+	// ErrInvalidAirspace is returned if an airspace does not describe an
+	// area with a floor below its ceiling
+	ErrInvalidAirspace = errors.New("invalid airspace")
+)
+
+// Airspace is a restricted area between a floor and a ceiling (in meters),
+// where the polygon is the corners of the area as `[lat, lng]` in degrees
+type Airspace struct {
+	Name    string       `json:"name"`
+	Floor   int64        `json:"floor"`
+	Ceiling int64        `json:"ceiling"`
+	Polygon [][2]float64 `json:"polygon"`
+}
+
+// LoadAirspaces reads a json array of airspaces and checks that each of them
+// is valid
+func LoadAirspaces(r io.Reader) (airspaces []Airspace, err error) {
+	if err = json.NewDecoder(r).Decode(&airspaces); err != nil {
+		return
+	}
+	for _, airspace := range airspaces {
+		if len(airspace.Polygon) < 3 {
+			return nil, fmt.Errorf("%s: '%s' must have at least 3 corners", ErrInvalidAirspace, airspace.Name)
+		}
+		if airspace.Floor >= airspace.Ceiling {
+			return nil, fmt.Errorf("%s: '%s' must have a floor below its ceiling", ErrInvalidAirspace, airspace.Name)
+		}
+	}
+	return
+}
+
+// contains checks if a point is inside the airspace, using the number of
+// edges of the polygon which a ray from the point crosses
+func (airspace *Airspace) contains(point igc.Point) bool {
+	if alt := altitude(point); alt < airspace.Floor || alt > airspace.Ceiling {
+		return false
+	}
+	lat, lng := point.Lat.Degrees(), point.Lng.Degrees()
+	inside := false
+	for i, j := 0, len(airspace.Polygon)-1; i < len(airspace.Polygon); j, i = i, i+1 {
+		a, b := airspace.Polygon[i], airspace.Polygon[j]
+		if (a[0] > lat) != (b[0] > lat) && lng < (b[1]-a[1])*(lat-a[0])/(b[0]-a[0])+a[1] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// infringedBy checks if any of the points of a track are inside the airspace
+func (airspace *Airspace) infringedBy(track igc.Track) bool {
+	for _, point := range track.Points {
+		if airspace.contains(point) {
+			return true
+		}
+	}
+	return false
+}
+
+// airspaceChecker starts a worker which checks stored tracks against the
+// airspaces, and returns an event handler which queues the tracks for the
+// worker so that storing a track does not wait for the check. When the queue
+// is full the handler waits for room, so that no track is left unchecked.
+func (server *Server) airspaceChecker() func(Event) {
+	queue := make(chan TrackMeta, airspaceQueueSize)
+	go func() {
+		for meta := range queue {
+			track, err := server.getTrack(meta.ID)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"id":    meta.ID,
+					"error": err,
+				}).Error("unable to get track to check against airspaces")
+				continue
+			}
+			for _, airspace := range server.config.Airspaces {
+				if airspace.infringedBy(track) {
+					server.events.Publish(NewAirspaceEvent(meta, airspace.Name))
+				}
+			}
+		}
+	}()
+	return func(event Event) {
+		if event.Type != EventTrackRegistered && event.Type != EventTrackRefreshed {
+			return
+		}
+		if len(server.config.Airspaces) == 0 {
+			return
+		}
+		queue <- *event.Track
+	}
+}
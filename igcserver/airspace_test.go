@@ -0,0 +1,98 @@
+package igcserver
+
+import (
+	"github.com/marni/goigc"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that airspaces are loaded from json and validated
+func TestLoadAirspaces(t *testing.T) {
+	for _, data := range []struct {
+		json string
+		expt bool
+	}{
+		{"[{\"name\":\"a\",\"floor\":0,\"ceiling\":1000,\"polygon\":[[60,10],[60,11],[61,10]]}]", true},
+		{"[]", true},
+		{"[{\"name\":\"a\",\"floor\":0,\"ceiling\":1000,\"polygon\":[[60,10],[60,11]]}]", false},
+		{"[{\"name\":\"a\",\"floor\":1000,\"ceiling\":1000,\"polygon\":[[60,10],[60,11],[61,10]]}]", false},
+		{"{\"name\":\"a\"}", false},
+	} {
+		if _, err := LoadAirspaces(strings.NewReader(data.json)); (err == nil) != data.expt {
+			t.Errorf("expected loading '%s' to succeed: %t, got '%v'", data.json, data.expt, err)
+		}
+	}
+}
+
+// Test that a track only infringes an airspace when it is inside the polygon
+// and between the floor and the ceiling
+func TestAirspaceInfringedBy(t *testing.T) {
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	track := makeStraightTrack(date, 12*time.Hour, 60, 61)
+
+	square := [][2]float64{{60.02, 9.99}, {60.02, 10.01}, {60.04, 10.01}, {60.04, 9.99}}
+	for _, data := range []struct {
+		airspace Airspace
+		expt     bool
+		about    string
+	}{
+		{Airspace{"a", 0, 2000, square}, true, "airspace around the track"},
+		{Airspace{"b", 1500, 2000, square}, false, "airspace above the track"},
+		{Airspace{"c", 0, 1010, square}, false, "airspace below the part of the track inside the polygon"},
+		{Airspace{"d", 0, 2000, [][2]float64{{60.02, 10.01}, {60.02, 10.03}, {60.04, 10.02}}}, false, "airspace beside the track"},
+	} {
+		if got := data.airspace.infringedBy(track); got != data.expt {
+			t.Errorf("expected infringement of %s to be %t, got %t", data.about, data.expt, got)
+		}
+	}
+}
+
+// Test that registered tracks are checked against the airspaces outside of
+// the registration
+func TestAirspaceChecker(t *testing.T) {
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		t.Fatalf("unable to parse 'test.igc': %s", err)
+	}
+	lat, lng := track.Points[0].Lat.Degrees(), track.Points[0].Lng.Degrees()
+
+	trackMetasMap := NewTrackMetasMap()
+	ticker := NewTickerDummy(2)
+	webhooks := NewWebhooksMap()
+	config := DefaultConfig
+	config.Airspaces = []Airspace{
+		{"takeoff", -1000, 100000, [][2]float64{{lat - 0.01, lng - 0.01}, {lat - 0.01, lng + 0.01}, {lat + 0.01, lng}}},
+		{"elsewhere", -1000, 100000, [][2]float64{{0, 0}, {0, 1}, {1, 0}}},
+	}
+	server := NewServerWithConfig(nil, &trackMetasMap, &ticker, &webhooks, nil, nil, config)
+
+	meta := TrackMeta{ID: 1, Date: track.Date}
+	trackMetasMap.Append(meta)
+	trackMetasMap.AppendContent(meta.ID, string(content))
+
+	events := server.events.Subscribe()
+	defer server.events.Unsubscribe(events)
+	server.events.Publish(NewTrackEvent(EventTrackRegistered, meta))
+
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type != EventAirspaceInfringement {
+				continue
+			}
+			if event.TrackID != meta.ID || event.Airspace != "takeoff" {
+				t.Errorf("expected track to infringe the airspace at the takeoff, got %v", event)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("expected registered track to infringe the airspace at the takeoff")
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/barskern/paragliding/isodur"
+	"github.com/marni/goigc"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultCompareStep is the time between each step of a comparison if
+	// none is specified in the request
+	defaultCompareStep = 10 * time.Second
+
+	// maxCompareTracks is the maximum amount of tracks which can be compared
+	// in a single request
+	maxCompareTracks = 10
+
+	// maxCompareSteps is the maximum amount of steps a comparison can contain
+	maxCompareSteps = 10000
+
+	// minCourseLength is the shortest course line (in km) which is used to
+	// determine who is ahead, shorter lines means that the tracks returned
+	// to where they started
+	minCourseLength = 0.01
+)
+
+var (
+	// ErrNoOverlap is returned if the tracks to compare were never in the air
+	// at the same time
+	ErrNoOverlap = errors.New("tracks do not overlap in time")
+
+	// ErrTooManySteps is returned if the step is too small for the length of
+	// the period where the tracks overlap
+	ErrTooManySteps = errors.New("too many steps in comparison")
+)
+
+// CompareReport contains the result of comparing several tracks which were
+// flown at the same time
+type CompareReport struct {
+	Tracks     []TrackID      `json:"tracks"`
+	Start      time.Time      `json:"t_start"`
+	End        time.Time      `json:"t_stop"`
+	Step       string         `json:"step"`
+	Course     CompareCourse  `json:"course"`
+	Steps      []CompareStep  `json:"steps"`
+	Summary    CompareSummary `json:"summary"`
+	Processing time.Duration  `json:"processing"`
+}
+
+// CompareCourse is the common course line which is used to determine who is
+// ahead, it goes from the mean start position to the mean end position
+type CompareCourse struct {
+	Start  ComparePoint `json:"start"`
+	End    ComparePoint `json:"end"`
+	Length float64      `json:"length"`
+}
+
+// ComparePoint is a position given in degrees
+type ComparePoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// CompareStep is the state of all the compared tracks at a single point in
+// time
+type CompareStep struct {
+	Time      time.Time         `json:"time"`
+	Positions []ComparePosition `json:"positions"`
+	Pairs     []ComparePair     `json:"pairs"`
+	Leader    TrackID           `json:"leader"`
+}
+
+// ComparePosition is the position of a single track in a step, where
+// progress is the distance (in km) covered along the course line
+type ComparePosition struct {
+	ID       TrackID `json:"id"`
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	Altitude int64   `json:"altitude"`
+	Progress float64 `json:"progress"`
+}
+
+// ComparePair is the distance (in km) and the altitude difference (in m)
+// between two tracks in a step
+type ComparePair struct {
+	A            TrackID `json:"a"`
+	B            TrackID `json:"b"`
+	Distance     float64 `json:"distance"`
+	AltitudeDiff int64   `json:"altitude_diff"`
+}
+
+// CompareSummary contains statistics of the entire comparison
+type CompareSummary struct {
+	Pairs  []ComparePairSummary  `json:"pairs"`
+	Tracks []CompareTrackSummary `json:"tracks"`
+}
+
+// ComparePairSummary contains statistics about the distance between two
+// tracks
+type ComparePairSummary struct {
+	A                TrackID `json:"a"`
+	B                TrackID `json:"b"`
+	MinDistance      float64 `json:"min_distance"`
+	MaxDistance      float64 `json:"max_distance"`
+	MeanDistance     float64 `json:"mean_distance"`
+	MeanAltitudeDiff float64 `json:"mean_altitude_diff"`
+}
+
+// CompareTrackSummary contains statistics about a single track
+type CompareTrackSummary struct {
+	ID           TrackID `json:"id"`
+	LeadTime     string  `json:"lead_time"`
+	MinAltitude  int64   `json:"min_altitude"`
+	MaxAltitude  int64   `json:"max_altitude"`
+	MeanAltitude float64 `json:"mean_altitude"`
+}
+
+// trackSeries is a track where every point has an absolute timestamp
+type trackSeries struct {
+	times  []time.Time
+	points []igc.Point
+}
+
+// newTrackSeries combines the date of the track with the time of day of every
+// point to get absolute timestamps, accounting for flights passing midnight
+func newTrackSeries(track igc.Track) (series trackSeries) {
+	date := time.Date(
+		track.Date.Year(), track.Date.Month(), track.Date.Day(),
+		0, 0, 0, 0, time.UTC,
+	)
+	series.times = make([]time.Time, 0, len(track.Points))
+	series.points = make([]igc.Point, 0, len(track.Points))
+	for _, point := range track.Points {
+		h, m, s := point.Time.Clock()
+		t := date.Add(
+			time.Duration(h)*time.Hour +
+				time.Duration(m)*time.Minute +
+				time.Duration(s)*time.Second +
+				time.Duration(point.Time.Nanosecond()),
+		)
+		// Small jumps back in time are noise from the logger, while large
+		// jumps means that we passed midnight
+		if n := len(series.times); n > 0 && t.Before(series.times[n-1]) {
+			if series.times[n-1].Sub(t) > time.Hour {
+				date = date.AddDate(0, 0, 1)
+				t = t.AddDate(0, 0, 1)
+			} else {
+				continue
+			}
+		}
+		series.times = append(series.times, t)
+		series.points = append(series.points, point)
+	}
+	return
+}
+
+func (series *trackSeries) start() time.Time {
+	return series.times[0]
+}
+
+func (series *trackSeries) end() time.Time {
+	return series.times[len(series.times)-1]
+}
+
+// at returns the interpolated position of the track at the given time, false
+// is returned if the time is outside of the track
+func (series *trackSeries) at(t time.Time) (point igc.Point, ok bool) {
+	n := len(series.times)
+	if n == 0 || t.Before(series.start()) || t.After(series.end()) {
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return !series.times[i].Before(t) })
+	if series.times[i].Equal(t) || i == 0 {
+		return series.points[i], true
+	}
+	prev, next := series.points[i-1], series.points[i]
+	span := series.times[i].Sub(series.times[i-1])
+	frac := float64(t.Sub(series.times[i-1])) / float64(span)
+
+	point = igc.NewPointFromLatLng(
+		lerp(prev.Lat.Degrees(), next.Lat.Degrees(), frac),
+		lerp(prev.Lng.Degrees(), next.Lng.Degrees(), frac),
+	)
+	point.Time = t
+	point.GNSSAltitude = int64(math.Round(lerp(float64(prev.GNSSAltitude), float64(next.GNSSAltitude), frac)))
+	point.PressureAltitude = int64(math.Round(lerp(float64(prev.PressureAltitude), float64(next.PressureAltitude), frac)))
+	return point, true
+}
+
+func lerp(a, b, frac float64) float64 {
+	return a + (b-a)*frac
+}
+
+// altitude returns the GNSS altitude of a point, or the pressure altitude if
+// the logger did not record a GNSS altitude
+func altitude(point igc.Point) int64 {
+	if point.GNSSAltitude != 0 {
+		return point.GNSSAltitude
+	}
+	return point.PressureAltitude
+}
+
+// courseLine is a straight line which positions can be projected onto to
+// find how far along the line they are
+type courseLine struct {
+	start  igc.Point
+	dx, dy float64
+	length float64
+}
+
+func newCourseLine(start, end igc.Point) (line courseLine) {
+	line.start = start
+	line.dx, line.dy = line.project(end)
+	line.length = math.Hypot(line.dx, line.dy)
+	return
+}
+
+// project converts a point into local coordinates (in km) relative to the
+// start of the line, which is accurate enough for the distances of a flight
+func (line *courseLine) project(point igc.Point) (x, y float64) {
+	x = (point.Lng.Radians() - line.start.Lng.Radians()) * math.Cos(line.start.Lat.Radians()) * igc.EarthRadius
+	y = (point.Lat.Radians() - line.start.Lat.Radians()) * igc.EarthRadius
+	return
+}
+
+// progress returns the distance covered along the line, if the line is too
+// short to have a direction the distance from the start is used instead
+func (line *courseLine) progress(point igc.Point) float64 {
+	if line.length < minCourseLength {
+		return line.start.Distance(point)
+	}
+	x, y := line.project(point)
+	return (x*line.dx + y*line.dy) / line.length
+}
+
+// meanPoint returns the mean position of the given points
+func meanPoint(points []igc.Point) igc.Point {
+	var lat, lng float64
+	for _, point := range points {
+		lat += point.Lat.Degrees()
+		lng += point.Lng.Degrees()
+	}
+	n := float64(len(points))
+	return igc.NewPointFromLatLng(lat/n, lng/n)
+}
+
+// compareTracks aligns the tracks on absolute time and compares their
+// positions for every step in the period where all tracks were in the air
+func compareTracks(ids []TrackID, tracks []igc.Track, step time.Duration) (rep CompareReport, err error) {
+	start := time.Now()
+
+	series := make([]trackSeries, len(tracks))
+	var from, to time.Time
+	for i, track := range tracks {
+		series[i] = newTrackSeries(track)
+		if len(series[i].times) == 0 {
+			err = ErrNoOverlap
+			return
+		}
+		if i == 0 || series[i].start().After(from) {
+			from = series[i].start()
+		}
+		if i == 0 || series[i].end().Before(to) {
+			to = series[i].end()
+		}
+	}
+	if to.Before(from) {
+		err = ErrNoOverlap
+		return
+	}
+	if to.Sub(from)/step > maxCompareSteps {
+		err = ErrTooManySteps
+		return
+	}
+
+	// The course line goes from the mean start position to the mean end
+	// position of the overlapping period
+	starts := make([]igc.Point, len(series))
+	ends := make([]igc.Point, len(series))
+	for i := range series {
+		starts[i], _ = series[i].at(from)
+		ends[i], _ = series[i].at(to)
+	}
+	courseEnd := meanPoint(ends)
+	line := newCourseLine(meanPoint(starts), courseEnd)
+
+	n := len(ids)
+	pairCount := n * (n - 1) / 2
+	pairSums := make([]ComparePairSummary, 0, pairCount)
+	for a := 0; a < n; a++ {
+		for b := a + 1; b < n; b++ {
+			pairSums = append(pairSums, ComparePairSummary{
+				A:           ids[a],
+				B:           ids[b],
+				MinDistance: math.Inf(1),
+			})
+		}
+	}
+	trackSums := make([]CompareTrackSummary, n)
+	leadSteps := make([]int, n)
+	for i, id := range ids {
+		trackSums[i] = CompareTrackSummary{
+			ID:          id,
+			MinAltitude: math.MaxInt64,
+			MaxAltitude: math.MinInt64,
+		}
+	}
+
+	var steps []CompareStep
+	for t := from; !t.After(to); t = t.Add(step) {
+		positions := make([]ComparePosition, n)
+		points := make([]igc.Point, n)
+		leader := 0
+		for i := range series {
+			points[i], _ = series[i].at(t)
+			alt := altitude(points[i])
+			positions[i] = ComparePosition{
+				ID:       ids[i],
+				Lat:      points[i].Lat.Degrees(),
+				Lng:      points[i].Lng.Degrees(),
+				Altitude: alt,
+				Progress: line.progress(points[i]),
+			}
+			if positions[i].Progress > positions[leader].Progress {
+				leader = i
+			}
+
+			sum := &trackSums[i]
+			sum.MeanAltitude += float64(alt)
+			if alt < sum.MinAltitude {
+				sum.MinAltitude = alt
+			}
+			if alt > sum.MaxAltitude {
+				sum.MaxAltitude = alt
+			}
+		}
+		leadSteps[leader]++
+
+		pairs := make([]ComparePair, 0, pairCount)
+		for a := 0; a < n; a++ {
+			for b := a + 1; b < n; b++ {
+				pair := ComparePair{
+					A:            ids[a],
+					B:            ids[b],
+					Distance:     points[a].Distance(points[b]),
+					AltitudeDiff: positions[a].Altitude - positions[b].Altitude,
+				}
+				sum := &pairSums[len(pairs)]
+				sum.MeanDistance += pair.Distance
+				sum.MeanAltitudeDiff += float64(pair.AltitudeDiff)
+				sum.MinDistance = math.Min(sum.MinDistance, pair.Distance)
+				sum.MaxDistance = math.Max(sum.MaxDistance, pair.Distance)
+				pairs = append(pairs, pair)
+			}
+		}
+
+		steps = append(steps, CompareStep{t, positions, pairs, ids[leader]})
+	}
+
+	count := float64(len(steps))
+	for i := range pairSums {
+		pairSums[i].MeanDistance /= count
+		pairSums[i].MeanAltitudeDiff /= count
+	}
+	for i := range trackSums {
+		trackSums[i].MeanAltitude /= count
+		trackSums[i].LeadTime = isodur.FormatAsISO8601(time.Duration(leadSteps[i]) * step)
+	}
+
+	rep = CompareReport{
+		ids,
+		from,
+		to,
+		isodur.FormatAsISO8601(step),
+		CompareCourse{
+			ComparePoint{line.start.Lat.Degrees(), line.start.Lng.Degrees()},
+			ComparePoint{courseEnd.Lat.Degrees(), courseEnd.Lng.Degrees()},
+			line.length,
+		},
+		steps,
+		CompareSummary{pairSums, trackSums},
+		time.Since(start),
+	}
+	return
+}
+
+// parseTrackIDs parses a comma-separated list of unique track ids
+func parseTrackIDs(s string) (ids []TrackID, err error) {
+	seen := make(map[TrackID]bool)
+	for _, idStr := range strings.Split(s, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		if seen[TrackID(id)] {
+			return nil, errors.New("duplicate track id")
+		}
+		seen[TrackID(id)] = true
+		ids = append(ids, TrackID(id))
+	}
+	return
+}
+
+// ----------- //
+// COMPARE API //
+// ----------- //
+
+// compareHandler compares several tracks given as `?ids=a,b,c`, an optional
+// `?step=<seconds>` decides the time between each step of the comparison
+func (server *Server) compareHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to compare tracks")
+
+	query := r.URL.Query()
+	ids, err := parseTrackIDs(query.Get("ids"))
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse track ids")
+		http.Error(w, "invalid ids", http.StatusBadRequest)
+		return
+	}
+	if len(ids) < 2 || len(ids) > maxCompareTracks {
+		logger.WithField("ids", ids).Info("invalid amount of tracks to compare")
+		http.Error(w, "invalid amount of ids", http.StatusBadRequest)
+		return
+	}
+	step := defaultCompareStep
+	if stepStr := query.Get("step"); stepStr != "" {
+		secs, err := strconv.Atoi(stepStr)
+		if err != nil || secs < 1 {
+			logger.WithField("step", stepStr).Info("step must be a positive number")
+			http.Error(w, "invalid step", http.StatusBadRequest)
+			return
+		}
+		step = time.Duration(secs) * time.Second
+	}
+
+	idlog := logger.WithField("ids", ids)
+	tracks := make([]igc.Track, len(ids))
+	for i, id := range ids {
+		tracks[i], err = server.getTrack(id)
+		if err == ErrTrackNotFound {
+			idlog.WithField("id", id).Info("unable to find track of id")
+			http.Error(w, "content not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			idlog.WithFields(log.Fields{
+				"id":    id,
+				"error": err,
+			}).Error("unable to get track of id")
+			http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	report, err := compareTracks(ids, tracks, step)
+	if err == ErrNoOverlap {
+		idlog.Info("tracks do not overlap in time")
+		http.Error(w, "tracks do not overlap in time", http.StatusUnprocessableEntity)
+		return
+	} else if err == ErrTooManySteps {
+		idlog.WithField("step", step).Info("comparison would contain too many steps")
+		http.Error(w, "step too small for the length of the tracks", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Error("unable to compare tracks")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	idlog.WithField("steps", len(report.Steps)).Info("responding with comparison of tracks")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
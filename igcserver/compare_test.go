@@ -0,0 +1,170 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/marni/goigc"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Convenience function to create a track flying straight north, starting at
+// the given latitude and time of day
+func makeStraightTrack(date time.Time, start time.Duration, lat float64, fixes int) igc.Track {
+	track := igc.NewTrack()
+	track.Date = date
+	for i := 0; i < fixes; i++ {
+		point := igc.NewPointFromLatLng(lat+float64(i)*0.001, 10)
+		point.Time = time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC).Add(start + time.Duration(i)*10*time.Second)
+		point.GNSSAltitude = int64(1000 + i)
+		track.Points = append(track.Points, point)
+	}
+	return track
+}
+
+// Test that tracks are aligned on time and that the leader is found
+func TestCompareTracks(t *testing.T) {
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	ahead := makeStraightTrack(date, 12*time.Hour, 60.01, 60)
+	behind := makeStraightTrack(date, 12*time.Hour+time.Minute, 60, 60)
+
+	report, err := compareTracks([]TrackID{1, 2}, []igc.Track{ahead, behind}, 10*time.Second)
+	if err != nil {
+		t.Fatalf("unable to compare tracks: %s", err)
+	}
+
+	if !report.Start.Equal(date.Add(12*time.Hour + time.Minute)) {
+		t.Errorf("expected comparison to start when both tracks are in the air, got %s", report.Start)
+	}
+	if !report.End.Equal(date.Add(12*time.Hour + 590*time.Second)) {
+		t.Errorf("expected comparison to end when the first track ends, got %s", report.End)
+	}
+	if len(report.Steps) != 54 {
+		t.Fatalf("expected 54 steps, got %d", len(report.Steps))
+	}
+	for _, step := range report.Steps {
+		if step.Leader != 1 {
+			t.Errorf("expected track 1 to be ahead at %s, got %d", step.Time, step.Leader)
+		}
+		// The first track is 16 fixes ahead in latitude, each fix being
+		// 0.001 degrees (~111m)
+		if d := step.Pairs[0].Distance; math.Abs(d-1.779) > 0.01 {
+			t.Errorf("expected distance of ~1.779km at %s, got %f", step.Time, d)
+		}
+		if diff := step.Pairs[0].AltitudeDiff; diff != 6 {
+			t.Errorf("expected altitude difference of 6m at %s, got %d", step.Time, diff)
+		}
+	}
+	if report.Summary.Tracks[0].LeadTime != "PT9M" {
+		t.Errorf("expected track 1 to lead for 'PT9M', got '%s'", report.Summary.Tracks[0].LeadTime)
+	}
+	if report.Summary.Tracks[1].LeadTime != "PT0S" {
+		t.Errorf("expected track 2 to never lead, got '%s'", report.Summary.Tracks[1].LeadTime)
+	}
+}
+
+// Test that tracks which were not in the air at the same time are rejected
+func TestCompareTracksNoOverlap(t *testing.T) {
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	morning := makeStraightTrack(date, 8*time.Hour, 60, 10)
+	evening := makeStraightTrack(date, 18*time.Hour, 60, 10)
+
+	_, err := compareTracks([]TrackID{1, 2}, []igc.Track{morning, evening}, 10*time.Second)
+	if err != ErrNoOverlap {
+		t.Fatalf("expected tracks flown at different times to not overlap, got '%v'", err)
+	}
+
+	nextDay := makeStraightTrack(date.AddDate(0, 0, 1), 8*time.Hour, 60, 10)
+	_, err = compareTracks([]TrackID{1, 2}, []igc.Track{morning, nextDay}, 10*time.Second)
+	if err != ErrNoOverlap {
+		t.Fatalf("expected tracks flown on different days to not overlap, got '%v'", err)
+	}
+}
+
+// Test that a track passing midnight keeps increasing timestamps
+func TestTrackSeriesMidnight(t *testing.T) {
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	track := makeStraightTrack(date, 23*time.Hour+59*time.Minute, 60, 20)
+	for i := range track.Points {
+		track.Points[i].Time = time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC).Add(
+			(23*time.Hour + 59*time.Minute + time.Duration(i)*10*time.Second) % (24 * time.Hour),
+		)
+	}
+
+	series := newTrackSeries(track)
+	if len(series.times) != len(track.Points) {
+		t.Fatalf("expected all points to be kept, got %d of %d", len(series.times), len(track.Points))
+	}
+	if expt := date.Add(23*time.Hour + 59*time.Minute + 190*time.Second); !series.end().Equal(expt) {
+		t.Fatalf("expected track to end at %s, got %s", expt, series.end())
+	}
+}
+
+// Test GET /compare
+func TestIgcServerCompare(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
+
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	for _, id := range []TrackID{1, 2} {
+		trackMetasMap.Append(TrackMeta{ID: id})
+		trackMetasMap.AppendContent(id, string(content))
+	}
+
+	req := httptest.NewRequest("GET", "/compare?ids=1,2&step=60", nil)
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var report CompareReport
+	if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+		t.Errorf("received response body: '%s'", res.Body)
+		t.Fatalf("failed when trying to decode body as json")
+	}
+	if len(report.Steps) == 0 {
+		t.Fatalf("expected comparison of a track with itself to contain steps")
+	}
+	for _, pair := range report.Summary.Pairs {
+		if pair.MaxDistance > 0.001 {
+			t.Errorf("expected a track compared with itself to have no distance, got %f", pair.MaxDistance)
+		}
+	}
+}
+
+// Test bad GET /compare
+func TestIgcServerCompareBad(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
+	trackMetasMap.Append(TrackMeta{ID: 1})
+	trackMetasMap.AppendContent(1, "")
+
+	for _, data := range []struct {
+		code  int
+		query string
+	}{
+		{400, ""},
+		{400, "ids=1"},
+		{400, "ids=1,1"},
+		{400, "ids=1,a"},
+		{400, "ids=1,2&step=-1"},
+		{400, "ids=1,2,3,4,5,6,7,8,9,10,11"},
+		{404, "ids=1,2"},
+	} {
+		uri := fmt.Sprintf("/compare?%s", data.query)
+		req := httptest.NewRequest("GET", uri, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		code := res.Result().StatusCode
+		if code != data.code {
+			t.Errorf("expected `GET %s` to return '%d', got '%d'", uri, data.code, code)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EventTrackRegistered is published when a new track is registered
+	EventTrackRegistered = "track_registered"
+
+	// EventTrackDeleted is published when a track is deleted
+	EventTrackDeleted = "track_deleted"
+
+	// EventTrackRefreshed is published when a track is fetched again from
+	// its url and updated
+	EventTrackRefreshed = "track_refreshed"
+
+	// EventTrackIngestionFailed is published when a track could not be
+	// fetched or parsed during registration
+	EventTrackIngestionFailed = "track_ingestion_failed"
+
+	// EventPersonalBest is published when a registered track is the longest
+	// track of its pilot
+	EventPersonalBest = "personal_best"
+
+	// EventLeaderboardChange is published when a registered or refreshed
+	// track places among the longest tracks of the service
+	EventLeaderboardChange = "leaderboard_change"
+
+	// EventAirspaceInfringement is published when a registered or refreshed
+	// track was flown inside a restricted airspace
+	EventAirspaceInfringement = "airspace_infringement"
+
+	// EventWebhookRegistered is published when a new webhook is registered
+	EventWebhookRegistered = "webhook_registered"
+
+	// EventWebhookDeliveryFailed is published when a webhook could not be
+	// notified
+	EventWebhookDeliveryFailed = "webhook_delivery_failed"
+
+	// eventBuffer is how many events a subscriber can lag behind before it
+	// is disconnected
+	eventBuffer = 64
+
+	// eventPingInterval is how often idle websocket connections are pinged
+	eventPingInterval = 30 * time.Second
+
+	// eventWriteTimeout is how long a write to a websocket can take before
+	// the connection is considered dead
+	eventWriteTimeout = 10 * time.Second
+)
+
+// Event is something which happened in the service
+type Event struct {
+	Type      string     `json:"type"`
+	Timestamp time.Time  `json:"timestamp"`
+	TrackID   TrackID    `json:"track_id,omitempty"`
+	Track     *TrackMeta `json:"track,omitempty"`
+	WebhookID WebhookID  `json:"webhook_id,omitempty"`
+	URL       string     `json:"url,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Rank      int        `json:"rank,omitempty"`
+	Airspace  string     `json:"airspace,omitempty"`
+}
+
+// NewTrackEvent creates an event about a track
+func NewTrackEvent(eventType string, meta TrackMeta) Event {
+	return Event{
+		Type:      eventType,
+		Timestamp: time.Now(),
+		TrackID:   meta.ID,
+		Track:     &meta,
+	}
+}
+
+// NewLeaderboardEvent creates an event about a track which placed at the
+// given rank of the leaderboard
+func NewLeaderboardEvent(meta TrackMeta, rank int) Event {
+	event := NewTrackEvent(EventLeaderboardChange, meta)
+	event.Rank = rank
+	return event
+}
+
+// NewAirspaceEvent creates an event about a track which was flown inside the
+// airspace with the given name
+func NewAirspaceEvent(meta TrackMeta, airspace string) Event {
+	event := NewTrackEvent(EventAirspaceInfringement, meta)
+	event.Airspace = airspace
+	return event
+}
+
+// NewIngestionFailedEvent creates an event about a track from the url which
+// could not be registered
+func NewIngestionFailedEvent(url string, err error) Event {
+	return Event{
+		Type:      EventTrackIngestionFailed,
+		Timestamp: time.Now(),
+		URL:       url,
+		Error:     err.Error(),
+	}
+}
+
+// NewWebhookEvent creates an event about a webhook. Events are public, hence
+// only the id of the webhook is included, as the url and the reason of a
+// failure can contain the credentials of the receiver.
+func NewWebhookEvent(eventType string, id WebhookID) Event {
+	return Event{
+		Type:      eventType,
+		Timestamp: time.Now(),
+		WebhookID: id,
+	}
+}
+
+// EventBus distributes events published by one part of the service to all
+// the parts which are interested in them
+type EventBus struct {
+	sync.RWMutex
+	handlers    []func(Event)
+	subscribers map[chan Event]struct{}
+}
+
+// NewEventBus creates a new bus without any handlers or subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Handle registers a handler which is called for every published event,
+// before the publisher continues. Handlers are meant for in-process
+// consumers which must not miss any events.
+func (bus *EventBus) Handle(handler func(Event)) {
+	bus.Lock()
+	defer bus.Unlock()
+	bus.handlers = append(bus.handlers, handler)
+}
+
+// Subscribe returns a channel which receives all published events. If the
+// subscriber lags too far behind the channel is closed.
+func (bus *EventBus) Subscribe() chan Event {
+	ch := make(chan Event, eventBuffer)
+	bus.Lock()
+	defer bus.Unlock()
+	bus.subscribers[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe
+func (bus *EventBus) Unsubscribe(ch chan Event) {
+	bus.Lock()
+	defer bus.Unlock()
+	if _, ok := bus.subscribers[ch]; ok {
+		delete(bus.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish sends an event to all handlers and subscribers
+func (bus *EventBus) Publish(event Event) {
+	bus.RLock()
+	handlers := bus.handlers
+	bus.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+
+	bus.Lock()
+	defer bus.Unlock()
+	for ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.WithField("event", event.Type).Warn("disconnecting event subscriber which is lagging behind")
+			delete(bus.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// EventFilter decides which events are sent to a websocket connection, where
+// empty fields match all events
+type EventFilter struct {
+	Types  []string `json:"types"`
+	Pilot  string   `json:"pilot"`
+	Glider string   `json:"glider"`
+}
+
+// Matches returns true if the event passes the filter. Events which are not
+// about a track never match a filter on pilot or glider.
+func (filter *EventFilter) Matches(event Event) bool {
+	if len(filter.Types) > 0 {
+		found := false
+		for _, t := range filter.Types {
+			found = found || t == event.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.Pilot != "" && (event.Track == nil || !strings.EqualFold(filter.Pilot, event.Track.Pilot)) {
+		return false
+	}
+	if filter.Glider != "" && (event.Track == nil || !strings.EqualFold(filter.Glider, event.Track.Glider)) {
+		return false
+	}
+	return true
+}
+
+// dispatchTrackEvents returns a handler which notifies the ticker and the
+// webhooks of new tracks, and sends other events to the webhooks which are
+// registered for them
+func dispatchTrackEvents(ticker Ticker, webhooks Webhooks) func(Event) {
+	return func(event Event) {
+		if event.Type != EventTrackRegistered {
+			if webhookEventTypes[event.Type] {
+				webhooks.Dispatch(event)
+			}
+			return
+		}
+		// Send the ticker information that we just added a track
+		ticker.Reporter(event.Track.Timestamp)
+		// Trigger webhooks
+		webhooks.Trigger()
+	}
+}
+
+// --------- //
+// EVENT API //
+// --------- //
+
+var eventUpgrader = websocket.Upgrader{
+	// The feed is public and read-only, hence it can be used from any origin
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// eventsWSHandler upgrades the request to a websocket and sends all events
+// which match the filter of the connection as json. The initial filter is
+// given by the query parameters `types` (comma separated), `pilot` and
+// `glider`, and the client can replace it at any time by sending a filter as
+// json.
+func (server *Server) eventsWSHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to stream events")
+
+	query := r.URL.Query()
+	filter := EventFilter{
+		Pilot:  query.Get("pilot"),
+		Glider: query.Get("glider"),
+	}
+	if types := query.Get("types"); types != "" {
+		filter.Types = strings.Split(types, ",")
+	}
+
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded with an error
+		logger.WithField("error", err).Info("unable to upgrade to websocket")
+		return
+	}
+	defer conn.Close()
+
+	events := server.events.Subscribe()
+	defer server.events.Unsubscribe(events)
+
+	// Read filters from the client until the connection is closed
+	filters := make(chan EventFilter)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(closed)
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var filter EventFilter
+			if err := json.Unmarshal(msg, &filter); err != nil {
+				logger.WithField("error", err).Info("ignoring invalid filter from client")
+				continue
+			}
+			select {
+			case filters <- filter:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	logger.WithField("filter", filter).Info("streaming events")
+
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				logger.Info("client lagged behind and was disconnected")
+				return
+			}
+			if !filter.Matches(event) {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				logger.WithField("error", err).Info("unable to send event to client")
+				return
+			}
+		case filter = <-filters:
+			logger.WithField("filter", filter).Info("client changed filter")
+		case <-ping.C:
+			deadline := time.Now().Add(eventWriteTimeout)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				logger.WithField("error", err).Info("unable to ping client")
+				return
+			}
+		case <-closed:
+			logger.Info("client closed event stream")
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package igcserver
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that events reach handlers and subscribers, and that lagging
+// subscribers are disconnected
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+
+	var handled []string
+	bus.Handle(func(event Event) {
+		handled = append(handled, event.Type)
+	})
+	events := bus.Subscribe()
+	lagging := bus.Subscribe()
+
+	for i := 0; i < eventBuffer+1; i++ {
+		bus.Publish(NewTrackEvent(EventTrackRegistered, TrackMeta{ID: TrackID(i)}))
+		<-events
+	}
+	bus.Publish(NewWebhookEvent(EventWebhookDeliveryFailed, 1))
+
+	if len(handled) != eventBuffer+2 {
+		t.Errorf("expected handler to receive %d events, got %d", eventBuffer+2, len(handled))
+	}
+	if event := <-events; event.Type != EventWebhookDeliveryFailed || event.WebhookID != 1 {
+		t.Errorf("expected subscriber to receive failed delivery, got %v", event)
+	}
+
+	count := 0
+	for range lagging {
+		count++
+	}
+	if count != eventBuffer {
+		t.Errorf("expected lagging subscriber to be closed after %d events, got %d", eventBuffer, count)
+	}
+	bus.Unsubscribe(lagging)
+	bus.Unsubscribe(events)
+}
+
+// Test that events are filtered on type, pilot and glider
+func TestEventFilter(t *testing.T) {
+	track := NewTrackEvent(EventTrackRegistered, TrackMeta{Pilot: "John Normal", Glider: "Boeng 777"})
+	webhook := NewWebhookEvent(EventWebhookRegistered, 1)
+
+	for _, data := range []struct {
+		filter EventFilter
+		event  Event
+		expt   bool
+	}{
+		{EventFilter{}, track, true},
+		{EventFilter{}, webhook, true},
+		{EventFilter{Types: []string{EventTrackDeleted, EventTrackRegistered}}, track, true},
+		{EventFilter{Types: []string{EventTrackDeleted}}, track, false},
+		{EventFilter{Pilot: "john normal"}, track, true},
+		{EventFilter{Pilot: "Aladin Special"}, track, false},
+		{EventFilter{Pilot: "John Normal"}, webhook, false},
+		{EventFilter{Glider: "Boeng 777"}, track, true},
+		{EventFilter{Glider: "Magical Carpet"}, track, false},
+	} {
+		if got := data.filter.Matches(data.event); got != data.expt {
+			t.Errorf("expected filter %v to give %t for '%s', got %t", data.filter, data.expt, data.event.Type, got)
+		}
+	}
+}
+
+// Test GET /events/ws with filters from the query and from the client
+func TestIgcServerEventsWS(t *testing.T) {
+	server, fileserver := makeTestServers()
+	defer fileserver.Close()
+	httpServer := httptest.NewServer(&server)
+	defer httpServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/events/ws?pilot=Miguel%20Angel%20Gordillo"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("unable to connect to websocket: %s", err)
+	}
+	defer conn.Close()
+
+	next := func() (event Event) {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("unable to read event: %s", err)
+		}
+		return
+	}
+	do := func(method, path, body string) string {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+testWebhookToken)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != 200 {
+			t.Fatalf("expected `%s %s` to return 200, got '%d'", method, path, code)
+		}
+		return res.Body.String()
+	}
+
+	// Wait for the connection to subscribe to the bus
+	for subscribed := false; !subscribed; {
+		time.Sleep(time.Millisecond)
+		server.events.RLock()
+		subscribed = len(server.events.subscribers) > 0
+		server.events.RUnlock()
+	}
+
+	// The webhook is filtered out because it has no pilot
+	do("POST", "/webhook/new_track", "{\"webhookURL\":\"http://unique.com\"}")
+	do("POST", "/track", fmt.Sprintf("{\"url\":\"%s\"}", fileserver.URL+"/test.igc"))
+
+	event := next()
+	if event.Type != EventTrackRegistered || event.Track == nil || event.Track.Pilot != "Miguel Angel Gordillo" {
+		t.Fatalf("expected registered track of pilot, got %v", event)
+	}
+	id := event.TrackID
+
+	// The first track of the pilot is also a personal best
+	if event := next(); event.Type != EventPersonalBest || event.TrackID != id {
+		t.Fatalf("expected personal best of pilot, got %v", event)
+	}
+	// The only track of the service tops the leaderboard
+	if event := next(); event.Type != EventLeaderboardChange || event.TrackID != id || event.Rank != 1 {
+		t.Fatalf("expected track to top the leaderboard, got %v", event)
+	}
+
+	if err := conn.WriteJSON(EventFilter{Types: []string{EventTrackDeleted, EventWebhookRegistered}}); err != nil {
+		t.Fatalf("unable to send filter: %s", err)
+	}
+	// Give the server time to apply the new filter
+	time.Sleep(50 * time.Millisecond)
+
+	do("DELETE", fmt.Sprintf("/track/%d", id), "")
+	if event := next(); event.Type != EventTrackDeleted || event.TrackID != id {
+		t.Errorf("expected deleted track '%d', got %v", id, event)
+	}
+	webhookID := do("POST", "/webhook/new_track", "{\"webhookURL\":\"http://unique2.com\"}")
+	if event := next(); event.Type != EventWebhookRegistered || fmt.Sprint(event.WebhookID) != webhookID {
+		t.Errorf("expected registered webhook '%s', got %v", webhookID, event)
+	}
+
+	if _, err := server.tracks.Get(id); err != ErrTrackNotFound {
+		t.Errorf("expected deleted track to be removed, got '%v'", err)
+	}
+}
@@ -0,0 +1,138 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/marni/goigc"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// enlMotorThreshold is the engine noise level (0-999) which is considered
+	// to be caused by a running motor
+	enlMotorThreshold = 500
+
+	// enlMotorMinFixes is how many fixes in a row which must be above the
+	// threshold for it to be considered a motor run, to ignore short spikes
+	// of noise
+	enlMotorMinFixes = 3
+)
+
+// FixExtensions contains the typed values of the B-record extensions declared
+// in the I-record, where a missing extension is nil
+type FixExtensions struct {
+	FXA   *int              `json:"fxa,omitempty"`
+	SIU   *int              `json:"siu,omitempty"`
+	ENL   *int              `json:"enl,omitempty"`
+	TAS   *int              `json:"tas,omitempty"`
+	Other map[string]string `json:"other,omitempty"`
+}
+
+// parseFixExtensions converts the raw extension data of a point into typed
+// values, extensions which are unknown or which could not be parsed are kept
+// as strings
+func parseFixExtensions(data map[string]string) (ext FixExtensions) {
+	for code, raw := range data {
+		var field **int
+		switch code {
+		case "FXA":
+			field = &ext.FXA
+		case "SIU":
+			field = &ext.SIU
+		case "ENL":
+			field = &ext.ENL
+		case "TAS":
+			field = &ext.TAS
+		}
+		if field != nil {
+			if v, err := strconv.Atoi(strings.TrimSpace(raw)); err == nil {
+				*field = &v
+				continue
+			}
+		}
+		if ext.Other == nil {
+			ext.Other = make(map[string]string)
+		}
+		ext.Other[code] = raw
+	}
+	return
+}
+
+// hasMotorRun returns true if the engine noise level of the track is above
+// the threshold for several fixes in a row
+func hasMotorRun(points []igc.Point) bool {
+	run := 0
+	for _, point := range points {
+		enl := parseFixExtensions(point.IData).ENL
+		if enl != nil && *enl >= enlMotorThreshold {
+			run++
+			if run >= enlMotorMinFixes {
+				return true
+			}
+		} else {
+			run = 0
+		}
+	}
+	return false
+}
+
+// SeriesFix is a single fix of a track including the extension data
+type SeriesFix struct {
+	Time             time.Time `json:"time"`
+	Lat              float64   `json:"lat"`
+	Lng              float64   `json:"lng"`
+	PressureAltitude int64     `json:"pressure_altitude"`
+	GNSSAltitude     int64     `json:"gnss_altitude"`
+	FixExtensions
+}
+
+// trackSeriesHandler returns all fixes of a specific track
+func (server *Server) trackSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to get series of track")
+
+	vars := mux.Vars(r)
+	idStr, _ := vars["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WithField("id", idStr).Info("id must be a valid number")
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	idlog := logger.WithField("id", id)
+	track, err := server.getTrack(TrackID(id))
+	if err == ErrTrackNotFound {
+		idlog.Info("unable to find track of id")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Error("unable to get track of id")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	series := newTrackSeries(track)
+	fixes := make([]SeriesFix, len(series.points))
+	for i, point := range series.points {
+		fixes[i] = SeriesFix{
+			series.times[i],
+			point.Lat.Degrees(),
+			point.Lng.Degrees(),
+			point.PressureAltitude,
+			point.GNSSAltitude,
+			parseFixExtensions(point.IData),
+		}
+	}
+
+	idlog.WithFields(log.Fields{
+		"fixes": len(fixes),
+	}).Info("responding with series of track")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fixes)
+}
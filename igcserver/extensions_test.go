@@ -0,0 +1,107 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"github.com/marni/goigc"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test that known extensions are typed and unknown extensions are kept
+func TestParseFixExtensions(t *testing.T) {
+	ext := parseFixExtensions(map[string]string{
+		"FXA": "015",
+		"ENL": "821",
+		"SIU": "07",
+		"TAS": "x12",
+		"GSP": "06103",
+	})
+
+	for _, data := range []struct {
+		code string
+		got  *int
+		expt int
+	}{
+		{"FXA", ext.FXA, 15},
+		{"ENL", ext.ENL, 821},
+		{"SIU", ext.SIU, 7},
+	} {
+		if data.got == nil || *data.got != data.expt {
+			t.Errorf("expected %s to be %d, got %v", data.code, data.expt, data.got)
+		}
+	}
+	if ext.TAS != nil {
+		t.Errorf("expected invalid TAS to not be typed, got %d", *ext.TAS)
+	}
+	if ext.Other["TAS"] != "x12" || ext.Other["GSP"] != "06103" {
+		t.Errorf("expected unknown and invalid extensions to be kept, got %v", ext.Other)
+	}
+}
+
+// Test that a motor run is only detected for several fixes with a high
+// engine noise level
+func TestHasMotorRun(t *testing.T) {
+	makePoints := func(enls ...string) (points []igc.Point) {
+		for _, enl := range enls {
+			point := igc.NewPoint()
+			point.IData["ENL"] = enl
+			points = append(points, point)
+		}
+		return
+	}
+
+	for _, data := range []struct {
+		points []igc.Point
+		expt   bool
+	}{
+		{makePoints(), false},
+		{makePoints("010", "020", "015", "012"), false},
+		{makePoints("010", "900", "015", "950", "012"), false},
+		{makePoints("010", "800", "820", "810", "012"), true},
+		{[]igc.Point{igc.NewPoint(), igc.NewPoint(), igc.NewPoint()}, false},
+	} {
+		if got := hasMotorRun(data.points); got != data.expt {
+			t.Errorf("expected motor run to be %t for %v, got %t", data.expt, data.points, got)
+		}
+	}
+}
+
+// Test GET /track/<id>/series
+func TestIgcServerTrackSeries(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
+
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	trackMetasMap.Append(TrackMeta{ID: 1})
+	trackMetasMap.AppendContent(1, string(content))
+
+	req := httptest.NewRequest("GET", "/track/1/series", nil)
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var fixes []SeriesFix
+	if err := json.Unmarshal(res.Body.Bytes(), &fixes); err != nil {
+		t.Errorf("received response body: '%s'", res.Body)
+		t.Fatalf("failed when trying to decode body as json")
+	}
+	if len(fixes) == 0 {
+		t.Fatalf("expected series to contain fixes")
+	}
+	first := fixes[0]
+	if first.FXA == nil || *first.FXA != 6 || first.ENL == nil || *first.ENL != 103 {
+		t.Errorf("expected extensions of first fix to be FXA 6 and ENL 103, got %v", first.FixExtensions)
+	}
+	if first.Other["GSP"] != "00837" || first.Other["TRT"] != "359" {
+		t.Errorf("expected unknown extensions of first fix to be kept, got %v", first.Other)
+	}
+
+	track, _ := igc.Parse(string(content))
+	if !hasMotorRun(track.Points) {
+		t.Errorf("expected motor run to be detected in 'test.igc'")
+	}
+}
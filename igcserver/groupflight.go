@@ -0,0 +1,168 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/marni/goigc"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// groupFlightStep is the time between each sample when checking how
+	// close two tracks were during a flight
+	groupFlightStep = 10 * time.Second
+
+	// groupFlightQueueSize is how many registered tracks can wait to be
+	// linked to group flights
+	groupFlightQueueSize = 64
+)
+
+// GroupFlightConfig decides when two tracks are considered a group flight,
+// which is when the other track was within Distance (in km) of a track for
+// at least Portion (between 0 and 1) of the flight
+type GroupFlightConfig struct {
+	Distance float64
+	Portion  float64
+}
+
+// DefaultGroupFlightConfig is the configuration used by a server unless
+// another configuration is set
+var DefaultGroupFlightConfig = GroupFlightConfig{
+	Distance: 2,
+	Portion:  0.5,
+}
+
+// TrackRelation links a track to another track it flew together with, where
+// portion is how much of the flight they were close to each other
+type TrackRelation struct {
+	ID      TrackID `json:"id" bson:"id"`
+	Portion float64 `json:"portion" bson:"portion"`
+}
+
+// proximityPortion returns how much of the flight of `a` that `b` was within
+// the given distance (in km)
+func proximityPortion(a, b trackSeries, distance float64) float64 {
+	if len(a.times) == 0 || len(b.times) == 0 {
+		return 0
+	}
+	var samples, close int
+	for t := a.start(); !t.After(a.end()); t = t.Add(groupFlightStep) {
+		samples++
+		pa, _ := a.at(t)
+		pb, ok := b.at(t)
+		if ok && pa.Distance(pb) <= distance {
+			close++
+		}
+	}
+	return float64(close) / float64(samples)
+}
+
+// groupFlightLinker starts a worker which links registered and refreshed
+// tracks to group flights, and returns an event handler which queues the
+// tracks for the worker so that registering a track does not wait for the
+// linking. When the
+// queue is full the handler waits for room, so that no track is left
+// unlinked.
+func (server *Server) groupFlightLinker() func(Event) {
+	queue := make(chan TrackMeta, groupFlightQueueSize)
+	go func() {
+		for meta := range queue {
+			track, err := server.getTrack(meta.ID)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"id":    meta.ID,
+					"error": err,
+				}).Error("unable to get track to link to group flights")
+				continue
+			}
+			server.linkGroupFlights(meta, track)
+		}
+	}()
+	return func(event Event) {
+		if event.Type != EventTrackRegistered && event.Type != EventTrackRefreshed {
+			return
+		}
+		queue <- *event.Track
+	}
+}
+
+// linkGroupFlights compares a newly registered track with all other tracks
+// flown on the same date and links the tracks which flew together
+func (server *Server) linkGroupFlights(meta TrackMeta, track igc.Track) {
+	config := server.config.GroupFlight
+	metalog := log.WithField("id", meta.ID)
+
+	candidates, err := server.tracks.GetByDate(meta.Date)
+	if err != nil {
+		metalog.WithField("error", err).Error("unable to get tracks flown on the same date")
+		return
+	}
+
+	series := newTrackSeries(track)
+	for _, candidate := range candidates {
+		if candidate.ID == meta.ID {
+			continue
+		}
+		candlog := metalog.WithField("candidate", candidate.ID)
+		other, err := server.getTrack(candidate.ID)
+		if err != nil {
+			candlog.WithField("error", err).Warn("unable to get track of candidate for group flight")
+			continue
+		}
+		otherSeries := newTrackSeries(other)
+
+		if portion := proximityPortion(series, otherSeries, config.Distance); portion >= config.Portion {
+			candlog.WithField("portion", portion).Info("linking track to group flight")
+			err = server.tracks.AddRelation(meta.ID, TrackRelation{candidate.ID, portion})
+			if err != nil {
+				candlog.WithField("error", err).Error("unable to link track to group flight")
+			}
+		}
+		if portion := proximityPortion(otherSeries, series, config.Distance); portion >= config.Portion {
+			candlog.WithField("portion", portion).Info("linking group flight to track")
+			err = server.tracks.AddRelation(candidate.ID, TrackRelation{meta.ID, portion})
+			if err != nil {
+				candlog.WithField("error", err).Error("unable to link group flight to track")
+			}
+		}
+	}
+}
+
+// trackRelatedHandler returns the tracks which flew together with a specific
+// track
+func (server *Server) trackRelatedHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to get related tracks")
+
+	vars := mux.Vars(r)
+	idStr, _ := vars["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WithField("id", idStr).Info("id must be a valid number")
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	idlog := logger.WithField("id", id)
+	meta, err := server.tracks.Get(TrackID(id))
+	if err == ErrTrackNotFound {
+		idlog.Info("unable to find metadata of id")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Info("error when getting metadata of id")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	related := meta.Related
+	if related == nil {
+		related = []TrackRelation{}
+	}
+	idlog.WithField("related", related).Info("responding with related tracks")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(related)
+}
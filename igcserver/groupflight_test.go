@@ -0,0 +1,181 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/marni/goigc"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Test how much of a flight two tracks are close to each other
+func TestProximityPortion(t *testing.T) {
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	long := newTrackSeries(makeStraightTrack(date, 12*time.Hour, 60, 61))
+	short := newTrackSeries(makeStraightTrack(date, 12*time.Hour, 60, 31))
+	far := newTrackSeries(makeStraightTrack(date, 12*time.Hour, 61, 61))
+
+	for _, data := range []struct {
+		a, b  trackSeries
+		expt  float64
+		about string
+	}{
+		{long, long, 1, "identical tracks"},
+		{short, long, 1, "track flown entirely together with the other"},
+		{long, short, 0.5, "track where the other landed halfway"},
+		{long, far, 0, "tracks far apart"},
+	} {
+		if got := proximityPortion(data.a, data.b, 1); math.Abs(got-data.expt) > 0.02 {
+			t.Errorf("expected portion of %f for %s, got %f", data.expt, data.about, got)
+		}
+	}
+}
+
+// Test that tracks flown together are linked and returned by
+// GET /track/<id>/related
+func TestIgcServerGroupFlight(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
+
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		t.Fatalf("unable to parse 'test.igc': %s", err)
+	}
+
+	first := TrackMeta{ID: 1, Date: track.Date}
+	second := TrackMeta{ID: 2, Date: track.Date}
+	other := TrackMeta{ID: 3, Date: track.Date.AddDate(0, 0, 1)}
+	for _, meta := range []TrackMeta{first, second, other} {
+		trackMetasMap.Append(meta)
+		trackMetasMap.AppendContent(meta.ID, string(content))
+	}
+
+	server.linkGroupFlights(second, track)
+
+	for _, data := range []struct {
+		id   TrackID
+		expt TrackID
+	}{
+		{first.ID, second.ID},
+		{second.ID, first.ID},
+	} {
+		uri := fmt.Sprintf("/track/%d/related", data.id)
+		req := httptest.NewRequest("GET", uri, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		var related []TrackRelation
+		if err := json.Unmarshal(res.Body.Bytes(), &related); err != nil {
+			t.Errorf("received response body: '%s'", res.Body)
+			t.Fatalf("failed when trying to decode body as json")
+		}
+		if len(related) != 1 || related[0].ID != data.expt || related[0].Portion != 1 {
+			t.Errorf("expected `GET %s` to return track '%d' flown entirely together, got %v", uri, data.expt, related)
+		}
+	}
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/track/%d/related", other.ID), nil)
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	if body := res.Body.String(); body != "[]\n" {
+		t.Errorf("expected track flown on another date to have no related tracks, got '%s'", body)
+	}
+}
+
+// Test that registered tracks are linked to group flights by the worker
+func TestGroupFlightLinker(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	ticker := NewTickerDummy(2)
+	webhooks := NewWebhooksMap()
+	server := NewServer(nil, &trackMetasMap, &ticker, &webhooks, nil, nil)
+
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		t.Fatalf("unable to parse 'test.igc': %s", err)
+	}
+
+	first := TrackMeta{ID: 1, Date: track.Date}
+	second := TrackMeta{ID: 2, Date: track.Date}
+	for _, meta := range []TrackMeta{first, second} {
+		trackMetasMap.Append(meta)
+		trackMetasMap.AppendContent(meta.ID, string(content))
+	}
+
+	server.events.Publish(NewTrackEvent(EventTrackRegistered, second))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if meta, _ := trackMetasMap.Get(first.ID); len(meta.Related) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected registered track to be linked to the group flight")
+}
+
+// Test that refreshed tracks are linked to group flights again, and that
+// deleted tracks are removed from the group flights they were in
+func TestGroupFlightRelink(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	ticker := NewTickerDummy(2)
+	webhooks := NewWebhooksMap()
+	server := NewServer(nil, &trackMetasMap, &ticker, &webhooks, nil, nil)
+
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		t.Fatalf("unable to parse 'test.igc': %s", err)
+	}
+
+	first := TrackMeta{ID: 1, Date: track.Date, Related: []TrackRelation{{2, 0.5}}}
+	second := TrackMeta{ID: 2, Date: track.Date, Related: []TrackRelation{{1, 0.5}}}
+	for _, meta := range []TrackMeta{first, second} {
+		trackMetasMap.Append(meta)
+		trackMetasMap.AppendContent(meta.ID, string(content))
+	}
+
+	srcURL, _ := url.Parse("http://a.com/test.igc")
+	if _, err := server.refreshTrack(second, *srcURL, string(content), track); err != nil {
+		t.Fatalf("unable to refresh track: %s", err)
+	}
+	linked := func() bool {
+		a, _ := trackMetasMap.Get(first.ID)
+		b, _ := trackMetasMap.Get(second.ID)
+		return cmp.Equal(a.Related, []TrackRelation{{2, 1}}) && cmp.Equal(b.Related, []TrackRelation{{1, 1}})
+	}
+	deadline := time.Now().Add(time.Second)
+	for !linked() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !linked() {
+		a, _ := trackMetasMap.Get(first.ID)
+		b, _ := trackMetasMap.Get(second.ID)
+		t.Fatalf("expected refreshed track to replace its old group flights, got %v and %v", a.Related, b.Related)
+	}
+
+	if _, err := trackMetasMap.Delete(second.ID); err != nil {
+		t.Fatalf("unable to delete track: %s", err)
+	}
+	if meta, _ := trackMetasMap.Get(first.ID); len(meta.Related) != 0 {
+		t.Errorf("expected deleted track to be removed from group flights, got %v", meta.Related)
+	}
+}
@@ -17,10 +17,44 @@ type Server struct {
 	ticker      Ticker
 	tracks      TrackMetas
 	webhooks    Webhooks
+	config      Config
+	live        LiveTracks
+	events      *EventBus
 }
 
-// NewServer creates a new server which handles requests to the igc api
-func NewServer(httpClient *http.Client, trackMetas TrackMetas, ticker Ticker, webhooks Webhooks) (srv Server) {
+// Config contains the settings of a server, which are fixed when the server
+// is created so that they can be read by its workers without locking
+type Config struct {
+	GroupFlight         GroupFlightConfig
+	WebhookVerification WebhookVerificationConfig
+	Airspaces           []Airspace
+
+	// AdminToken can manage every track, including tracks registered before
+	// tracks had an owner. Tracks without an owner can not be managed if it
+	// is empty.
+	AdminToken string
+}
+
+// DefaultConfig is the configuration used by servers created by NewServer
+var DefaultConfig = Config{
+	GroupFlight:         DefaultGroupFlightConfig,
+	WebhookVerification: DefaultWebhookVerificationConfig,
+}
+
+// NewServer creates a new server which handles requests to the igc api, using
+// the default configuration
+func NewServer(httpClient *http.Client, trackMetas TrackMetas, ticker Ticker, webhooks Webhooks, live LiveTracks, events *EventBus) Server {
+	return NewServerWithConfig(httpClient, trackMetas, ticker, webhooks, live, events, DefaultConfig)
+}
+
+// NewServerWithConfig creates a new server which handles requests to the igc
+// api using the given configuration
+func NewServerWithConfig(httpClient *http.Client, trackMetas TrackMetas, ticker Ticker, webhooks Webhooks, live LiveTracks, events *EventBus, config Config) (srv Server) {
+	if events == nil {
+		events = NewEventBus()
+	}
+	events.Handle(dispatchTrackEvents(ticker, webhooks))
+
 	srv = Server{
 		time.Now(),
 		httpClient,
@@ -28,19 +62,40 @@ func NewServer(httpClient *http.Client, trackMetas TrackMetas, ticker Ticker, we
 		ticker,
 		trackMetas,
 		webhooks,
+		config,
+		live,
+		events,
 	}
 
+	// Link registered tracks to group flights and check them against the
+	// airspaces outside of the registration
+	events.Handle(srv.groupFlightLinker())
+	events.Handle(srv.airspaceChecker())
+
 	srv.router.Use(loggingMiddleware)
 
 	// Webhook API
 	srv.router.HandleFunc("/webhook/new_track", srv.webhookRegHandler).Methods(http.MethodPost)
+	srv.router.HandleFunc("/webhook/new_track", srv.webhookListHandler).Methods(http.MethodGet)
 	srv.router.HandleFunc("/webhook/new_track/{webhookID}", srv.webhookGetHandler).Methods(http.MethodGet)
+	srv.router.HandleFunc("/webhook/new_track/{webhookID}", srv.webhookPatchHandler).Methods(http.MethodPatch)
 	srv.router.HandleFunc("/webhook/new_track/{webhookID}", srv.webhookDeleteHandler).Methods(http.MethodDelete)
+	srv.router.HandleFunc("/webhook/new_track/{webhookID}/verify", srv.webhookVerifyHandler).Methods(http.MethodPost)
+	srv.router.HandleFunc("/webhook/new_track/{webhookID}/pause", srv.webhookPauseHandler).Methods(http.MethodPost)
+	srv.router.HandleFunc("/webhook/new_track/{webhookID}/resume", srv.webhookResumeHandler).Methods(http.MethodPost)
+	srv.router.HandleFunc("/webhook/new_track/{webhookID}/deliveries", srv.webhookDeliveriesHandler).Methods(http.MethodGet)
+	srv.router.HandleFunc(
+		"/webhook/new_track/{webhookID}/deliveries/{deliveryID}/redeliver",
+		srv.webhookRedeliverHandler,
+	).Methods(http.MethodPost)
 
 	// Ticker API
 	srv.router.HandleFunc("/ticker", srv.tickerHandler).Methods(http.MethodGet)
 	srv.router.HandleFunc("/ticker/latest", srv.tickerLatestHandler).Methods(http.MethodGet)
+	srv.router.HandleFunc("/ticker/stream", srv.tickerStreamHandler).Methods(http.MethodGet)
+	srv.router.HandleFunc("/ticker/wait", srv.tickerWaitHandler).Methods(http.MethodGet)
 	srv.router.HandleFunc("/ticker/{timestamp}", srv.tickerAfterHandler).Methods(http.MethodGet)
+	srv.router.HandleFunc("/ticker/before/{timestamp}", srv.tickerBeforeHandler).Methods(http.MethodGet)
 
 	// Igc track API
 	srv.router.HandleFunc("/", srv.metaHandler).Methods(http.MethodGet)
@@ -50,11 +105,43 @@ func NewServer(httpClient *http.Client, trackMetas TrackMetas, ticker Ticker, we
 		"/track/{id}",
 		srv.trackGetHandler,
 	).Methods(http.MethodGet)
+	srv.router.HandleFunc(
+		"/track/{id}",
+		srv.trackDeleteHandler,
+	).Methods(http.MethodDelete)
+	srv.router.HandleFunc(
+		"/track/{id}/refresh",
+		srv.trackRefreshHandler,
+	).Methods(http.MethodPost)
+	srv.router.HandleFunc(
+		"/track/{id}/related",
+		srv.trackRelatedHandler,
+	).Methods(http.MethodGet)
+	srv.router.HandleFunc(
+		"/track/{id}/replay",
+		srv.trackReplayHandler,
+	).Methods(http.MethodGet)
+	srv.router.HandleFunc(
+		"/track/{id}/series",
+		srv.trackSeriesHandler,
+	).Methods(http.MethodGet)
 	srv.router.HandleFunc(
 		"/track/{id}/{field}",
 		srv.trackGetFieldHandler,
 	).Methods(http.MethodGet)
 
+	// Live tracking API
+	srv.router.HandleFunc("/live", srv.liveOpenHandler).Methods(http.MethodPost)
+	srv.router.HandleFunc("/live/{id}/fixes", srv.liveFixesHandler).Methods(http.MethodPost)
+	srv.router.HandleFunc("/live/{id}/stream", srv.liveStreamHandler).Methods(http.MethodGet)
+	srv.router.HandleFunc("/live/{id}/close", srv.liveCloseHandler).Methods(http.MethodPost)
+
+	// Track comparison API
+	srv.router.HandleFunc("/compare", srv.compareHandler).Methods(http.MethodGet)
+
+	// Event API
+	srv.router.HandleFunc("/events/ws", srv.eventsWSHandler).Methods(http.MethodGet)
+
 	srv.router.MethodNotAllowedHandler =
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			logger := newReqLogger(r)
@@ -107,6 +194,9 @@ func (server *Server) metaHandler(w http.ResponseWriter, r *http.Request) {
 		"info":    "Service for Paragliding tracks.",
 		"version": "v1",
 	}
+	if server.webhooks != nil {
+		metadata["webhookQueueDepth"] = server.webhooks.QueueDepth()
+	}
 
 	logger.WithFields(log.Fields(metadata)).Info("responding with metadata")
 
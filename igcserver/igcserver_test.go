@@ -12,6 +12,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -43,6 +44,9 @@ func makeIgcFileServer() *httptest.Server {
 	)
 }
 
+// testWebhookToken is the management token of the webhooks in the testdata
+const testWebhookToken = "test-token"
+
 // Convenience function to create testdata to insert into the database
 func makeWebhooksTestData() []WebhookInfo {
 	return []WebhookInfo{
@@ -51,12 +55,34 @@ func makeWebhooksTestData() []WebhookInfo {
 			"http://unique.com",
 			1,
 			time.Now(),
+			"",
+			WebhookFormatDiscord,
+			"",
+			false,
+			nil,
+			nil,
+			"",
+			hashToken(testWebhookToken),
+			false,
+			false,
+			time.Time{},
 		},
 		{
 			NewWebhookID([]byte("dsa")),
 			"http://unique2.com",
 			2,
 			time.Now(),
+			"",
+			WebhookFormatTemplate,
+			"{{len .Tracks}} new tracks",
+			false,
+			[]string{WebhookEventNewTrack, EventTrackDeleted},
+			&TrackFilter{Pilot: "John Normal", MinLength: 50},
+			"P1DT12H",
+			hashToken(testWebhookToken),
+			false,
+			false,
+			time.Time{},
 		},
 	}
 }
@@ -73,6 +99,12 @@ func makeIGCTestData(serverURL string) []TrackMeta {
 			"MGI2",
 			1200,
 			serverURL + "/aladin.igc",
+			TrackFormatIGC,
+			false,
+			SignatureUnsupported,
+			NewGeoPoint(60.0, 10.0),
+			hashToken(testWebhookToken),
+			nil,
 		},
 		{
 			NewTrackID([]byte("dsa")),
@@ -83,6 +115,12 @@ func makeIGCTestData(serverURL string) []TrackMeta {
 			"BG7",
 			10,
 			serverURL + "/boeng.igc",
+			TrackFormatGPX,
+			true,
+			SignatureMissing,
+			nil,
+			hashToken(testWebhookToken),
+			nil,
 		},
 	}
 }
@@ -101,15 +139,18 @@ func makeTestServers() (server Server, igcFileServer *httptest.Server) {
 	// Setup a in-memory webhooks
 	webhooks := NewWebhooksMap()
 
+	// Setup in-memory live tracks
+	live := NewLiveTracksMap()
+
 	// Initialize main API server
-	server = NewServer(igcFileServer.Client(), &trackMetasMap, &ticker, &webhooks)
+	server = NewServer(igcFileServer.Client(), &trackMetasMap, &ticker, &webhooks, &live, nil)
 	return
 }
 
 // Test GET /
 func TestIgcServerGetMetaValid(t *testing.T) {
 	// We don't need any extra deps to test metadata
-	server := NewServer(nil, nil, nil, nil)
+	server := NewServer(nil, nil, nil, nil, nil, nil)
 
 	req := httptest.NewRequest("GET", "/", nil)
 	res := httptest.NewRecorder()
@@ -128,6 +169,27 @@ func TestIgcServerGetMetaValid(t *testing.T) {
 	}
 }
 
+// Test that GET / contains the queue depth of the webhooks
+func TestIgcServerGetMetaQueueDepth(t *testing.T) {
+	webhooksMap := NewWebhooksMap()
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
+	delivery := NewDelivery(1, []byte("{}"), time.Now())
+	webhooksMap.deliveries[delivery.ID] = delivery
+
+	req := httptest.NewRequest("GET", "/", nil)
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(res.Body.Bytes(), &data); err != nil {
+		t.Fatalf("failed when trying to decode body as json: %s", err)
+	}
+	if depth, ok := data["webhookQueueDepth"].(float64); !ok || depth != 1 {
+		t.Errorf("expected webhook queue depth to be 1, got %v", data["webhookQueueDepth"])
+	}
+}
+
 // Test bad POST /track
 func TestIgcServerPostTrackBad(t *testing.T) {
 	server, fileserver := makeTestServers()
@@ -219,10 +281,197 @@ func TestIgcServerPostTrackValidDuplicate(t *testing.T) {
 
 }
 
+// Test that DELETE /track/<id> requires the token the track was registered
+// with
+func TestIgcServerDeleteTrack(t *testing.T) {
+	server, fileserver := makeTestServers()
+	defer fileserver.Close()
+
+	body := fmt.Sprintf("{\"url\":\"%s\"}", fileserver.URL+"/test.igc")
+	req := httptest.NewRequest("POST", "/track", bytes.NewReader([]byte(body)))
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var data map[string]TrackID
+	if err := json.Unmarshal(res.Body.Bytes(), &data); err != nil {
+		t.Errorf("received response body: '%s'", res.Body)
+		t.Fatalf("failed when trying to decode body as json")
+	}
+	token := res.Header().Get(TokenHeader)
+	if token == "" {
+		t.Fatalf("expected registration to return a generated token")
+	}
+
+	uri := fmt.Sprintf("/track/%d", data["id"])
+	for _, data := range []struct {
+		token string
+		code  int
+	}{
+		{"", 401},
+		{"wrong", 404},
+		{token, 200},
+		{token, 404},
+	} {
+		req := httptest.NewRequest("DELETE", uri, nil)
+		if data.token != "" {
+			req.Header.Set("Authorization", "Bearer "+data.token)
+		}
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != data.code {
+			t.Errorf("expected `DELETE %s` with token '%s' to return %d, got '%d'", uri, data.token, data.code, code)
+		}
+	}
+}
+
+// Test that the admin token can delete any track, including tracks without an
+// owner, and that tracks without an owner can not be deleted otherwise
+func TestIgcServerDeleteTrackAdmin(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	ticker := NewTickerDummy(2)
+	webhooks := NewWebhooksMap()
+	for _, meta := range []TrackMeta{
+		{ID: 1, Owner: hashToken("owner")},
+		{ID: 2},
+		{ID: 3},
+	} {
+		trackMetasMap.Append(meta)
+	}
+	config := DefaultConfig
+	config.AdminToken = "admin"
+	admin := NewServerWithConfig(nil, &trackMetasMap, &ticker, &webhooks, nil, nil, config)
+	server := NewServer(nil, &trackMetasMap, &ticker, &webhooks, nil, nil)
+
+	for _, data := range []struct {
+		server *Server
+		id     TrackID
+		token  string
+		code   int
+	}{
+		{&server, 2, "", 401},
+		{&server, 2, "admin", 404},
+		{&admin, 2, "wrong", 404},
+		{&admin, 2, "admin", 200},
+		{&admin, 1, "admin", 200},
+		{&server, 3, "owner", 404},
+	} {
+		uri := fmt.Sprintf("/track/%d", data.id)
+		req := httptest.NewRequest("DELETE", uri, nil)
+		if data.token != "" {
+			req.Header.Set("Authorization", "Bearer "+data.token)
+		}
+		res := httptest.NewRecorder()
+
+		data.server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != data.code {
+			t.Errorf("expected `DELETE %s` with token '%s' to return %d, got '%d'", uri, data.token, data.code, code)
+		}
+	}
+}
+
+// Test POST /track/<id>/refresh
+func TestIgcServerRefreshTrack(t *testing.T) {
+	full, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read test track: %s", err)
+	}
+	// Keep the header and the first 100 fixes of the track
+	lines := strings.SplitAfter(string(full), "\n")
+	fixes := 0
+	var truncated string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "B") {
+			if fixes++; fixes > 100 {
+				break
+			}
+		}
+		truncated += line
+	}
+
+	content := string(full)
+	fileserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, content)
+	}))
+	defer fileserver.Close()
+	trackMetasMap := NewTrackMetasMap()
+	ticker := NewTickerDummy(2)
+	webhooks := NewWebhooksMap()
+	server := NewServer(fileserver.Client(), &trackMetasMap, &ticker, &webhooks, nil, nil)
+
+	body := fmt.Sprintf("{\"url\":\"%s\"}", fileserver.URL+"/test.igc")
+	req := httptest.NewRequest("POST", "/track", bytes.NewReader([]byte(body)))
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	var data map[string]TrackID
+	if err := json.Unmarshal(res.Body.Bytes(), &data); err != nil {
+		t.Fatalf("unable to register track, got response '%s'", res.Body)
+	}
+	id := data["id"]
+	token := res.Header().Get(TokenHeader)
+	registered, _ := trackMetasMap.Get(id)
+
+	content = truncated
+	events := server.events.Subscribe()
+	defer server.events.Unsubscribe(events)
+
+	uri := fmt.Sprintf("/track/%d/refresh", id)
+	for _, data := range []struct {
+		token string
+		code  int
+	}{
+		{"", 401},
+		{"wrong", 404},
+		{token, 200},
+	} {
+		req := httptest.NewRequest("POST", uri, nil)
+		if data.token != "" {
+			req.Header.Set("Authorization", "Bearer "+data.token)
+		}
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != data.code {
+			t.Errorf("expected `POST %s` with token '%s' to return %d, got '%d'", uri, data.token, data.code, code)
+		}
+	}
+
+	refreshed, _ := trackMetasMap.Get(id)
+	if refreshed.TrackLength >= registered.TrackLength || !refreshed.Timestamp.Equal(registered.Timestamp) || refreshed.Owner != registered.Owner {
+		t.Errorf("expected shorter track with the same timestamp and owner, got %v (was %v)", refreshed, registered)
+	}
+	if stored, _ := trackMetasMap.GetContent(id); stored != truncated {
+		t.Errorf("expected content of track to be replaced")
+	}
+	var published []string
+	for len(events) > 0 {
+		published = append(published, (<-events).Type)
+	}
+	if expt := []string{EventTrackRefreshed, EventPersonalBest, EventLeaderboardChange}; !cmp.Equal(published, expt) {
+		t.Errorf("expected refresh to publish %v, got %v", expt, published)
+	}
+
+	content = "invalid"
+	req = httptest.NewRequest("POST", uri, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if code := res.Result().StatusCode; code != 400 {
+		t.Errorf("expected refreshing to invalid content to return 400, got '%d'", code)
+	}
+	if stored, _ := trackMetasMap.GetContent(id); stored != truncated {
+		t.Errorf("expected content of track to be kept when the refresh fails")
+	}
+}
+
 // Test GET /track
 func TestIgcServerGetTrack(t *testing.T) {
 	trackMetasMap := NewTrackMetasMap()
-	server := NewServer(nil, &trackMetasMap, nil, nil)
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
 
 	testTrackMetas := makeIGCTestData("localhost")
 	ids := make([]TrackID, 0, len(testTrackMetas))
@@ -260,7 +509,7 @@ outer:
 // Test valid GET /track/<id>
 func TestIgcServerGetTrackByIdValid(t *testing.T) {
 	trackMetasMap := NewTrackMetasMap()
-	server := NewServer(nil, &trackMetasMap, nil, nil)
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
 
 	testTrackMetas := makeIGCTestData("localhost")
 	ids := make([]TrackID, 0, len(testTrackMetas))
@@ -296,7 +545,7 @@ func TestIgcServerGetTrackByIdValid(t *testing.T) {
 // Test bad GET /track/<id>
 func TestIgcServerGetTrackByIdBad(t *testing.T) {
 	trackMetasMap := NewTrackMetasMap()
-	server := NewServer(nil, &trackMetasMap, nil, nil)
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
 
 	for _, badID := range []struct {
 		int
@@ -327,7 +576,7 @@ func TestIgcServerGetTrackByIdBad(t *testing.T) {
 // Test valid GET /track/<id>/<field>
 func TestIgcServerGetTrackFieldValid(t *testing.T) {
 	trackMetasMap := NewTrackMetasMap()
-	server := NewServer(nil, &trackMetasMap, nil, nil)
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
 
 	testTrackMetas := makeIGCTestData("localhost")
 	ids := make([]TrackID, 0, len(testTrackMetas))
@@ -351,6 +600,8 @@ func TestIgcServerGetTrackFieldValid(t *testing.T) {
 			"glider",
 			"glider_id",
 			"track_src_url",
+			"source_format",
+			"signature_status",
 		} {
 			uri := fmt.Sprintf("/track/%d/%s", id, field)
 			req := httptest.NewRequest("GET", uri, nil)
@@ -370,6 +621,7 @@ func TestIgcServerGetTrackFieldValid(t *testing.T) {
 		for _, field := range []string{
 			"H_date",
 			"track_length",
+			"motor_run",
 		} {
 			uri := fmt.Sprintf("/track/%d/%s", id, field)
 			req := httptest.NewRequest("GET", uri, nil)
@@ -394,7 +646,7 @@ func TestIgcServerGetTrackFieldValid(t *testing.T) {
 // Test bad GET /track/<id>/<field>
 func TestIgcServerGetTrackFieldBad(t *testing.T) {
 	trackMetasMap := NewTrackMetasMap()
-	server := NewServer(nil, &trackMetasMap, nil, nil)
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
 
 	testTrackMetas := makeIGCTestData("localhost")
 	ids := make([]TrackID, 0, len(testTrackMetas))
@@ -448,7 +700,7 @@ outer:
 
 // Test different rubbish urls -> 404
 func TestIgcServerGetRubbish(t *testing.T) {
-	server := NewServer(nil, nil, nil, nil)
+	server := NewServer(nil, nil, nil, nil, nil, nil)
 
 	rubbishURLs := []string{
 		"/rubbish",
@@ -484,7 +736,7 @@ func TestIgcServerGetRubbish(t *testing.T) {
 
 // Test PUT -> 405 response
 func TestIgcServerPutMethod(t *testing.T) {
-	server := NewServer(nil, nil, nil, nil)
+	server := NewServer(nil, nil, nil, nil, nil, nil)
 
 	req := httptest.NewRequest("PUT", "/", nil)
 	res := httptest.NewRecorder()
@@ -504,7 +756,7 @@ func TestIgcServerPutMethod(t *testing.T) {
 // Test bad GET /webhook/new_track/<id>
 func TestGetWebhookByBadID(t *testing.T) {
 	webhooksMap := NewWebhooksMap()
-	server := NewServer(nil, nil, nil, &webhooksMap)
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
 
 	for _, badID := range []struct {
 		int
@@ -520,6 +772,7 @@ func TestGetWebhookByBadID(t *testing.T) {
 		{404, "99999"},
 	} {
 		req := httptest.NewRequest("GET", "/webhook/new_track/"+badID.string, nil)
+		req.Header.Set("Authorization", "Bearer "+testWebhookToken)
 		res := httptest.NewRecorder()
 
 		server.ServeHTTP(res, req)
@@ -534,7 +787,7 @@ func TestGetWebhookByBadID(t *testing.T) {
 // Test valid GET /webhook/new_track/<id>
 func TestGetWebhookByIdValid(t *testing.T) {
 	webhooksMap := NewWebhooksMap()
-	server := NewServer(nil, nil, nil, &webhooksMap)
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
 
 	testData := makeWebhooksTestData()
 	ids := make([]WebhookID, 0, len(testData))
@@ -550,6 +803,7 @@ func TestGetWebhookByIdValid(t *testing.T) {
 	for i, id := range ids {
 		uri := fmt.Sprintf("/webhook/new_track/%d", id)
 		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("Authorization", "Bearer "+testWebhookToken)
 		res := httptest.NewRecorder()
 
 		server.ServeHTTP(res, req)
@@ -570,10 +824,11 @@ func TestGetWebhookByIdValid(t *testing.T) {
 // Test valid POST /webhook/new_track/
 func TestRegWebhook(t *testing.T) {
 	webhooksMap := NewWebhooksMap()
-	server := NewServer(nil, nil, nil, &webhooksMap)
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
 
 	testData := makeWebhooksTestData()
 	ids := make([]WebhookID, len(testData))
+	tokens := make([]string, len(testData))
 	b := new(bytes.Buffer)
 	for i, webhook := range testData {
 		json.NewEncoder(b).Encode(&webhook)
@@ -592,11 +847,15 @@ func TestRegWebhook(t *testing.T) {
 			t.Fatal("unable to decode response as integer")
 		}
 		ids[i] = WebhookID(id)
+		if tokens[i] = res.Header().Get(TokenHeader); tokens[i] == "" {
+			t.Fatal("expected a management token to be returned")
+		}
 	}
 
 	for i, id := range ids {
 		uri := fmt.Sprintf("/webhook/new_track/%d", id)
 		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[i])
 		res := httptest.NewRecorder()
 
 		server.ServeHTTP(res, req)
@@ -617,7 +876,7 @@ func TestRegWebhook(t *testing.T) {
 // Test invalid POST /webhook/new_track/
 func TestRegWebhookBad(t *testing.T) {
 	webhooksMap := NewWebhooksMap()
-	server := NewServer(nil, nil, nil, &webhooksMap)
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
 
 	var data = []struct {
 		int
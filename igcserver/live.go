@@ -0,0 +1,416 @@
+package igcserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/marni/goigc"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxLiveIdle is how long a live track can go without new fixes before
+	// it is discarded
+	maxLiveIdle = 6 * time.Hour
+
+	// maxLiveRecordsSize is the largest body of records which can be
+	// appended to a live track in one request
+	maxLiveRecordsSize = 1 << 20
+)
+
+var (
+	// liveStreamPollInterval is how often a stream checks the live track for
+	// new fixes, which can be appended through any instance of the service
+	liveStreamPollInterval = time.Second
+)
+
+var (
+	// ErrLiveTrackNotFound is returned if a request did not result in an
+	// open live track
+	ErrLiveTrackNotFound = errors.New("live track not found")
+)
+
+// LiveTracks is a interface for all storages containing live tracks. Live
+// tracks which have been idle for longer than `maxLiveIdle` are never
+// returned.
+type LiveTracks interface {
+	Open(track LiveTrack) error
+	Get(id TrackID) (LiveTrack, error)
+	Append(id TrackID, records string, fixes []ReplayFix) error
+	Claim(id TrackID) (LiveTrack, error)
+	Release(id TrackID, closed bool) error
+}
+
+// LiveOpenRequest is the format of a request to open a live track
+type LiveOpenRequest struct {
+	Pilot    string `json:"pilot"`
+	Glider   string `json:"glider"`
+	GliderID string `json:"glider_id"`
+}
+
+// LiveTrack is a track which is still being flown, where the content is
+// built from the header and all records received so far. A live track is
+// closing while it is being registered, and closed once it is registered.
+type LiveTrack struct {
+	ID      TrackID     `bson:"id"`
+	URLstr  string      `bson:"url"`
+	Owner   string      `bson:"owner"`
+	Header  string      `bson:"header"`
+	Records []string    `bson:"records"`
+	Fixes   []ReplayFix `bson:"fixes"`
+	Updated time.Time   `bson:"updated"`
+	Closing bool        `bson:"closing"`
+	Closed  bool        `bson:"closed"`
+}
+
+// owns checks if the token is the token the track was opened with
+func (track *LiveTrack) owns(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(track.Owner)) == 1
+}
+
+// content returns the igc content of the header and all records
+func (track *LiveTrack) content() string {
+	var content bytes.Buffer
+	content.WriteString(track.Header)
+	for _, records := range track.Records {
+		content.WriteString(records)
+		if len(records) > 0 && records[len(records)-1] != '\n' {
+			content.WriteByte('\n')
+		}
+	}
+	return content.String()
+}
+
+// liveTrackOfRequest gets the open live track of the id in the url, which
+// requires the token the track was opened with as a bearer token, and
+// responds with an error if it is unable to. A wrong token gives the same
+// response as an unknown id.
+func (server *Server) liveTrackOfRequest(w http.ResponseWriter, r *http.Request, logger *log.Entry) (track LiveTrack, ok bool) {
+	id, err := parseLiveID(r)
+	if err != nil {
+		logger.WithField("error", err).Info("id must be a valid number")
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	idlog := logger.WithField("id", id)
+	token := bearerToken(r)
+	if token == "" {
+		idlog.Info("request is missing bearer token")
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	track, err = server.live.Get(id)
+	if err == ErrLiveTrackNotFound {
+		idlog.Info("unable to find live track")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Error("unable to get live track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	if track.Closing || track.Closed || !track.owns(token) {
+		idlog.Info("request to manage live track which is closed or with wrong token")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	}
+	return track, true
+}
+
+// newLiveURL creates a unique url which identifies a live track
+func newLiveURL() (liveURL url.URL, err error) {
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	liveURL = url.URL{Scheme: "live", Opaque: hex.EncodeToString(b)}
+	return
+}
+
+// parseLiveID parses the id of a live track from the url variables
+func parseLiveID(r *http.Request) (id TrackID, err error) {
+	vars := mux.Vars(r)
+	idStr, _ := vars["id"]
+	n, err := strconv.ParseUint(idStr, 10, 32)
+	id = TrackID(n)
+	return
+}
+
+// -------- //
+// LIVE API //
+// -------- //
+
+// liveOpenHandler opens a new live track, the response will be in the
+// following structure
+//
+// ```json
+// {
+//   "id": <TrackID>,
+//   "token": <token to append fixes to and close the track>
+// }
+// ```
+func (server *Server) liveOpenHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to open live track")
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	var req LiveOpenRequest
+	if err := dec.Decode(&req); err != nil {
+		logger.WithField("error", err).Info("unable to decode request body")
+		http.Error(w, "invalid json object", http.StatusBadRequest)
+		return
+	}
+	// Prevent the fields from injecting records into the track
+	for _, field := range []string{req.Pilot, req.Glider, req.GliderID} {
+		if strings.ContainsAny(field, "\r\n") {
+			logger.WithField("field", field).Info("header field contains line break")
+			http.Error(w, "invalid header fields", http.StatusBadRequest)
+			return
+		}
+	}
+	liveURL, err := newLiveURL()
+	if err != nil {
+		logger.WithField("error", err).Error("unable to create url for live track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	token, err := newToken()
+	if err != nil {
+		logger.WithField("error", err).Error("unable to create token for live track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	header := fmt.Sprintf(
+		"HFDTE%s\nHFPLTPILOT:%s\nHFGTYGLIDERTYPE:%s\nHFGIDGLIDERID:%s\n",
+		time.Now().UTC().Format("020106"),
+		req.Pilot,
+		req.Glider,
+		req.GliderID,
+	)
+	if _, err := igc.Parse(header); err != nil {
+		logger.WithField("error", err).Info("unable to create header of live track")
+		http.Error(w, "invalid header fields", http.StatusBadRequest)
+		return
+	}
+
+	id := NewTrackID([]byte(liveURL.String()))
+	err = server.live.Open(LiveTrack{
+		ID:      id,
+		URLstr:  liveURL.String(),
+		Owner:   hashToken(token),
+		Header:  header,
+		Updated: time.Now(),
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("unable to open live track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	result := map[string]interface{}{
+		"id":    id,
+		"token": token,
+	}
+
+	logger.WithField("id", id).Info("responding with id of opened live track")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// liveFixesHandler appends the igc records in the body (normally B-records)
+// to a live track, which requires the token of the track as a bearer token
+func (server *Server) liveFixesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to append fixes to live track")
+
+	track, ok := server.liveTrackOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
+	idlog := logger.WithField("id", track.ID)
+	records, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLiveRecordsSize))
+	if err != nil {
+		idlog.WithField("error", err).Info("unable to read request body")
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+	// The records are parsed in the context of the header of the track
+	parsed, err := igc.Parse(track.Header + string(records))
+	if err != nil {
+		idlog.WithField("error", err).Info("unable to parse igc records")
+		http.Error(w, "unable to parse igc records", http.StatusBadRequest)
+		return
+	}
+	fixes := mergeFixes([]TrackID{track.ID}, []igc.Track{parsed})
+	err = server.live.Append(track.ID, string(records), fixes)
+	if err == ErrLiveTrackNotFound {
+		idlog.Info("live track was closed before the fixes were appended")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Error("unable to append fixes to live track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	result := map[string]interface{}{
+		"fixes": len(fixes),
+	}
+
+	idlog.WithField("fixes", len(fixes)).Info("appended fixes to live track")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// liveStreamHandler streams all fixes of a live track as Server-Sent Events,
+// starting with the fixes received before the client subscribed. New fixes
+// are polled for, so that fixes appended through other instances of the
+// service are streamed as well.
+func (server *Server) liveStreamHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to stream live track")
+
+	id, err := parseLiveID(r)
+	if err != nil {
+		logger.WithField("error", err).Info("id must be a valid number")
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	idlog := logger.WithField("id", id)
+	track, err := server.live.Get(id)
+	if err == ErrLiveTrackNotFound {
+		idlog.Info("unable to find live track")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Error("unable to get live track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	stream, err := newEventStream(w)
+	if err != nil {
+		idlog.WithField("error", err).Error("unable to stream live track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	idlog.Info("streaming live track")
+
+	poll := time.NewTicker(liveStreamPollInterval)
+	defer poll.Stop()
+	sent := 0
+	for {
+		for _, fix := range track.Fixes[sent:] {
+			if err := stream.Send("fix", "", fix); err != nil {
+				idlog.WithField("error", err).Info("unable to send fix to client")
+				return
+			}
+		}
+		sent = len(track.Fixes)
+		if track.Closed {
+			stream.Send("end", "", map[string]interface{}{"id": id})
+			idlog.Info("live track was closed")
+			return
+		}
+
+		select {
+		case <-poll.C:
+		case <-r.Context().Done():
+			idlog.Info("client stopped streaming live track")
+			return
+		}
+		track, err = server.live.Get(id)
+		if err == ErrLiveTrackNotFound {
+			stream.Send("end", "", map[string]interface{}{"id": id})
+			idlog.Info("live track was discarded")
+			return
+		} else if err != nil {
+			idlog.WithField("error", err).Error("unable to get live track")
+			return
+		}
+	}
+}
+
+// liveCloseHandler finalizes a live track into a normal track, which requires
+// the token of the track as a bearer token. The response will be in the
+// following structure
+//
+// ```json
+// {
+//   "id": <TrackID>
+// }
+// ```
+func (server *Server) liveCloseHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to close live track")
+
+	track, ok := server.liveTrackOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
+	idlog := logger.WithField("id", track.ID)
+
+	// No more fixes are accepted while the track is registered, and the
+	// track is only closed if it was registered
+	track, err := server.live.Claim(track.ID)
+	if err == ErrLiveTrackNotFound {
+		idlog.Info("live track was closed by another request")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Error("unable to claim live track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	liveURL, _ := url.Parse(track.URLstr)
+	content := track.content()
+	parsed, err := igc.Parse(content)
+	var trackMeta TrackMeta
+	if err == nil {
+		// The track can be deleted using the token of the live track
+		trackMeta, err = server.registerTrack(*liveURL, content, parsed, track.Owner)
+	}
+	if rerr := server.live.Release(track.ID, err == nil); rerr != nil {
+		idlog.WithField("error", rerr).Error("unable to release live track")
+	}
+	if err == ErrTrackAlreadyExists {
+		idlog.Info("live track was already registered")
+		http.Error(w, "track already exists", http.StatusForbidden)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Error("unable to register live track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	result := map[string]interface{}{
+		"id": trackMeta.ID,
+	}
+
+	idlog.WithFields(log.Fields{
+		"trackmeta": trackMeta,
+	}).Info("responding with id of finalized live track")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
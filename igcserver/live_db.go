@@ -0,0 +1,124 @@
+package igcserver
+
+import (
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const liveCollection = "live"
+
+// LiveTracksDB contains all live tracks in a mongodb, so that a live track
+// can be appended to and streamed through any instance of the service
+type LiveTracksDB struct {
+	session *mgo.Session
+}
+
+// NewLiveTracksDB creates a new storage of live tracks, where live tracks are
+// removed by the database when they have been idle for `maxLiveIdle`
+func NewLiveTracksDB(session *mgo.Session) LiveTracksDB {
+	conn := session.Copy()
+	defer conn.Close()
+	live := conn.DB("").C(liveCollection)
+	err := live.EnsureIndex(mgo.Index{
+		Key:    []string{"id"},
+		Unique: true,
+	})
+	if err == nil {
+		err = live.EnsureIndex(mgo.Index{
+			Key:         []string{"updated"},
+			ExpireAfter: maxLiveIdle,
+		})
+	}
+	if err != nil {
+		log.WithField("error", err).Error("unable to ensure indexes of live tracks")
+	}
+
+	return LiveTracksDB{
+		session,
+	}
+}
+
+// notIdle adds to a query that the live track has been updated recently, as
+// the database only removes idle live tracks periodically
+func notIdle(query bson.M) bson.M {
+	query["updated"] = bson.M{"$gt": time.Now().Add(-maxLiveIdle)}
+	return query
+}
+
+// Open adds a new live track
+func (live *LiveTracksDB) Open(track LiveTrack) (err error) {
+	conn := live.session.Copy()
+	defer conn.Close()
+
+	return conn.DB("").C(liveCollection).Insert(track)
+}
+
+// Get fetches the live track of a specific id if it exists
+func (live *LiveTracksDB) Get(id TrackID) (track LiveTrack, err error) {
+	conn := live.session.Copy()
+	defer conn.Close()
+
+	err = conn.DB("").C(liveCollection).Find(notIdle(bson.M{"id": id})).One(&track)
+	if err == mgo.ErrNotFound {
+		err = ErrLiveTrackNotFound
+	}
+	return
+}
+
+// Append adds records and the fixes parsed from them to a live track, unless
+// the live track is closing or closed
+func (live *LiveTracksDB) Append(id TrackID, records string, fixes []ReplayFix) (err error) {
+	conn := live.session.Copy()
+	defer conn.Close()
+
+	err = conn.DB("").C(liveCollection).Update(
+		notIdle(bson.M{"id": id, "closing": false, "closed": false}),
+		bson.M{
+			"$push": bson.M{
+				"records": records,
+				"fixes":   bson.M{"$each": fixes},
+			},
+			"$set": bson.M{"updated": time.Now()},
+		},
+	)
+	if err == mgo.ErrNotFound {
+		err = ErrLiveTrackNotFound
+	}
+	return
+}
+
+// Claim marks a live track as closing and returns it, so that no more fixes
+// are accepted while it is registered
+func (live *LiveTracksDB) Claim(id TrackID) (track LiveTrack, err error) {
+	conn := live.session.Copy()
+	defer conn.Close()
+
+	_, err = conn.DB("").C(liveCollection).Find(
+		notIdle(bson.M{"id": id, "closing": false, "closed": false}),
+	).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"closing": true}},
+		ReturnNew: true,
+	}, &track)
+	if err == mgo.ErrNotFound {
+		err = ErrLiveTrackNotFound
+	}
+	return
+}
+
+// Release ends the claim of a live track, which is closed if it was
+// registered and otherwise accepts fixes again
+func (live *LiveTracksDB) Release(id TrackID, closed bool) (err error) {
+	conn := live.session.Copy()
+	defer conn.Close()
+
+	err = conn.DB("").C(liveCollection).Update(
+		bson.M{"id": id},
+		bson.M{"$set": bson.M{"closing": false, "closed": closed}},
+	)
+	if err == mgo.ErrNotFound {
+		err = ErrLiveTrackNotFound
+	}
+	return
+}
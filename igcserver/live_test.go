@@ -0,0 +1,422 @@
+package igcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Convenience function to get the B-records of 'test.igc'
+func readTestFixes(t *testing.T) []string {
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	var records []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "B") {
+			records = append(records, strings.TrimSpace(line))
+		}
+	}
+	return records
+}
+
+// liveOpened is the response when opening a live track
+type liveOpened struct {
+	ID    TrackID `json:"id"`
+	Token string  `json:"token"`
+}
+
+// LiveTracksMap is an in-memory storage of live tracks
+type LiveTracksMap struct {
+	sync.RWMutex
+	data map[TrackID]LiveTrack
+}
+
+// NewLiveTracksMap creates a new empty storage of live tracks
+func NewLiveTracksMap() LiveTracksMap {
+	return LiveTracksMap{
+		sync.RWMutex{},
+		make(map[TrackID]LiveTrack),
+	}
+}
+
+// get fetches a live track which is not idle, while the map is locked
+func (live *LiveTracksMap) get(id TrackID) (track LiveTrack, err error) {
+	track, ok := live.data[id]
+	if !ok || time.Since(track.Updated) > maxLiveIdle {
+		err = ErrLiveTrackNotFound
+	}
+	return
+}
+
+// Open adds a new live track
+func (live *LiveTracksMap) Open(track LiveTrack) (err error) {
+	live.Lock()
+	defer live.Unlock()
+	live.data[track.ID] = track
+	return
+}
+
+// Get fetches the live track of a specific id if it exists
+func (live *LiveTracksMap) Get(id TrackID) (track LiveTrack, err error) {
+	live.RLock()
+	defer live.RUnlock()
+	track, err = live.get(id)
+	// The slices are copied so that they are not changed by later appends
+	track.Records = append([]string(nil), track.Records...)
+	track.Fixes = append([]ReplayFix(nil), track.Fixes...)
+	return
+}
+
+// Append adds records and the fixes parsed from them to a live track, unless
+// the live track is closing or closed
+func (live *LiveTracksMap) Append(id TrackID, records string, fixes []ReplayFix) (err error) {
+	live.Lock()
+	defer live.Unlock()
+	track, err := live.get(id)
+	if err != nil || track.Closing || track.Closed {
+		return ErrLiveTrackNotFound
+	}
+	track.Records = append(track.Records, records)
+	track.Fixes = append(track.Fixes, fixes...)
+	track.Updated = time.Now()
+	live.data[id] = track
+	return
+}
+
+// Claim marks a live track as closing and returns it
+func (live *LiveTracksMap) Claim(id TrackID) (track LiveTrack, err error) {
+	live.Lock()
+	defer live.Unlock()
+	track, err = live.get(id)
+	if err != nil || track.Closing || track.Closed {
+		return LiveTrack{}, ErrLiveTrackNotFound
+	}
+	track.Closing = true
+	live.data[id] = track
+	return
+}
+
+// Release ends the claim of a live track, closing it if it was registered
+func (live *LiveTracksMap) Release(id TrackID, closed bool) (err error) {
+	live.Lock()
+	defer live.Unlock()
+	track, ok := live.data[id]
+	if !ok {
+		return ErrLiveTrackNotFound
+	}
+	track.Closing = false
+	track.Closed = closed
+	live.data[id] = track
+	return
+}
+
+// Test opening, streaming and closing a live track
+func TestIgcServerLive(t *testing.T) {
+	liveStreamPollInterval = 10 * time.Millisecond
+	defer func() { liveStreamPollInterval = time.Second }()
+
+	server, fileserver := makeTestServers()
+	defer fileserver.Close()
+
+	body := "{\"pilot\":\"Aladin Special\",\"glider\":\"Magical Carpet\",\"glider_id\":\"MGI2\"}"
+	req := httptest.NewRequest("POST", "/live", strings.NewReader(body))
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var opened liveOpened
+	if err := json.Unmarshal(res.Body.Bytes(), &opened); err != nil {
+		t.Errorf("received response body: '%s'", res.Body)
+		t.Fatalf("failed when trying to decode body as json")
+	}
+	id := opened.ID
+
+	records := readTestFixes(t)
+	half := len(records) / 2
+	appendFixes := func(records []string) {
+		uri := fmt.Sprintf("/live/%d/fixes", id)
+		req := httptest.NewRequest("POST", uri, strings.NewReader(strings.Join(records, "\n")))
+		req.Header.Set("Authorization", "Bearer "+opened.Token)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != 200 {
+			t.Fatalf("expected `POST %s` to return 200, got '%d'", uri, code)
+		}
+	}
+	appendFixes(records[:half])
+
+	streamed := make(chan string)
+	go func() {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/live/%d/stream", id), nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		streamed <- res.Body.String()
+	}()
+
+	// The stream polls the live track, so the fixes appended after it
+	// started are streamed as well
+	appendFixes(records[half:])
+
+	req = httptest.NewRequest("POST", fmt.Sprintf("/live/%d/close", id), nil)
+	req.Header.Set("Authorization", "Bearer "+opened.Token)
+	res = httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var closed map[string]TrackID
+	if err := json.Unmarshal(res.Body.Bytes(), &closed); err != nil {
+		t.Errorf("received response body: '%s'", res.Body)
+		t.Fatalf("failed when trying to decode body as json")
+	}
+	if closed["id"] != id {
+		t.Errorf("expected finalized track to keep the id '%d', got '%d'", id, closed["id"])
+	}
+
+	select {
+	case stream := <-streamed:
+		// Some fixes are dropped because they go back in time
+		if got := strings.Count(stream, "event: fix\n"); got < len(records)-10 {
+			t.Errorf("expected stream to contain all %d fixes, got %d", len(records), got)
+		}
+		if !strings.Contains(stream, "event: end\n") {
+			t.Errorf("expected stream to end when live track was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream did not end when live track was closed")
+	}
+
+	meta, err := server.tracks.Get(id)
+	if err != nil {
+		t.Fatalf("unable to get finalized track: %s", err)
+	}
+	if meta.Pilot != "Aladin Special" || meta.TrackLength == 0 {
+		t.Errorf("unexpected metadata of finalized track: %v", meta)
+	}
+
+	req = httptest.NewRequest("POST", fmt.Sprintf("/live/%d/fixes", id), bytes.NewReader([]byte(records[0])))
+	req.Header.Set("Authorization", "Bearer "+opened.Token)
+	res = httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	if code := res.Result().StatusCode; code != 404 {
+		t.Errorf("expected appending to a closed live track to return 404, got '%d'", code)
+	}
+}
+
+// Test bad requests to the live API
+func TestIgcServerLiveBad(t *testing.T) {
+	server, fileserver := makeTestServers()
+	defer fileserver.Close()
+
+	req := httptest.NewRequest("POST", "/live", strings.NewReader("{}"))
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var opened liveOpened
+	if err := json.Unmarshal(res.Body.Bytes(), &opened); err != nil {
+		t.Errorf("received response body: '%s'", res.Body)
+		t.Fatalf("failed when trying to decode body as json")
+	}
+	id := opened.ID
+
+	for _, data := range []struct {
+		code   int
+		method string
+		uri    string
+		token  string
+		body   string
+	}{
+		{400, "POST", "/live", "", "{\"pilot\":\"a\\nB1522224014028N00401933WA005380063200610300837359\"}"},
+		{400, "POST", "/live", "", "{\"unknown\":1}"},
+		{400, "POST", fmt.Sprintf("/live/%d/fixes", id), opened.Token, "B15222"},
+		{400, "POST", "/live/abc/fixes", opened.Token, ""},
+		{401, "POST", fmt.Sprintf("/live/%d/fixes", id), "", ""},
+		{401, "POST", fmt.Sprintf("/live/%d/close", id), "", ""},
+		{404, "POST", fmt.Sprintf("/live/%d/fixes", id), "wrong", ""},
+		{404, "POST", fmt.Sprintf("/live/%d/close", id), "wrong", ""},
+		{404, "POST", "/live/1/fixes", opened.Token, ""},
+		{404, "GET", "/live/1/stream", "", ""},
+		{404, "POST", "/live/1/close", opened.Token, ""},
+	} {
+		req := httptest.NewRequest(data.method, data.uri, strings.NewReader(data.body))
+		if data.token != "" {
+			req.Header.Set("Authorization", "Bearer "+data.token)
+		}
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		code := res.Result().StatusCode
+		if code != data.code {
+			t.Errorf("expected `%s %s` to return '%d', got '%d'", data.method, data.uri, data.code, code)
+		}
+	}
+}
+
+// Test that a live track does not accept fixes while it is registered, that
+// it accepts fixes again if it could not be registered and that idle live
+// tracks are discarded
+func testLiveTracks(t *testing.T, live LiveTracks) {
+	open := func(name string, updated time.Time) TrackID {
+		id := NewTrackID([]byte(name))
+		err := live.Open(LiveTrack{ID: id, URLstr: "live:" + name, Owner: hashToken(name), Header: "HFDTE010118\n", Updated: updated})
+		if err != nil {
+			t.Fatalf("unable to open live track: %s", err)
+		}
+		return id
+	}
+	first, second := open("first", time.Now()), open("second", time.Now())
+	idle := open("idle", time.Now().Add(-maxLiveIdle-time.Minute))
+	fix := ReplayFix{first, time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC), 60, 10, 1000}
+
+	if err := live.Append(first, "B1", []ReplayFix{fix}); err != nil {
+		t.Fatalf("unable to append to live track: %s", err)
+	}
+	claimed, err := live.Claim(first)
+	if err != nil || !claimed.Closing || !cmp.Equal(claimed.Records, []string{"B1"}) || len(claimed.Fixes) != 1 {
+		t.Fatalf("expected claimed live track with its records and fixes, got %v (%v)", claimed, err)
+	}
+	if _, err := live.Claim(first); err != ErrLiveTrackNotFound {
+		t.Errorf("expected live track to only be claimed once, got '%v'", err)
+	}
+	if err := live.Append(first, "B2", nil); err != ErrLiveTrackNotFound {
+		t.Errorf("expected live track which is being registered to reject fixes, got '%v'", err)
+	}
+	if err := live.Append(second, "B2", nil); err != nil {
+		t.Errorf("expected other live tracks to accept fixes while registering, got '%s'", err)
+	}
+
+	// A live track which could not be registered accepts fixes again
+	if err := live.Release(first, false); err != nil {
+		t.Fatalf("unable to release live track: %s", err)
+	}
+	if err := live.Append(first, "B2", nil); err != nil {
+		t.Errorf("expected released live track to accept fixes, got '%v'", err)
+	}
+
+	if _, err := live.Claim(first); err != nil {
+		t.Fatalf("unable to claim live track: %s", err)
+	}
+	if err := live.Release(first, true); err != nil {
+		t.Fatalf("unable to release live track: %s", err)
+	}
+	if track, err := live.Get(first); err != nil || !track.Closed || !cmp.Equal(track.Records, []string{"B1", "B2"}) {
+		t.Errorf("expected closed live track to keep its records for streams, got %v (%v)", track, err)
+	}
+	if err := live.Append(first, "B3", nil); err != ErrLiveTrackNotFound {
+		t.Errorf("expected closed live track to reject fixes, got '%v'", err)
+	}
+	if _, err := live.Claim(first); err != ErrLiveTrackNotFound {
+		t.Errorf("expected closed live track not to be claimed, got '%v'", err)
+	}
+
+	if _, err := live.Get(idle); err != ErrLiveTrackNotFound {
+		t.Errorf("expected idle live track to be discarded, got '%v'", err)
+	}
+	if err := live.Append(idle, "B1", nil); err != ErrLiveTrackNotFound {
+		t.Errorf("expected idle live track to reject fixes, got '%v'", err)
+	}
+}
+
+func TestLiveTracksMap(t *testing.T) {
+	live := NewLiveTracksMap()
+	testLiveTracks(t, &live)
+}
+
+func TestLiveTracksDB(t *testing.T) {
+	session := makeTestSession(t)
+	defer session.Close()
+	defer session.DB("").DropDatabase()
+
+	live := NewLiveTracksDB(session.Copy())
+	testLiveTracks(t, &live)
+}
+
+// Test that a live track can be streamed through another instance of the
+// service than the one its fixes are appended through
+func TestIgcServerLiveInstances(t *testing.T) {
+	liveStreamPollInterval = 10 * time.Millisecond
+	defer func() { liveStreamPollInterval = time.Second }()
+
+	trackMetasMap := NewTrackMetasMap()
+	ticker := NewTickerDummy(2)
+	webhooks := NewWebhooksMap()
+	live := NewLiveTracksMap()
+	first := NewServer(nil, &trackMetasMap, &ticker, &webhooks, &live, nil)
+	second := NewServer(nil, &trackMetasMap, &ticker, &webhooks, &live, nil)
+
+	res := httptest.NewRecorder()
+	first.ServeHTTP(res, httptest.NewRequest("POST", "/live", strings.NewReader("{}")))
+	var opened liveOpened
+	if err := json.Unmarshal(res.Body.Bytes(), &opened); err != nil {
+		t.Fatalf("unable to open live track, got response '%s'", res.Body)
+	}
+
+	records := readTestFixes(t)[:10]
+	for i, server := range []*Server{&first, &second} {
+		uri := fmt.Sprintf("/live/%d/fixes", opened.ID)
+		req := httptest.NewRequest("POST", uri, strings.NewReader(records[i]))
+		req.Header.Set("Authorization", "Bearer "+opened.Token)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != 200 {
+			t.Fatalf("expected `POST %s` to instance %d to return 200, got '%d'", uri, i, code)
+		}
+	}
+
+	req := httptest.NewRequest("POST", fmt.Sprintf("/live/%d/close", opened.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+opened.Token)
+	res = httptest.NewRecorder()
+	second.ServeHTTP(res, req)
+	if code := res.Result().StatusCode; code != 200 {
+		t.Fatalf("expected closing through another instance to return 200, got '%d'", code)
+	}
+
+	res = httptest.NewRecorder()
+	first.ServeHTTP(res, httptest.NewRequest("GET", fmt.Sprintf("/live/%d/stream", opened.ID), nil))
+	if stream := res.Body.String(); strings.Count(stream, "event: fix\n") != 2 || !strings.Contains(stream, "event: end\n") {
+		t.Errorf("expected stream to contain the fixes from both instances, got '%s'", stream)
+	}
+}
+
+// Test that the body of records appended to a live track is limited
+func TestIgcServerLiveFixesLimit(t *testing.T) {
+	server, fileserver := makeTestServers()
+	defer fileserver.Close()
+
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, httptest.NewRequest("POST", "/live", strings.NewReader("{}")))
+	var opened liveOpened
+	if err := json.Unmarshal(res.Body.Bytes(), &opened); err != nil {
+		t.Fatalf("unable to open live track, got response '%s'", res.Body)
+	}
+
+	record := readTestFixes(t)[0] + "\n"
+	body := strings.Repeat(record, maxLiveRecordsSize/len(record)+1)
+	req := httptest.NewRequest("POST", fmt.Sprintf("/live/%d/fixes", opened.ID), strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+opened.Token)
+	res = httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	if code := res.Result().StatusCode; code != 400 {
+		t.Errorf("expected too large body of records to return 400, got '%d'", code)
+	}
+}
@@ -0,0 +1,149 @@
+package igcserver
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/marni/goigc"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxReplayTracks is the maximum amount of tracks which can be replayed
+	// in a single stream
+	maxReplayTracks = 10
+)
+
+// ReplayFix is a single fix of a track sent to clients replaying a track
+type ReplayFix struct {
+	ID       TrackID   `json:"id"`
+	Time     time.Time `json:"time"`
+	Lat      float64   `json:"lat"`
+	Lng      float64   `json:"lng"`
+	Altitude int64     `json:"altitude"`
+}
+
+// mergeFixes merges the fixes of several tracks into a single list ordered by
+// absolute time
+func mergeFixes(ids []TrackID, tracks []igc.Track) (fixes []ReplayFix) {
+	for i, track := range tracks {
+		series := newTrackSeries(track)
+		for j, point := range series.points {
+			fixes = append(fixes, ReplayFix{
+				ids[i],
+				series.times[j],
+				point.Lat.Degrees(),
+				point.Lng.Degrees(),
+				altitude(point),
+			})
+		}
+	}
+	sort.SliceStable(fixes, func(i, j int) bool {
+		return fixes[i].Time.Before(fixes[j].Time)
+	})
+	return
+}
+
+// ---------- //
+// REPLAY API //
+// ---------- //
+
+// trackReplayHandler streams the fixes of a track as Server-Sent Events in
+// real time scaled by `?speed=<factor>`, other tracks can be replayed in the
+// same stream using `?with=<id1>,<id2>`
+func (server *Server) trackReplayHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to replay track")
+
+	vars := mux.Vars(r)
+	idStr, _ := vars["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WithField("id", idStr).Info("id must be a valid number")
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	ids := []TrackID{TrackID(id)}
+
+	query := r.URL.Query()
+	if withStr := query.Get("with"); withStr != "" {
+		with, err := parseTrackIDs(withStr)
+		if err != nil {
+			logger.WithField("error", err).Info("unable to parse track ids to replay with")
+			http.Error(w, "invalid ids", http.StatusBadRequest)
+			return
+		}
+		for _, other := range with {
+			if other != ids[0] {
+				ids = append(ids, other)
+			}
+		}
+	}
+	if len(ids) > maxReplayTracks {
+		logger.WithField("ids", ids).Info("too many tracks to replay")
+		http.Error(w, "too many ids", http.StatusBadRequest)
+		return
+	}
+	speed := 1.0
+	if speedStr := query.Get("speed"); speedStr != "" {
+		speed, err = strconv.ParseFloat(speedStr, 64)
+		if err != nil || speed <= 0 {
+			logger.WithField("speed", speedStr).Info("speed must be a positive number")
+			http.Error(w, "invalid speed", http.StatusBadRequest)
+			return
+		}
+	}
+
+	idlog := logger.WithFields(log.Fields{
+		"ids":   ids,
+		"speed": speed,
+	})
+	tracks := make([]igc.Track, len(ids))
+	for i, id := range ids {
+		tracks[i], err = server.getTrack(id)
+		if err == ErrTrackNotFound {
+			idlog.WithField("id", id).Info("unable to find track of id")
+			http.Error(w, "content not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			idlog.WithFields(log.Fields{
+				"id":    id,
+				"error": err,
+			}).Error("unable to get track of id")
+			http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+			return
+		}
+	}
+	fixes := mergeFixes(ids, tracks)
+
+	stream, err := newEventStream(w)
+	if err != nil {
+		idlog.WithField("error", err).Error("unable to stream replay")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	idlog.WithField("fixes", len(fixes)).Info("streaming replay of tracks")
+
+	start := time.Now()
+	for _, fix := range fixes {
+		// Wait until the fix would have been recorded, scaled by the speed
+		elapsed := time.Duration(float64(fix.Time.Sub(fixes[0].Time)) / speed)
+		if wait := elapsed - time.Since(start); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				idlog.Info("client stopped replay")
+				return
+			}
+		}
+		if err := stream.Send("fix", "", fix); err != nil {
+			idlog.WithField("error", err).Info("unable to send fix to client")
+			return
+		}
+	}
+	stream.Send("end", "", map[string]interface{}{"tracks": ids})
+	idlog.Info("finished replay of tracks")
+}
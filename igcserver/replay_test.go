@@ -0,0 +1,106 @@
+package igcserver
+
+import (
+	"fmt"
+	"github.com/marni/goigc"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that fixes of several tracks are merged in order of time
+func TestMergeFixes(t *testing.T) {
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	early := makeStraightTrack(date, 12*time.Hour, 60, 10)
+	late := makeStraightTrack(date, 12*time.Hour+5*time.Second, 61, 10)
+
+	fixes := mergeFixes([]TrackID{1, 2}, []igc.Track{early, late})
+	if len(fixes) != 20 {
+		t.Fatalf("expected 20 fixes, got %d", len(fixes))
+	}
+	for i, fix := range fixes {
+		if expt := TrackID(i%2 + 1); fix.ID != expt {
+			t.Errorf("expected fix %d to belong to track %d, got %d", i, expt, fix.ID)
+		}
+		if i > 0 && fix.Time.Before(fixes[i-1].Time) {
+			t.Errorf("fix %d is before the previous fix", i)
+		}
+	}
+}
+
+// Test GET /track/<id>/replay
+func TestIgcServerReplay(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
+
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		t.Fatalf("unable to parse 'test.igc': %s", err)
+	}
+	fixCount := len(newTrackSeries(track).points)
+	for _, id := range []TrackID{1, 2} {
+		trackMetasMap.Append(TrackMeta{ID: id})
+		trackMetasMap.AppendContent(id, string(content))
+	}
+
+	for _, data := range []struct {
+		query string
+		fixes int
+	}{
+		{"speed=1000000", fixCount},
+		{"speed=1000000&with=1", fixCount},
+		{"speed=1000000&with=2", 2 * fixCount},
+	} {
+		uri := fmt.Sprintf("/track/1/replay?%s", data.query)
+		req := httptest.NewRequest("GET", uri, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if ct := res.Result().Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("expected `GET %s` to respond with an event stream, got '%s'", uri, ct)
+		}
+		body := res.Body.String()
+		if got := strings.Count(body, "event: fix\n"); got != data.fixes {
+			t.Errorf("expected `GET %s` to send %d fixes, got %d", uri, data.fixes, got)
+		}
+		if !strings.Contains(body, "event: end\n") {
+			t.Errorf("expected `GET %s` to end the replay", uri)
+		}
+	}
+}
+
+// Test bad GET /track/<id>/replay
+func TestIgcServerReplayBad(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
+	trackMetasMap.Append(TrackMeta{ID: 1})
+	trackMetasMap.AppendContent(1, "")
+
+	for _, data := range []struct {
+		code int
+		uri  string
+	}{
+		{400, "/track/1/replay?speed=0"},
+		{400, "/track/1/replay?speed=fast"},
+		{400, "/track/1/replay?with=a"},
+		{404, "/track/2/replay"},
+		{404, "/track/1/replay?with=2"},
+	} {
+		req := httptest.NewRequest("GET", data.uri, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		code := res.Result().StatusCode
+		if code != data.code {
+			t.Errorf("expected `GET %s` to return '%d', got '%d'", data.uri, data.code, code)
+		}
+	}
+}
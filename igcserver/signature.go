@@ -0,0 +1,113 @@
+package igcserver
+
+import (
+	"context"
+	"github.com/marni/goigc"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureValid means that the G-record matched the content of the track
+	SignatureValid = "valid"
+
+	// SignatureInvalid means that the G-record did not match the content of
+	// the track, ie. the track was tampered with
+	SignatureInvalid = "invalid"
+
+	// SignatureMissing means that the track did not contain a G-record
+	SignatureMissing = "missing"
+
+	// SignatureUnsupported means that no verifier for the manufacturer of the
+	// logger was available
+	SignatureUnsupported = "unsupported"
+
+	// valiTimeout is how long a validation program can run before giving up
+	valiTimeout = 10 * time.Second
+)
+
+// SignatureVerifier verifies the G-record of the raw content of a track,
+// returning false if the track was tampered with and an error if the
+// verification could not be done
+type SignatureVerifier func(content string) (bool, error)
+
+var (
+	signatureVerifiersLock sync.RWMutex
+
+	// signatureVerifiers contains the verifiers of each logger manufacturer,
+	// indexed by the three-character code from the A-record. The open G-record
+	// of XCSoar is verified natively, while other manufacturers need a
+	// registered verifier.
+	signatureVerifiers = map[string]SignatureVerifier{
+		"XCS": verifyXCSSignature,
+	}
+)
+
+// RegisterSignatureVerifier sets the verifier used for the G-records of
+// tracks recorded by loggers of the given manufacturer (eg. `XCS`)
+func RegisterSignatureVerifier(manufacturer string, verifier SignatureVerifier) {
+	signatureVerifiersLock.Lock()
+	defer signatureVerifiersLock.Unlock()
+	signatureVerifiers[strings.ToUpper(manufacturer)] = verifier
+}
+
+// NewValiVerifier creates a verifier which runs a validation program, like
+// the VALI programs distributed by the manufacturers through the FAI. The
+// program is given the path to the igc file and is expected to exit with
+// status 0 if, and only if, the file is valid.
+func NewValiVerifier(program string) SignatureVerifier {
+	return func(content string) (valid bool, err error) {
+		f, err := ioutil.TempFile("", "paragliding-*.igc")
+		if err != nil {
+			return
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), valiTimeout)
+		defer cancel()
+		err = exec.CommandContext(ctx, program, f.Name()).Run()
+		if _, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+			// The program ran successfully and rejected the file
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
+
+// verifySignature returns the signature status of the raw content of a track
+func verifySignature(format string, content string, track igc.Track) string {
+	if format != TrackFormatIGC || track.Signature == "" {
+		return SignatureMissing
+	}
+	signatureVerifiersLock.RLock()
+	verifier, ok := signatureVerifiers[strings.ToUpper(track.Manufacturer)]
+	signatureVerifiersLock.RUnlock()
+	if !ok {
+		return SignatureUnsupported
+	}
+
+	valid, err := verifier(content)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"manufacturer": track.Manufacturer,
+			"error":        err,
+		}).Error("unable to verify signature of track")
+		return SignatureUnsupported
+	}
+	if valid {
+		return SignatureValid
+	}
+	return SignatureInvalid
+}
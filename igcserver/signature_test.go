@@ -0,0 +1,174 @@
+package igcserver
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"github.com/marni/goigc"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test the signature status of tracks with and without verifiers
+func TestVerifySignature(t *testing.T) {
+	const signed = "AXXT001\nHFDTE010618\nG0123456789ABCDEF\n"
+	const tampered = "AXXT001\nHFDTE010618\nHFPLTPILOT:Someone Else\nG0123456789ABCDEF\n"
+	const unsigned = "AXXT001\nHFDTE010618\n"
+
+	RegisterSignatureVerifier("xxt", func(content string) (bool, error) {
+		return content == signed, nil
+	})
+	RegisterSignatureVerifier("XXE", func(content string) (bool, error) {
+		return false, errors.New("verifier failed")
+	})
+	defer func() {
+		signatureVerifiersLock.Lock()
+		defer signatureVerifiersLock.Unlock()
+		delete(signatureVerifiers, "XXT")
+		delete(signatureVerifiers, "XXE")
+	}()
+
+	for _, data := range []struct {
+		format  string
+		content string
+		expt    string
+	}{
+		{TrackFormatIGC, signed, SignatureValid},
+		{TrackFormatIGC, tampered, SignatureInvalid},
+		{TrackFormatIGC, unsigned, SignatureMissing},
+		{TrackFormatIGC, "AXXU001\nHFDTE010618\nG0123456789ABCDEF\n", SignatureUnsupported},
+		{TrackFormatIGC, "AXXE001\nHFDTE010618\nG0123456789ABCDEF\n", SignatureUnsupported},
+		{TrackFormatGPX, testGPX, SignatureMissing},
+	} {
+		track, err := parseTrack(data.format, data.content)
+		if err != nil {
+			t.Fatalf("unable to parse track: %s", err)
+		}
+		if got := verifySignature(data.format, data.content, track); got != data.expt {
+			t.Errorf("expected signature of '%s' to be '%s', got '%s'", data.content, data.expt, got)
+		}
+	}
+}
+
+// Test that validation programs decide the signature status by exit status
+func TestValiVerifier(t *testing.T) {
+	for _, data := range []struct {
+		program string
+		valid   bool
+		err     bool
+	}{
+		{"true", true, false},
+		{"false", false, false},
+		{"./non-existing-vali-program", false, true},
+	} {
+		valid, err := NewValiVerifier(data.program)("AXXT001\n")
+		if valid != data.valid || (err != nil) != data.err {
+			t.Errorf("expected '%s' to give valid '%t' and error '%t', got '%t' and '%v'", data.program, data.valid, data.err, valid, err)
+		}
+	}
+}
+
+// Test GET /track?signature_status=<status>
+func TestIgcServerGetTrackBySignature(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
+
+	for _, meta := range makeIGCTestData("localhost") {
+		trackMetasMap.Append(meta)
+	}
+
+	for _, data := range []struct {
+		query string
+		count int
+	}{
+		{"", 2},
+		{"?signature_status=missing", 1},
+		{"?signature_status=unsupported", 1},
+		{"?signature_status=valid", 0},
+	} {
+		req := httptest.NewRequest("GET", "/track"+data.query, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		var ids []TrackID
+		if err := json.Unmarshal(res.Body.Bytes(), &ids); err != nil {
+			t.Errorf("received response body: '%s'", res.Body)
+			t.Fatalf("failed when trying to decode body as json")
+		}
+		if len(ids) != data.count {
+			t.Errorf("expected `GET /track%s` to return %d ids, got %d", data.query, data.count, len(ids))
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/track?signature_status=forged", nil)
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	if code := res.Result().StatusCode; code != 400 {
+		t.Errorf("expected unknown signature status to return 400, got '%d'", code)
+	}
+}
+
+// Test that 'test.igc' is unsupported without a verifier for its logger
+func TestVerifySignatureTestFile(t *testing.T) {
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		t.Fatalf("unable to parse 'test.igc': %s", err)
+	}
+	if got := verifySignature(TrackFormatIGC, string(content), track); got != SignatureUnsupported {
+		t.Errorf("expected signature of 'test.igc' to be '%s', got '%s'", SignatureUnsupported, got)
+	}
+}
+
+// Test that the digest starts from the given key, and that it is MD5 when
+// given the standard initial state
+func TestMD5WithKey(t *testing.T) {
+	standard := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	for _, data := range []string{"", "a", "B1101355206343N00006198WA0058700558", strings.Repeat("x", 200)} {
+		if got, expt := md5WithKey(standard, []byte(data)), md5.Sum([]byte(data)); got != expt {
+			t.Errorf("expected digest of '%s' to be '%x', got '%x'", data, expt, got)
+		}
+		if md5WithKey(xcsKeys[0], []byte(data)) == md5.Sum([]byte(data)) {
+			t.Errorf("expected digest of '%s' to depend on the key", data)
+		}
+	}
+}
+
+// Test the open G-record of XCSoar against 'lk8000.igc', which was recorded
+// and signed by LK8000 using the G-record code of XCSoar (from the testdata
+// of github.com/marni/goigc)
+func TestVerifyXCSSignature(t *testing.T) {
+	content, err := ioutil.ReadFile("../assets/lk8000.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'lk8000.igc': %s", err)
+	}
+	signed := string(content)
+	gStart := strings.Index(signed, "\nG") + 1
+	unsigned := signed[:gStart]
+
+	for _, data := range []struct {
+		about   string
+		content string
+		expt    bool
+	}{
+		{"signed", signed, true},
+		{"changed fix", strings.Replace(signed, "B1039", "B1038", 1), false},
+		{"changed header", strings.Replace(signed, "WOLF.HIRTH", "WOLF.HIRTI", 1), false},
+		{"changed signature", signed[:gStart+1] + "0" + signed[gStart+2:], false},
+		{"added comment", unsigned + "LABCNOT SIGNED\n" + signed[gStart:], true},
+		{"added observer header", strings.Replace(signed, "HFDTE", "HOCIDCOMPETITIONID:1\nHFDTE", 1), true},
+		{"missing", unsigned, false},
+	} {
+		if got, err := verifyXCSSignature(data.content); got != data.expt || err != nil {
+			t.Errorf("expected signature of '%s' track to be valid: %t, got %t (%v)", data.about, data.expt, got, err)
+		}
+	}
+}
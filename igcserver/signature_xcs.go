@@ -0,0 +1,142 @@
+package igcserver
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// The G-record of XCSoar (manufacturer `XCS`) is open source, and is built
+// from four MD5 digests of the signed records where each digest starts from
+// its own key instead of the standard initial state. The digests are written
+// as 128 lowercase hex characters, split into G-records of 16 characters.
+
+// xcsKeys are the initial states of the four digests
+var xcsKeys = [4][4]uint32{
+	{0x63e54c01, 0x25adab89, 0x44baecfe, 0x60f25476},
+	{0x41e24d03, 0x23b8ebea, 0x4a4bfc9e, 0x640ed89a},
+	{0x61e54e01, 0x22cdab89, 0x48b20cfe, 0x62125476},
+	{0xc1e84fe8, 0x21d1c28a, 0x438e1a12, 0x6c250aee},
+}
+
+// md5Shifts and md5Sines are the per-round constants of MD5 (RFC 1321)
+var (
+	md5Shifts = [64]uint{
+		7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22, 7, 12, 17, 22,
+		5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20, 5, 9, 14, 20,
+		4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23, 4, 11, 16, 23,
+		6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21, 6, 10, 15, 21,
+	}
+	md5Sines = func() (sines [64]uint32) {
+		for i := range sines {
+			sines[i] = uint32(math.Floor(math.Abs(math.Sin(float64(i+1))) * (1 << 32)))
+		}
+		return
+	}()
+)
+
+// md5WithKey calculates the MD5 digest of the data, starting from the given
+// state instead of the standard initial state
+func md5WithKey(key [4]uint32, data []byte) [16]byte {
+	// Pad the data with a one bit, zeros and the length in bits
+	msg := append(append([]byte{}, data...), 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(msg[len(msg)-8:], uint64(len(data))*8)
+
+	state := key
+	var words [16]uint32
+	for ; len(msg) > 0; msg = msg[64:] {
+		for i := range words {
+			words[i] = binary.LittleEndian.Uint32(msg[4*i:])
+		}
+		a, b, c, d := state[0], state[1], state[2], state[3]
+		for i := 0; i < 64; i++ {
+			var f uint32
+			var g int
+			switch {
+			case i < 16:
+				f, g = (b&c)|(^b&d), i
+			case i < 32:
+				f, g = (d&b)|(^d&c), (5*i+1)%16
+			case i < 48:
+				f, g = b^c^d, (3*i+5)%16
+			default:
+				f, g = c^(b|^d), (7*i)%16
+			}
+			f += a + md5Sines[i] + words[g]
+			a, d, c = d, c, b
+			b += bits.RotateLeft32(f, int(md5Shifts[i]))
+		}
+		state[0] += a
+		state[1] += b
+		state[2] += c
+		state[3] += d
+	}
+
+	var digest [16]byte
+	for i, v := range state {
+		binary.LittleEndian.PutUint32(digest[4*i:], v)
+	}
+	return digest
+}
+
+// isXCSSigned checks if a record is part of the G-record of XCSoar, which
+// excludes the G-records, the headers entered by the pilot or an observer
+// and comments which were not written by XCSoar itself
+func isXCSSigned(record string) bool {
+	switch record[0] {
+	case 'G':
+		return false
+	case 'L':
+		return strings.HasPrefix(record[1:], "XCS")
+	case 'H':
+		return len(record) > 1 && record[1] != 'O' && record[1] != 'P'
+	}
+	return true
+}
+
+// isXCSSignedChar checks if a character of a signed record is part of the
+// digest, which are the printable characters except those reserved by the
+// igc format
+func isXCSSignedChar(c byte) bool {
+	return c >= 0x20 && c < 0x7E && !strings.ContainsRune("$*,!\\^", rune(c))
+}
+
+// xcsGRecord calculates the G-record of the raw content of a track as it
+// would be written by XCSoar
+func xcsGRecord(content string) string {
+	var data []byte
+	for _, record := range strings.Split(content, "\n") {
+		record = strings.TrimRight(record, "\r")
+		if record == "" || !isXCSSigned(record) {
+			continue
+		}
+		for i := 0; i < len(record); i++ {
+			if isXCSSignedChar(record[i]) {
+				data = append(data, record[i])
+			}
+		}
+	}
+	var signature string
+	for _, key := range xcsKeys {
+		digest := md5WithKey(key, data)
+		signature += hex.EncodeToString(digest[:])
+	}
+	return signature
+}
+
+// verifyXCSSignature verifies the G-record of a track recorded by XCSoar
+func verifyXCSSignature(content string) (bool, error) {
+	var signature string
+	for _, record := range strings.Split(content, "\n") {
+		if strings.HasPrefix(record, "G") {
+			signature += strings.TrimSpace(record[1:])
+		}
+	}
+	return signature == xcsGRecord(content), nil
+}
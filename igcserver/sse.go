@@ -0,0 +1,66 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrStreamingUnsupported is returned if the response writer is unable to
+	// flush data to the client as it is written
+	ErrStreamingUnsupported = errors.New("streaming unsupported")
+)
+
+// eventStream writes Server-Sent Events to a client
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newEventStream writes the headers of a Server-Sent Events response and
+// returns a stream which events can be sent on
+func newEventStream(w http.ResponseWriter) (stream eventStream, err error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		err = ErrStreamingUnsupported
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stream = eventStream{w, flusher}
+	return
+}
+
+// Send writes an event with the given data encoded as json, the id is
+// omitted if it is empty
+func (stream *eventStream) Send(event string, id string, data interface{}) (err error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	if id != "" {
+		if _, err = fmt.Fprintf(stream.w, "id: %s\n", id); err != nil {
+			return
+		}
+	}
+	if _, err = fmt.Fprintf(stream.w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return
+	}
+	stream.flusher.Flush()
+	return
+}
+
+// Ping writes a comment to keep the connection open when no events are sent
+func (stream *eventStream) Ping() (err error) {
+	if _, err = fmt.Fprint(stream.w, ": ping\n\n"); err != nil {
+		return
+	}
+	stream.flusher.Flush()
+	return
+}
@@ -3,24 +3,87 @@ package igcserver
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	// tickerDefaultLimit is the amount of tracks in a report when no limit is
+	// given by the user
+	tickerDefaultLimit = 5
+
+	// tickerMaxLimit is the maximum amount of tracks in a report, larger
+	// limits are capped to this value
+	tickerMaxLimit = 100
+
+	// tickerDefaultWait is how long a long poll waits for new tracks when no
+	// timeout is given by the user
+	tickerDefaultWait = 30 * time.Second
+
+	// tickerMaxWait is the longest a long poll can wait for new tracks
+	tickerMaxWait = 60 * time.Second
+
+	// tickerPingInterval is how often a comment is sent on an idle ticker
+	// stream to prevent proxies from closing the connection
+	tickerPingInterval = 15 * time.Second
+)
+
 var (
 	// ErrNoTracksFound symbolizes that there are no tracks to report the
 	// timestamp on
 	ErrNoTracksFound = errors.New("no tracks meeting criteria found")
+
+	// ErrInvalidLimit symbolizes that the limit of a report is not a positive
+	// number
+	ErrInvalidLimit = errors.New("limit must be a positive number")
+
+	// ErrInvalidExpand symbolizes that a report was requested to be expanded
+	// with something other than tracks
+	ErrInvalidExpand = errors.New("only tracks can be expanded")
+
+	// ErrInvalidField symbolizes that an expanded track was requested to
+	// contain an unknown field
+	ErrInvalidField = errors.New("unknown track field")
+
+	// ErrInvalidCursor symbolizes that a cursor was not created by a report
+	ErrInvalidCursor = errors.New("invalid cursor")
 )
 
+// trackSummaryFields are the fields which expanded tracks can be restricted
+// to, the id is always included
+var trackSummaryFields = map[string]bool{
+	"timestamp":        true,
+	"H_date":           true,
+	"pilot":            true,
+	"glider":           true,
+	"glider_id":        true,
+	"track_length":     true,
+	"track_src_url":    true,
+	"source_format":    true,
+	"motor_run":        true,
+	"signature_status": true,
+	"takeoff":          true,
+}
+
 // Ticker is a generic interface for any type which can act as a ticker
 type Ticker interface {
 	Latest() *time.Time
 	Reporter(latest time.Time)
-	GetReport(limit int) (TickerReport, error)
-	GetReportAfter(timestamp time.Time, limit int) (TickerReport, error)
+	GetReport(limit int, filter TrackFilter) (TickerReport, error)
+	GetReportAfter(timestamp time.Time, limit int, filter TrackFilter) (TickerReport, error)
+	GetReportAfterCursor(cursor TickerCursor, limit int, filter TrackFilter) (TickerReport, error)
+	GetReportBefore(timestamp time.Time, limit int, filter TrackFilter) (TickerReport, error)
+	GetReportRange(from time.Time, to time.Time, limit int, filter TrackFilter) (TickerReport, error)
+	Subscribe() chan time.Time
+	Unsubscribe(ch chan time.Time)
 }
 
 // TickerReport encompasses the report the ticker provides to the user
@@ -30,26 +93,224 @@ type Ticker interface {
 // "t_start": <the first timestamp of the added track>,
 // "t_stop": <the last timestamp of the added track>,
 // "tracks": [<id1>, <id2>, ...],
-// "processing": <time in ms of how long it took to process the request>
+// "processing": <time in ms of how long it took to process the request>,
+// "cursor": <cursor of the last track, to get the next page>,
+// "expanded": [{"id": <id1>, "pilot": <pilot>, ...}, ...]
 // }
 type TickerReport struct {
-	Latest     time.Time     `json:"t_latest"`
-	Start      time.Time     `json:"t_start"`
-	End        time.Time     `json:"t_stop"`
-	Tracks     []TrackID     `json:"tracks"`
-	Processing time.Duration `json:"processing"`
+	Latest     time.Time                `json:"t_latest"`
+	Start      time.Time                `json:"t_start"`
+	End        time.Time                `json:"t_stop"`
+	Tracks     []TrackID                `json:"tracks"`
+	Processing time.Duration            `json:"processing"`
+	Cursor     TickerCursor             `json:"cursor"`
+	Expanded   []map[string]interface{} `json:"expanded,omitempty"`
+	Metas      []TrackMeta              `json:"-"`
+}
+
+// newTickerReport creates a report of the given tracks, which must be sorted
+// from oldest to newest and contain at least one track
+func newTickerReport(latest time.Time, trackMetas []TrackMeta, start time.Time) TickerReport {
+	ids := make([]TrackID, len(trackMetas))
+	for i, meta := range trackMetas {
+		ids[i] = meta.ID
+	}
+	last := trackMetas[len(trackMetas)-1]
+	return TickerReport{
+		latest,
+		trackMetas[0].Timestamp,
+		last.Timestamp,
+		ids,
+		time.Since(start),
+		TickerCursor{last.Timestamp, last.ID},
+		nil,
+		trackMetas,
+	}
+}
+
+// expand embeds the metadata of each track in the report, restricted to the
+// given fields if any
+func (report *TickerReport) expand(fields []string) {
+	report.Expanded = make([]map[string]interface{}, len(report.Metas))
+	for i, meta := range report.Metas {
+		// Reuse the json representation of the metadata, so that the
+		// summaries always have the same fields as `GET /track/<id>`
+		var all map[string]interface{}
+		b, _ := json.Marshal(meta)
+		json.Unmarshal(b, &all)
+		all["timestamp"] = meta.Timestamp
+
+		summary := all
+		if len(fields) > 0 {
+			summary = make(map[string]interface{}, len(fields)+1)
+			for _, field := range fields {
+				summary[field] = all[field]
+			}
+		}
+		summary["id"] = meta.ID
+		report.Expanded[i] = summary
+	}
+}
+
+// TickerCursor is the position of a track in the order of the ticker. Tracks
+// are ordered by timestamp and then by id, so that paging is deterministic
+// even when several tracks share a timestamp.
+type TickerCursor struct {
+	Timestamp time.Time
+	ID        TrackID
+}
+
+// ParseTickerCursor parses a cursor in the format of TickerCursor.String
+func ParseTickerCursor(s string) (cursor TickerCursor, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		err = ErrInvalidCursor
+		return
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		err = ErrInvalidCursor
+		return
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		err = ErrInvalidCursor
+		return
+	}
+	cursor = TickerCursor{time.Unix(0, nanos), TrackID(id)}
+	return
+}
+
+// String formats the cursor as `<unix nanoseconds>-<id>`, which can be used
+// in urls without escaping
+func (cursor TickerCursor) String() string {
+	return fmt.Sprintf("%d-%d", cursor.Timestamp.UnixNano(), cursor.ID)
+}
+
+// MarshalText formats the cursor as a string in json
+func (cursor TickerCursor) MarshalText() ([]byte, error) {
+	return []byte(cursor.String()), nil
+}
+
+// UnmarshalText parses a cursor formatted as a string in json
+func (cursor *TickerCursor) UnmarshalText(text []byte) (err error) {
+	*cursor, err = ParseTickerCursor(string(text))
+	return
+}
+
+// tickerSubscribers keeps the channels which are notified each time a new
+// latest timestamp is reported
+type tickerSubscribers struct {
+	sync.Mutex
+	chans map[chan time.Time]struct{}
+}
+
+func newTickerSubscribers() *tickerSubscribers {
+	return &tickerSubscribers{chans: make(map[chan time.Time]struct{})}
+}
+
+// subscribe returns a channel which receives new latest timestamps. The
+// channel only buffers the newest notification, hence subscribers should
+// query for all tracks after the last one they have seen when notified.
+func (subs *tickerSubscribers) subscribe() chan time.Time {
+	ch := make(chan time.Time, 1)
+	subs.Lock()
+	defer subs.Unlock()
+	subs.chans[ch] = struct{}{}
+	return ch
+}
+
+func (subs *tickerSubscribers) unsubscribe(ch chan time.Time) {
+	subs.Lock()
+	defer subs.Unlock()
+	delete(subs.chans, ch)
+}
+
+// notify sends the latest timestamp to all subscribers without blocking,
+// replacing any notification which has not been received yet
+func (subs *tickerSubscribers) notify(latest time.Time) {
+	subs.Lock()
+	defer subs.Unlock()
+	for ch := range subs.chans {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- latest
+	}
 }
 
 // ---------- //
 // TICKER API //
 // ---------- //
 
-func (server *Server) tickerHandler(w http.ResponseWriter, r *http.Request) {
-	logger := newReqLogger(r)
+// parseTickerLimit parses the optional `limit` query parameter of a ticker
+// request, capping it to the maximum limit
+func parseTickerLimit(r *http.Request) (int, error) {
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr == "" {
+		return tickerDefaultLimit, nil
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit < 1 {
+		return 0, ErrInvalidLimit
+	}
+	if limit > tickerMaxLimit {
+		limit = tickerMaxLimit
+	}
+	return limit, nil
+}
 
-	logger.Info("processing request to get ticker report")
+// tickerOptions are the query parameters which apply to all ticker reports
+type tickerOptions struct {
+	limit  int
+	expand bool
+	fields []string
+	filter TrackFilter
+}
 
-	report, err := server.ticker.GetReport(5)
+// parseTickerOptions parses the optional `limit`, `expand` and `fields`
+// query parameters of a ticker request, as well as the filter of the tracks
+func parseTickerOptions(r *http.Request) (opts tickerOptions, err error) {
+	if opts.limit, err = parseTickerLimit(r); err != nil {
+		return
+	}
+	query := r.URL.Query()
+	if opts.filter, err = TrackFilterFrom(query); err != nil {
+		err = fmt.Errorf("invalid filter: %s", err)
+		return
+	}
+	switch query.Get("expand") {
+	case "":
+	case "tracks":
+		opts.expand = true
+	default:
+		err = ErrInvalidExpand
+		return
+	}
+	if fieldsStr := query.Get("fields"); fieldsStr != "" {
+		opts.fields = strings.Split(fieldsStr, ",")
+		for _, field := range opts.fields {
+			if field != "id" && !trackSummaryFields[field] {
+				err = ErrInvalidField
+				return
+			}
+		}
+	}
+	return
+}
+
+// parseTickerTimestamp parses an optional RFC3339 timestamp, where an empty
+// string gives the zero time
+func parseTickerTimestamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// writeTickerReport responds with the report or the appropriate error
+func writeTickerReport(w http.ResponseWriter, logger *log.Entry, report TickerReport, err error, opts tickerOptions) {
 	if err == ErrNoTracksFound {
 		logger.WithField("error", err).Info("no tracks registered")
 		http.Error(w, "content not found", http.StatusNotFound)
@@ -60,10 +321,69 @@ func (server *Server) tickerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if opts.expand {
+		report.expand(opts.fields)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(report)
 }
 
+func (server *Server) tickerHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to get ticker report")
+
+	opts, err := parseTickerOptions(r)
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse options")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	if cursorStr := query.Get("cursor"); cursorStr != "" {
+		cursor, err := ParseTickerCursor(cursorStr)
+		if err != nil {
+			logger.WithField("error", err).Info("unable to parse cursor")
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		report, err := server.ticker.GetReportAfterCursor(cursor, opts.limit, opts.filter)
+		writeTickerReport(w, logger, report, err, opts)
+		return
+	}
+	if query.Get("from") == "" && query.Get("to") == "" {
+		report, err := server.ticker.GetReport(opts.limit, opts.filter)
+		writeTickerReport(w, logger, report, err, opts)
+		return
+	}
+
+	from, err := parseTickerTimestamp(query.Get("from"))
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse 'from' as timestamp")
+		http.Error(w, "invalid timestamp", http.StatusBadRequest)
+		return
+	}
+	to, err := parseTickerTimestamp(query.Get("to"))
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse 'to' as timestamp")
+		http.Error(w, "invalid timestamp", http.StatusBadRequest)
+		return
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		logger.WithFields(log.Fields{
+			"from": from,
+			"to":   to,
+		}).Info("range ends before it starts")
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+
+	report, err := server.ticker.GetReportRange(from, to, opts.limit, opts.filter)
+	writeTickerReport(w, logger, report, err, opts)
+}
+
 func (server *Server) tickerAfterHandler(w http.ResponseWriter, r *http.Request) {
 	logger := newReqLogger(r)
 
@@ -77,19 +397,39 @@ func (server *Server) tickerAfterHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "invalid timestamp", http.StatusBadRequest)
 		return
 	}
+	opts, err := parseTickerOptions(r)
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse options")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	report, err := server.ticker.GetReportAfter(timestamp, 5)
-	if err == ErrNoTracksFound {
-		logger.WithField("error", err).Info("no tracks registered")
-		http.Error(w, "content not found", http.StatusNotFound)
+	report, err := server.ticker.GetReportAfter(timestamp, opts.limit, opts.filter)
+	writeTickerReport(w, logger, report, err, opts)
+}
+
+func (server *Server) tickerBeforeHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to get ticker report before timestamp")
+
+	vars := mux.Vars(r)
+	timestampStr, _ := vars["timestamp"]
+	timestamp, err := time.Parse(time.RFC3339, timestampStr)
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse as timestamp")
+		http.Error(w, "invalid timestamp", http.StatusBadRequest)
 		return
-	} else if err != nil {
-		logger.WithField("error", err).Info("unable to build ticker report")
-		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+	}
+	opts, err := parseTickerOptions(r)
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse options")
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(report)
+
+	report, err := server.ticker.GetReportBefore(timestamp, opts.limit, opts.filter)
+	writeTickerReport(w, logger, report, err, opts)
 }
 
 func (server *Server) tickerLatestHandler(w http.ResponseWriter, r *http.Request) {
@@ -106,3 +446,167 @@ func (server *Server) tickerLatestHandler(w http.ResponseWriter, r *http.Request
 	logger.WithField("latest", latest).Info("responding with latest timestamp")
 	io.WriteString(w, latest.Format(time.RFC3339))
 }
+
+// parseTickerWait parses the optional `timeout` query parameter of a long
+// poll, capping it to the maximum wait
+func parseTickerWait(r *http.Request) (time.Duration, error) {
+	timeoutStr := r.URL.Query().Get("timeout")
+	if timeoutStr == "" {
+		return tickerDefaultWait, nil
+	}
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil {
+		return 0, err
+	}
+	if timeout < 0 {
+		return 0, errors.New("timeout must not be negative")
+	}
+	if timeout > tickerMaxWait {
+		timeout = tickerMaxWait
+	}
+	return timeout, nil
+}
+
+// tickerWaitHandler responds with a report of the tracks added after the
+// `after` timestamp, waiting until `timeout` for new tracks if there are none.
+// If no tracks are added before the timeout it responds with 204 No Content.
+func (server *Server) tickerWaitHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to wait for ticker report")
+
+	opts, err := parseTickerOptions(r)
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse options")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout, err := parseTickerWait(r)
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse timeout")
+		http.Error(w, "invalid timeout", http.StatusBadRequest)
+		return
+	}
+	after, err := parseTickerTimestamp(r.URL.Query().Get("after"))
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse 'after' as timestamp")
+		http.Error(w, "invalid timestamp", http.StatusBadRequest)
+		return
+	}
+
+	// Subscribe before querying, so that no tracks are missed between the
+	// query and the wait
+	notifications := server.ticker.Subscribe()
+	defer server.ticker.Unsubscribe(notifications)
+
+	if after.IsZero() {
+		if latest := server.ticker.Latest(); latest != nil {
+			after = *latest
+		}
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		report, err := server.ticker.GetReportAfter(after, opts.limit, opts.filter)
+		if err != ErrNoTracksFound {
+			writeTickerReport(w, logger, report, err, opts)
+			return
+		}
+
+		select {
+		case <-notifications:
+		case <-deadline.C:
+			logger.WithField("timeout", timeout).Info("no tracks added before timeout")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			logger.Info("client stopped waiting for ticker report")
+			return
+		}
+	}
+}
+
+// tickerStreamHandler streams reports of new tracks as Server-Sent Events.
+// The id of each event is the cursor of the last track in the report, so
+// that a client reconnecting with `Last-Event-ID` receives the tracks it
+// missed.
+func (server *Server) tickerStreamHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to stream ticker reports")
+
+	opts, err := parseTickerOptions(r)
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse options")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The last event id is a cursor, but a timestamp is also accepted to
+	// start after all tracks of that time
+	var cursor TickerCursor
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		if cursor, err = ParseTickerCursor(lastEventID); err != nil {
+			after, err := time.Parse(time.RFC3339, lastEventID)
+			if err != nil {
+				logger.WithField("error", err).Info("unable to parse 'Last-Event-ID' as cursor or timestamp")
+				http.Error(w, "invalid last event id", http.StatusBadRequest)
+				return
+			}
+			cursor = TickerCursor{after, math.MaxUint32}
+		}
+	}
+
+	notifications := server.ticker.Subscribe()
+	defer server.ticker.Unsubscribe(notifications)
+
+	if cursor.Timestamp.IsZero() {
+		if latest := server.ticker.Latest(); latest != nil {
+			cursor = TickerCursor{*latest, math.MaxUint32}
+		}
+	}
+
+	stream, err := newEventStream(w)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to stream ticker reports")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	logger.WithField("cursor", cursor).Info("streaming ticker reports")
+
+	ping := time.NewTicker(tickerPingInterval)
+	defer ping.Stop()
+	for {
+		// Send all tracks after the last one sent, in pages
+		for {
+			report, err := server.ticker.GetReportAfterCursor(cursor, tickerMaxLimit, opts.filter)
+			if err == ErrNoTracksFound {
+				break
+			} else if err != nil {
+				logger.WithField("error", err).Error("unable to build ticker report")
+				return
+			}
+			if opts.expand {
+				report.expand(opts.fields)
+			}
+			if err := stream.Send("tracks", report.Cursor.String(), report); err != nil {
+				logger.WithField("error", err).Info("unable to send ticker report to client")
+				return
+			}
+			cursor = report.Cursor
+		}
+
+		select {
+		case <-notifications:
+		case <-ping.C:
+			if err := stream.Ping(); err != nil {
+				logger.WithField("error", err).Info("unable to ping client")
+				return
+			}
+		case <-r.Context().Done():
+			logger.Info("client stopped streaming ticker reports")
+			return
+		}
+	}
+}
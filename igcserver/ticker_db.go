@@ -7,53 +7,153 @@ import (
 	"time"
 )
 
+const (
+	tickerCollection = "ticker"
+
+	// tickerWatermarkID is the id of the document containing the latest
+	// timestamp reported by any instance of the service
+	tickerWatermarkID = "latest"
+)
+
+// tickerPollInterval is how often the watermark is read to pick up tracks
+// reported by other instances of the service
+var tickerPollInterval = time.Second
+
+// tickerWatermark is the document which is shared by all instances of the
+// service, so that they all report the same latest timestamp
+type tickerWatermark struct {
+	ID        string    `bson:"_id"`
+	Timestamp time.Time `bson:"timestamp"`
+}
+
+// TickerWatermarks stores the latest timestamp shared by all instances of
+// the service
+type TickerWatermarks interface {
+	Load() (time.Time, error)
+	Raise(latest time.Time) error
+}
+
+// TickerWatermarksDB stores the shared latest timestamp in the database
+type TickerWatermarksDB struct {
+	session *mgo.Session
+}
+
+// Load reads the latest timestamp reported by any instance
+func (watermarks *TickerWatermarksDB) Load() (latest time.Time, err error) {
+	conn := watermarks.session.Copy()
+	defer conn.Close()
+
+	var watermark tickerWatermark
+	err = conn.DB("").C(tickerCollection).FindId(tickerWatermarkID).One(&watermark)
+	latest = watermark.Timestamp
+	return
+}
+
+// Raise raises the shared latest timestamp, it is never lowered even if
+// instances report out of order
+func (watermarks *TickerWatermarksDB) Raise(latest time.Time) (err error) {
+	conn := watermarks.session.Copy()
+	defer conn.Close()
+
+	_, err = conn.DB("").C(tickerCollection).UpsertId(
+		tickerWatermarkID,
+		bson.M{"$max": bson.M{"timestamp": latest}},
+	)
+	return
+}
+
 // TickerDB is a database-aware ticker instance
 type TickerDB struct {
-	session   *mgo.Session
-	latest    *time.Time
-	publisher chan *time.Time
-	reporter  chan time.Time
+	session     *mgo.Session
+	watermarks  TickerWatermarks
+	latest      *time.Time
+	publisher   chan *time.Time
+	reporter    chan time.Time
+	subscribers *tickerSubscribers
+	stop        chan struct{}
 }
 
 // NewTickerDB creates a new database-aware ticker instance
 func NewTickerDB(session *mgo.Session, buf int) TickerDB {
-	reporter := make(chan time.Time, buf)
-	publisher := make(chan *time.Time)
-	ticker := TickerDB{
-		session,
-		nil,
-		publisher,
-		reporter,
-	}
+	watermarks := &TickerWatermarksDB{session}
 
-	// Initialize ticker.latest from DB on remake
-	conn := ticker.session.Copy()
+	// Initialize latest from DB on remake
+	conn := session.Copy()
 	defer conn.Close()
 	tracks := conn.DB("").C(trackCollection)
 
-	var meta TrackMeta
-	err := tracks.
-		Find(nil).
-		Sort("-timestamp").
-		One(&meta)
+	// All reports are ranges of timestamps ordered by id, hence they need an
+	// index
+	if err := tracks.EnsureIndexKey("timestamp", "id"); err != nil {
+		log.WithField("error", err).Warn("unable to ensure index on timestamp")
+	}
 
-	if err == nil {
-		ticker.latest = &meta.Timestamp
+	var latest *time.Time
+	if watermark, err := watermarks.Load(); err == nil {
+		latest = &watermark
 	} else {
-		log.Warn("unable to get initial timestamp from database")
+		// The watermark is missing when the service is first upgraded, hence
+		// it is seeded with the newest track
+		var meta TrackMeta
+		err := tracks.
+			Find(nil).
+			Sort("-timestamp").
+			One(&meta)
+
+		if err == nil {
+			latest = &meta.Timestamp
+			watermarks.Raise(meta.Timestamp)
+		} else {
+			log.Warn("unable to get initial timestamp from database")
+		}
+	}
+
+	return newTickerDB(session, watermarks, latest, buf)
+}
+
+// newTickerDB creates a ticker instance which starts from the given latest
+// timestamp, and follows the shared watermark to pick up tracks reported by
+// other instances
+func newTickerDB(session *mgo.Session, watermarks TickerWatermarks, latest *time.Time, buf int) TickerDB {
+	reporter := make(chan time.Time, buf)
+	publisher := make(chan *time.Time)
+	ticker := TickerDB{
+		session,
+		watermarks,
+		latest,
+		publisher,
+		reporter,
+		newTickerSubscribers(),
+		make(chan struct{}),
 	}
 
 	// Handle all requests and responses to get latest ticker value. Doesn't
 	// need a mutex because all accesses to ticker.latest is done in the
 	// following goroutine
+	poll := time.NewTicker(tickerPollInterval)
 	go func() {
+		advance := func(latest time.Time) {
+			if ticker.latest == nil || latest.After(*ticker.latest) {
+				ticker.latest = &latest
+				ticker.subscribers.notify(latest)
+			}
+		}
 		for {
 			select {
 			// We received a new latest value
 			case latest := <-reporter:
-				ticker.latest = &latest
+				advance(latest)
+			// Another instance might have reported a new latest value
+			case <-poll.C:
+				if watermark, err := ticker.watermarks.Load(); err == nil {
+					advance(watermark)
+				}
 			// A user asked for the latest value so we send it
 			case publisher <- ticker.latest:
+			// The ticker was closed
+			case <-ticker.stop:
+				poll.Stop()
+				return
 			}
 		}
 	}()
@@ -61,58 +161,149 @@ func NewTickerDB(session *mgo.Session, buf int) TickerDB {
 	return ticker
 }
 
-// Reporter returns a channel which expects to have timestamps sent to it and
-// it will listen to it and keep the current timestamp updated accordingly
+// Reporter stores the timestamp as the shared watermark and updates the
+// latest timestamp of this instance accordingly. The timestamp is truncated
+// to the precision of the database, so that all instances report the same
+// value.
 func (t *TickerDB) Reporter(latest time.Time) {
-	t.reporter <- latest
+	latest = latest.Truncate(time.Millisecond)
+	if err := t.watermarks.Raise(latest); err != nil {
+		log.WithField("error", err).Error("unable to store latest timestamp in database")
+	}
+	select {
+	case t.reporter <- latest:
+	case <-t.stop:
+	}
 }
 
 // Latest returns a channel which expects send the current latest timestamp on
-// a request
+// a request. It returns nil if the ticker is closed.
 func (t *TickerDB) Latest() *time.Time {
-	return <-t.publisher
+	select {
+	case latest := <-t.publisher:
+		return latest
+	case <-t.stop:
+		return nil
+	}
+}
+
+// Close stops following the shared watermark. Reports to a closed ticker
+// still raise the watermark, but no longer update this instance.
+func (t *TickerDB) Close() {
+	close(t.stop)
+}
+
+// Subscribe returns a channel which is notified with the latest timestamp
+// each time a new track is reported
+func (t *TickerDB) Subscribe() chan time.Time {
+	return t.subscribers.subscribe()
+}
+
+// Unsubscribe stops notifications on a channel returned by Subscribe
+func (t *TickerDB) Unsubscribe(ch chan time.Time) {
+	t.subscribers.unsubscribe(ch)
 }
 
 // GetReport returns a report of the oldest registered timestamps with the given limit
-func (t *TickerDB) GetReport(limit int) (rep TickerReport, err error) {
-	rep, err = t.GetReportAfter(time.Unix(0, 0), limit)
+func (t *TickerDB) GetReport(limit int, filter TrackFilter) (rep TickerReport, err error) {
+	rep, err = t.GetReportAfter(time.Unix(0, 0), limit, filter)
 	return
 }
 
 // GetReportAfter returns a report after a specified time with the given limit
-func (t *TickerDB) GetReportAfter(timestamp time.Time, limit int) (rep TickerReport, err error) {
+func (t *TickerDB) GetReportAfter(timestamp time.Time, limit int, filter TrackFilter) (TickerReport, error) {
+	return t.getReport(bson.M{"timestamp": bson.M{"$gt": timestamp}}, false, limit, filter)
+}
+
+// GetReportAfterCursor returns a report of the tracks after the cursor with
+// the given limit
+func (t *TickerDB) GetReportAfterCursor(cursor TickerCursor, limit int, filter TrackFilter) (TickerReport, error) {
+	return t.getReport(bson.M{"$or": []bson.M{
+		{"timestamp": bson.M{"$gt": cursor.Timestamp}},
+		{"timestamp": cursor.Timestamp, "id": bson.M{"$gt": cursor.ID}},
+	}}, false, limit, filter)
+}
+
+// GetReportBefore returns a report of the newest tracks before a specified
+// time with the given limit
+func (t *TickerDB) GetReportBefore(timestamp time.Time, limit int, filter TrackFilter) (TickerReport, error) {
+	return t.getReport(bson.M{"timestamp": bson.M{"$lt": timestamp}}, true, limit, filter)
+}
+
+// GetReportRange returns a report of the oldest tracks between two times
+// (inclusive) with the given limit, where a zero time leaves that end of the
+// range open
+func (t *TickerDB) GetReportRange(from time.Time, to time.Time, limit int, filter TrackFilter) (TickerReport, error) {
+	timestamp := bson.M{}
+	if !from.IsZero() {
+		timestamp["$gte"] = from
+	}
+	if !to.IsZero() {
+		timestamp["$lte"] = to
+	}
+	query := bson.M{}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	return t.getReport(query, false, limit, filter)
+}
+
+// getReport returns a report of the tracks matching the query and the
+// filter, where the newest tracks are selected if newest is set. The tracks
+// of the report are always sorted from oldest to newest, by timestamp and
+// then by id. The latest timestamp of the report is the latest of the tracks
+// matching the filter.
+func (t *TickerDB) getReport(query bson.M, newest bool, limit int, filter TrackFilter) (rep TickerReport, err error) {
 	start := time.Now()
 
 	conn := t.session.Copy()
 	defer conn.Close()
 	tracks := conn.DB("").C(trackCollection)
 
+	filtered := filter != (TrackFilter{})
+	if filtered {
+		query = bson.M{"$and": []bson.M{query, filter.query()}}
+	}
+
+	sort := []string{"timestamp", "id"}
+	if newest {
+		sort = []string{"-timestamp", "-id"}
+	}
+
 	var trackMetas []TrackMeta
 	err = tracks.
-		Find(bson.M{"timestamp": bson.M{"$gt": timestamp}}).
+		Find(query).
 		Limit(limit).
-		Sort("timestamp").
+		Sort(sort...).
 		All(&trackMetas)
 
 	if err == nil {
 		if len(trackMetas) < 1 {
 			err = ErrNoTracksFound
 		} else {
-			latest := t.Latest()
-			firststamp := trackMetas[0].Timestamp
-			laststamp := trackMetas[len(trackMetas)-1].Timestamp
-			ids := make([]TrackID, len(trackMetas))
-			for i, meta := range trackMetas {
-				ids[i] = meta.ID
+			if newest {
+				for i, j := 0, len(trackMetas)-1; i < j; i, j = i+1, j-1 {
+					trackMetas[i], trackMetas[j] = trackMetas[j], trackMetas[i]
+				}
+			}
+			var latest *time.Time
+			if !filtered {
+				latest = t.Latest()
 			}
-			processing := time.Since(start)
-			rep = TickerReport{
-				*latest,
-				firststamp,
-				laststamp,
-				ids,
-				processing,
+			// The latest timestamp is unknown to this instance if it has not
+			// read the watermark yet, hence it is found like for a filter
+			if latest == nil {
+				var meta TrackMeta
+				err = tracks.
+					Find(filter.query()).
+					Sort("-timestamp").
+					One(&meta)
+				if err != nil {
+					return
+				}
+				latest = &meta.Timestamp
 			}
+			rep = newTickerReport(*latest, trackMetas, start)
 		}
 	}
 	return
@@ -0,0 +1,198 @@
+package igcserver
+
+import (
+	"fmt"
+	"github.com/globalsign/mgo"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TickerWatermarksMap is an in-memory shared latest timestamp
+type TickerWatermarksMap struct {
+	sync.Mutex
+	latest *time.Time
+}
+
+// Load reads the latest timestamp reported by any instance
+func (watermarks *TickerWatermarksMap) Load() (latest time.Time, err error) {
+	watermarks.Lock()
+	defer watermarks.Unlock()
+	if watermarks.latest == nil {
+		return latest, ErrNoTracksFound
+	}
+	return *watermarks.latest, nil
+}
+
+// Raise raises the shared latest timestamp, it is never lowered
+func (watermarks *TickerWatermarksMap) Raise(latest time.Time) (err error) {
+	watermarks.Lock()
+	defer watermarks.Unlock()
+	if watermarks.latest == nil || latest.After(*watermarks.latest) {
+		watermarks.latest = &latest
+	}
+	return
+}
+
+// makeTestSession connects to a fresh database of the mongodb given by the
+// envvar 'MONGODB_TEST_URI', skipping the test if it is not set
+func makeTestSession(t *testing.T) *mgo.Session {
+	uri, ok := os.LookupEnv("MONGODB_TEST_URI")
+	if !ok {
+		t.Skip("envvar 'MONGODB_TEST_URI' is not set")
+	}
+	info, err := mgo.ParseURL(uri)
+	if err != nil {
+		t.Fatalf("unable to parse 'MONGODB_TEST_URI': %s", err)
+	}
+	info.Database = fmt.Sprintf("paragliding_test_%d", time.Now().UnixNano())
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		t.Fatalf("unable to connect to mongodb: %s", err)
+	}
+	return session
+}
+
+// waitForLatest waits until the latest timestamp of the ticker becomes the
+// expected timestamp, failing the test if it takes too long
+func waitForLatest(t *testing.T, ticker *TickerDB, expt time.Time) {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		latest := ticker.Latest()
+		if latest != nil && latest.Equal(expt) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected latest to become '%s', got '%v'", expt, latest)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Test that two instances sharing a database report the same latest
+// timestamp, regardless of which instance the track was reported to
+func TestTickerDBMultiInstance(t *testing.T) {
+	session := makeTestSession(t)
+	defer session.Close()
+	defer session.DB("").DropDatabase()
+
+	tickerPollInterval = 10 * time.Millisecond
+	defer func() { tickerPollInterval = time.Second }()
+
+	tracks := NewTrackMetasDB(session.Copy())
+	first := NewTickerDB(session.Copy(), 2)
+	defer first.Close()
+	second := NewTickerDB(session.Copy(), 2)
+	defer second.Close()
+	notifications := second.Subscribe()
+	defer second.Unsubscribe(notifications)
+
+	start := time.Now().Truncate(time.Millisecond)
+	for i, ticker := range []*TickerDB{&first, &second, &first} {
+		meta := TrackMeta{ID: TrackID(i + 1), Timestamp: start.Add(time.Duration(i) * time.Second)}
+		if err := tracks.Append(meta); err != nil {
+			t.Fatalf("unable to add track: %s", err)
+		}
+		ticker.Reporter(meta.Timestamp)
+
+		waitForLatest(t, &first, meta.Timestamp)
+		waitForLatest(t, &second, meta.Timestamp)
+
+		if i == 0 {
+			select {
+			case <-notifications:
+			default:
+				t.Errorf("expected second instance to notify subscribers of tracks reported to the first")
+			}
+		}
+	}
+
+	// A late report from an instance must not move the watermark backwards
+	second.Reporter(start)
+	latest := start.Add(2 * time.Second)
+	waitForLatest(t, &first, latest)
+	waitForLatest(t, &second, latest)
+
+	firstReport, err := first.GetReport(5, TrackFilter{})
+	if err != nil {
+		t.Fatalf("unable to get report: %s", err)
+	}
+	secondReport, err := second.GetReport(5, TrackFilter{})
+	if err != nil {
+		t.Fatalf("unable to get report: %s", err)
+	}
+	if !firstReport.Latest.Equal(secondReport.Latest) || len(secondReport.Tracks) != 3 {
+		t.Errorf("expected both instances to report the same, got %v and %v", firstReport, secondReport)
+	}
+
+	// A new instance starts from the shared watermark
+	third := NewTickerDB(session.Copy(), 2)
+	defer third.Close()
+	if latest := third.Latest(); latest == nil || !latest.Equal(start.Add(2*time.Second)) {
+		t.Errorf("expected new instance to start from the watermark, got '%v'", latest)
+	}
+}
+
+// Test that instances sharing a watermark report the same latest timestamp,
+// regardless of which instance the track was reported to
+func TestTickerDBSharedWatermark(t *testing.T) {
+	tickerPollInterval = 10 * time.Millisecond
+	defer func() { tickerPollInterval = time.Second }()
+
+	var watermarks TickerWatermarksMap
+	first := newTickerDB(nil, &watermarks, nil, 2)
+	defer first.Close()
+	second := newTickerDB(nil, &watermarks, nil, 2)
+	defer second.Close()
+	notifications := second.Subscribe()
+	defer second.Unsubscribe(notifications)
+
+	start := time.Now().Truncate(time.Millisecond)
+	for i, ticker := range []*TickerDB{&first, &second, &first} {
+		timestamp := start.Add(time.Duration(i) * time.Second)
+		ticker.Reporter(timestamp)
+
+		waitForLatest(t, &first, timestamp)
+		waitForLatest(t, &second, timestamp)
+	}
+	select {
+	case <-notifications:
+	default:
+		t.Errorf("expected second instance to notify subscribers of tracks reported to the first")
+	}
+
+	// A late report from an instance must not move the watermark backwards
+	second.Reporter(start)
+	time.Sleep(5 * tickerPollInterval)
+	latest := start.Add(2 * time.Second)
+	waitForLatest(t, &first, latest)
+	waitForLatest(t, &second, latest)
+
+	// The shared watermark keeps the newest timestamp
+	if watermark, err := watermarks.Load(); err != nil || !watermark.Equal(latest) {
+		t.Errorf("expected watermark to be '%s', got '%s'", latest, watermark)
+	}
+}
+
+// Test that a closed ticker stops following the watermark, without blocking
+// anyone asking for the latest timestamp
+func TestTickerDBClose(t *testing.T) {
+	var watermarks TickerWatermarksMap
+	ticker := newTickerDB(nil, &watermarks, nil, 0)
+	ticker.Close()
+
+	done := make(chan bool)
+	go func() {
+		ticker.Reporter(time.Now())
+		done <- ticker.Latest() == nil
+	}()
+	select {
+	case closed := <-done:
+		if !closed {
+			t.Errorf("expected closed ticker not to have a latest timestamp")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected closed ticker not to block")
+	}
+}
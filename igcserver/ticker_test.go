@@ -1,14 +1,24 @@
 package igcserver
 
 import (
+	"bufio"
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
 	"time"
 )
 
 // TickerDummy is simple ticker instance for testing
 type TickerDummy struct {
-	latest    *time.Time
-	publisher chan *time.Time
-	reporter  chan time.Time
+	latest      *time.Time
+	publisher   chan *time.Time
+	reporter    chan time.Time
+	subscribers *tickerSubscribers
 }
 
 // NewTickerDummy creates a new simple ticker
@@ -19,6 +29,7 @@ func NewTickerDummy(buf int) TickerDummy {
 		nil,
 		publisher,
 		reporter,
+		newTickerSubscribers(),
 	}
 
 	// Handle all requests and responses to get latest ticker value. Doesn't
@@ -30,6 +41,7 @@ func NewTickerDummy(buf int) TickerDummy {
 			// We received a new latest value
 			case latest := <-reporter:
 				ticker.latest = &latest
+				ticker.subscribers.notify(latest)
 			// A user asked for the latest value so we send it
 			case publisher <- ticker.latest:
 			}
@@ -51,14 +63,578 @@ func (t *TickerDummy) Latest() *time.Time {
 	return <-t.publisher
 }
 
+// Subscribe returns a channel which is notified on new timestamps
+func (t *TickerDummy) Subscribe() chan time.Time {
+	return t.subscribers.subscribe()
+}
+
+// Unsubscribe stops notifications on a channel returned by Subscribe
+func (t *TickerDummy) Unsubscribe(ch chan time.Time) {
+	t.subscribers.unsubscribe(ch)
+}
+
 // GetReport returns a report of the oldest registered timestamps with the given limit
-func (t *TickerDummy) GetReport(limit int) (rep TickerReport, err error) {
-	rep, err = t.GetReportAfter(time.Unix(0, 0), limit)
+func (t *TickerDummy) GetReport(limit int, filter TrackFilter) (rep TickerReport, err error) {
+	rep, err = t.GetReportAfter(time.Unix(0, 0), limit, filter)
 	return
 }
 
 // GetReportAfter returns a report after a specified time with the given limit
-func (t *TickerDummy) GetReportAfter(timestamp time.Time, limit int) (rep TickerReport, err error) {
+func (t *TickerDummy) GetReportAfter(timestamp time.Time, limit int, filter TrackFilter) (rep TickerReport, err error) {
+	err = ErrNoTracksFound
+	return
+}
+
+// GetReportAfterCursor returns a report after a cursor with the given limit
+func (t *TickerDummy) GetReportAfterCursor(cursor TickerCursor, limit int, filter TrackFilter) (rep TickerReport, err error) {
+	err = ErrNoTracksFound
+	return
+}
+
+// GetReportBefore returns a report before a specified time with the given limit
+func (t *TickerDummy) GetReportBefore(timestamp time.Time, limit int, filter TrackFilter) (rep TickerReport, err error) {
 	err = ErrNoTracksFound
 	return
 }
+
+// GetReportRange returns a report between two times with the given limit
+func (t *TickerDummy) GetReportRange(from time.Time, to time.Time, limit int, filter TrackFilter) (rep TickerReport, err error) {
+	err = ErrNoTracksFound
+	return
+}
+
+// TickerMap is a ticker which builds reports from the tracks of a
+// TrackMetasMap, for testing the content of reports
+type TickerMap struct {
+	sync.Mutex
+	tracks      *TrackMetasMap
+	latest      *time.Time
+	subscribers *tickerSubscribers
+}
+
+// NewTickerMap creates a ticker reporting on the given tracks
+func NewTickerMap(tracks *TrackMetasMap) TickerMap {
+	return TickerMap{
+		sync.Mutex{},
+		tracks,
+		nil,
+		newTickerSubscribers(),
+	}
+}
+
+// Reporter sets the latest timestamp and notifies all subscribers
+func (t *TickerMap) Reporter(latest time.Time) {
+	t.Lock()
+	t.latest = &latest
+	t.Unlock()
+	t.subscribers.notify(latest)
+}
+
+// Latest returns the latest reported timestamp
+func (t *TickerMap) Latest() *time.Time {
+	t.Lock()
+	defer t.Unlock()
+	return t.latest
+}
+
+// Subscribe returns a channel which is notified on new timestamps
+func (t *TickerMap) Subscribe() chan time.Time {
+	return t.subscribers.subscribe()
+}
+
+// Unsubscribe stops notifications on a channel returned by Subscribe
+func (t *TickerMap) Unsubscribe(ch chan time.Time) {
+	t.subscribers.unsubscribe(ch)
+}
+
+// GetReport returns a report of the oldest tracks with the given limit
+func (t *TickerMap) GetReport(limit int, filter TrackFilter) (TickerReport, error) {
+	return t.getReport(func(TrackMeta) bool { return true }, false, limit, filter)
+}
+
+// GetReportAfter returns a report after a specified time with the given limit
+func (t *TickerMap) GetReportAfter(timestamp time.Time, limit int, filter TrackFilter) (TickerReport, error) {
+	return t.getReport(func(meta TrackMeta) bool { return meta.Timestamp.After(timestamp) }, false, limit, filter)
+}
+
+// GetReportAfterCursor returns a report after a cursor with the given limit
+func (t *TickerMap) GetReportAfterCursor(cursor TickerCursor, limit int, filter TrackFilter) (TickerReport, error) {
+	return t.getReport(func(meta TrackMeta) bool {
+		return meta.Timestamp.After(cursor.Timestamp) ||
+			(meta.Timestamp.Equal(cursor.Timestamp) && meta.ID > cursor.ID)
+	}, false, limit, filter)
+}
+
+// GetReportBefore returns a report before a specified time with the given limit
+func (t *TickerMap) GetReportBefore(timestamp time.Time, limit int, filter TrackFilter) (TickerReport, error) {
+	return t.getReport(func(meta TrackMeta) bool { return meta.Timestamp.Before(timestamp) }, true, limit, filter)
+}
+
+// GetReportRange returns a report between two times with the given limit
+func (t *TickerMap) GetReportRange(from time.Time, to time.Time, limit int, filter TrackFilter) (TickerReport, error) {
+	return t.getReport(func(meta TrackMeta) bool {
+		ts := meta.Timestamp
+		return (from.IsZero() || !ts.Before(from)) && (to.IsZero() || !ts.After(to))
+	}, false, limit, filter)
+}
+
+func (t *TickerMap) getReport(match func(TrackMeta) bool, newest bool, limit int, filter TrackFilter) (rep TickerReport, err error) {
+	latest := t.Latest()
+	filtered := filter != (TrackFilter{})
+	if filtered {
+		latest = nil
+	}
+
+	t.tracks.RLock()
+	var metas []TrackMeta
+	for _, meta := range t.tracks.data {
+		if !filter.Matches(meta) {
+			continue
+		}
+		if filtered && (latest == nil || meta.Timestamp.After(*latest)) {
+			timestamp := meta.Timestamp
+			latest = &timestamp
+		}
+		if match(meta) {
+			metas = append(metas, meta)
+		}
+	}
+	t.tracks.RUnlock()
+
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].Timestamp.Equal(metas[j].Timestamp) {
+			return metas[i].ID < metas[j].ID
+		}
+		return metas[i].Timestamp.Before(metas[j].Timestamp)
+	})
+	if len(metas) > limit {
+		if newest {
+			metas = metas[len(metas)-limit:]
+		} else {
+			metas = metas[:limit]
+		}
+	}
+	if len(metas) < 1 {
+		err = ErrNoTracksFound
+		return
+	}
+	rep = newTickerReport(*latest, metas, time.Now())
+	return
+}
+
+// Test that the limit of ticker reports defaults, is capped and is validated
+func TestParseTickerLimit(t *testing.T) {
+	for _, data := range []struct {
+		query string
+		limit int
+		err   error
+	}{
+		{"", tickerDefaultLimit, nil},
+		{"?limit=12", 12, nil},
+		{"?limit=100000", tickerMaxLimit, nil},
+		{"?limit=0", 0, ErrInvalidLimit},
+		{"?limit=-3", 0, ErrInvalidLimit},
+		{"?limit=many", 0, ErrInvalidLimit},
+	} {
+		req := httptest.NewRequest("GET", "/ticker"+data.query, nil)
+		limit, err := parseTickerLimit(req)
+		if limit != data.limit || err != data.err {
+			t.Errorf("expected '%s' to give limit %d and error '%v', got %d and '%v'", data.query, data.limit, data.err, limit, err)
+		}
+	}
+}
+
+// Test the status codes of the ticker report queries
+func TestIgcServerTickerQueries(t *testing.T) {
+	server, fileserver := makeTestServers()
+	defer fileserver.Close()
+
+	for _, data := range []struct {
+		path string
+		code int
+	}{
+		{"/ticker?limit=10", http.StatusNotFound},
+		{"/ticker?limit=none", http.StatusBadRequest},
+		{"/ticker?from=2018-06-01T00:00:00Z&to=2018-06-02T00:00:00Z", http.StatusNotFound},
+		{"/ticker?from=2018-06-01T00:00:00Z", http.StatusNotFound},
+		{"/ticker?from=yesterday", http.StatusBadRequest},
+		{"/ticker?from=2018-06-02T00:00:00Z&to=2018-06-01T00:00:00Z", http.StatusBadRequest},
+		{"/ticker/2018-06-01T00:00:00Z?limit=3", http.StatusNotFound},
+		{"/ticker/2018-06-01T00:00:00Z?limit=x", http.StatusBadRequest},
+		{"/ticker/before/2018-06-01T00:00:00Z", http.StatusNotFound},
+		{"/ticker/before/2018-06-01T00:00:00Z?limit=0", http.StatusBadRequest},
+		{"/ticker/before/yesterday", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("GET", data.path, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != data.code {
+			t.Errorf("expected `GET %s` to return %d, got %d", data.path, data.code, code)
+		}
+	}
+}
+
+// makeTickerTestServer creates a server with a ticker reporting on tracks
+// registered a minute apart, starting at the returned time
+func makeTickerTestServer(count int) (server Server, tracks *TrackMetasMap, ticker *TickerMap, start time.Time) {
+	trackMetasMap := NewTrackMetasMap()
+	tickerMap := NewTickerMap(&trackMetasMap)
+	tracks, ticker = &trackMetasMap, &tickerMap
+	server = NewServer(nil, tracks, ticker, nil, nil, nil)
+
+	start = time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		addTickerTestTrack(tracks, ticker, TrackID(i+1), start.Add(time.Duration(i)*time.Minute))
+	}
+	return
+}
+
+func addTickerTestTrack(tracks *TrackMetasMap, ticker *TickerMap, id TrackID, timestamp time.Time) {
+	tracks.Append(TrackMeta{ID: id, Timestamp: timestamp})
+	ticker.Reporter(timestamp)
+}
+
+// Test the content of the ticker reports
+func TestIgcServerTickerReports(t *testing.T) {
+	server, _, _, start := makeTickerTestServer(8)
+
+	stamp := func(minutes int) string {
+		return start.Add(time.Duration(minutes) * time.Minute).Format(time.RFC3339)
+	}
+	for _, data := range []struct {
+		path string
+		ids  []TrackID
+	}{
+		{"/ticker", []TrackID{1, 2, 3, 4, 5}},
+		{"/ticker?limit=2", []TrackID{1, 2}},
+		{"/ticker/" + stamp(5), []TrackID{7, 8}},
+		{"/ticker/before/" + stamp(5), []TrackID{1, 2, 3, 4, 5}},
+		{"/ticker/before/" + stamp(5) + "?limit=2", []TrackID{4, 5}},
+		{"/ticker?from=" + stamp(2) + "&to=" + stamp(4), []TrackID{3, 4, 5}},
+		{"/ticker?from=" + stamp(6), []TrackID{7, 8}},
+		{"/ticker?to=" + stamp(1) + "&limit=1", []TrackID{1}},
+	} {
+		req := httptest.NewRequest("GET", data.path, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		var report TickerReport
+		if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+			t.Errorf("received response body: '%s'", res.Body)
+			t.Fatalf("failed when trying to decode body as json")
+		}
+		if !cmp.Equal(report.Tracks, data.ids) {
+			t.Errorf("expected `GET %s` to report %v, got %v", data.path, data.ids, report.Tracks)
+		}
+		if !report.Latest.Equal(start.Add(7 * time.Minute)) {
+			t.Errorf("expected latest of `GET %s` to be the last track, got %s", data.path, report.Latest)
+		}
+	}
+}
+
+// Test GET /ticker/wait
+func TestIgcServerTickerWait(t *testing.T) {
+	server, tracks, ticker, start := makeTickerTestServer(2)
+
+	// Tracks after the timestamp already exist
+	req := httptest.NewRequest("GET", "/ticker/wait?after="+start.Format(time.RFC3339), nil)
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var report TickerReport
+	if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+		t.Errorf("received response body: '%s'", res.Body)
+		t.Fatalf("failed when trying to decode body as json")
+	}
+	if !cmp.Equal(report.Tracks, []TrackID{2}) {
+		t.Errorf("expected wait to immediately report track 2, got %v", report.Tracks)
+	}
+
+	// No tracks are added before the timeout
+	req = httptest.NewRequest("GET", "/ticker/wait?timeout=10ms", nil)
+	res = httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	if code := res.Result().StatusCode; code != http.StatusNoContent {
+		t.Errorf("expected wait to time out with 204, got %d", code)
+	}
+
+	// A track is added while waiting
+	waited := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest("GET", "/ticker/wait?timeout=5s", nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		waited <- res
+	}()
+	for subscribed := false; !subscribed; {
+		time.Sleep(time.Millisecond)
+		ticker.subscribers.Lock()
+		subscribed = len(ticker.subscribers.chans) > 0
+		ticker.subscribers.Unlock()
+	}
+	addTickerTestTrack(tracks, ticker, 3, start.Add(time.Hour))
+
+	select {
+	case res := <-waited:
+		var report TickerReport
+		if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+			t.Errorf("received response body: '%s'", res.Body)
+			t.Fatalf("failed when trying to decode body as json")
+		}
+		if !cmp.Equal(report.Tracks, []TrackID{3}) {
+			t.Errorf("expected wait to report the added track, got %v", report.Tracks)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("wait did not respond when a track was added")
+	}
+
+	req = httptest.NewRequest("GET", "/ticker/wait?timeout=soon", nil)
+	res = httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("expected invalid timeout to return 400, got %d", code)
+	}
+}
+
+// Test GET /ticker/stream, resuming after a specific event
+func TestIgcServerTickerStream(t *testing.T) {
+	server, tracks, ticker, start := makeTickerTestServer(3)
+	httpServer := httptest.NewServer(&server)
+	defer httpServer.Close()
+
+	req, _ := http.NewRequest("GET", httpServer.URL+"/ticker/stream", nil)
+	req.Header.Set("Last-Event-ID", start.Format(time.RFC3339Nano))
+	res, err := httpServer.Client().Do(req)
+	if err != nil {
+		t.Fatalf("unable to request stream: %s", err)
+	}
+	defer res.Body.Close()
+
+	reports := make(chan TickerReport)
+	go func() {
+		defer close(reports)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "data: ") {
+				var report TickerReport
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &report)
+				reports <- report
+			}
+		}
+	}()
+	next := func() TickerReport {
+		select {
+		case report := <-reports:
+			return report
+		case <-time.After(3 * time.Second):
+			t.Fatalf("stream did not send a report")
+		}
+		return TickerReport{}
+	}
+
+	if report := next(); !cmp.Equal(report.Tracks, []TrackID{2, 3}) {
+		t.Errorf("expected stream to resume with tracks 2 and 3, got %v", report.Tracks)
+	}
+
+	addTickerTestTrack(tracks, ticker, 4, start.Add(time.Hour))
+
+	if report := next(); !cmp.Equal(report.Tracks, []TrackID{4}) {
+		t.Errorf("expected stream to push track 4, got %v", report.Tracks)
+	}
+}
+
+// Test that cursors survive a round trip and that invalid cursors are rejected
+func TestParseTickerCursor(t *testing.T) {
+	cursor := TickerCursor{time.Date(2018, 6, 1, 12, 0, 0, 123456789, time.UTC), 42}
+	parsed, err := ParseTickerCursor(cursor.String())
+	if err != nil || !parsed.Timestamp.Equal(cursor.Timestamp) || parsed.ID != cursor.ID {
+		t.Errorf("expected cursor '%s' to survive a round trip, got '%s' and '%v'", cursor, parsed, err)
+	}
+
+	for _, s := range []string{"", "123", "abc-1", "123-abc", "123-99999999999"} {
+		if _, err := ParseTickerCursor(s); err != ErrInvalidCursor {
+			t.Errorf("expected '%s' to be an invalid cursor, got '%v'", s, err)
+		}
+	}
+}
+
+// Test that paging with cursors visits every track once, even when several
+// tracks share a timestamp
+func TestIgcServerTickerCursor(t *testing.T) {
+	server, tracks, ticker, start := makeTickerTestServer(2)
+	shared := start.Add(time.Hour)
+	for id := TrackID(3); id <= 7; id++ {
+		addTickerTestTrack(tracks, ticker, id, shared)
+	}
+
+	var got []TrackID
+	path := "/ticker?limit=2"
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", path, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if res.Result().StatusCode == http.StatusNotFound {
+			break
+		}
+		var report TickerReport
+		if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+			t.Errorf("received response body: '%s'", res.Body)
+			t.Fatalf("failed when trying to decode body as json")
+		}
+		got = append(got, report.Tracks...)
+		path = "/ticker?limit=2&cursor=" + report.Cursor.String()
+	}
+	if expt := []TrackID{1, 2, 3, 4, 5, 6, 7}; !cmp.Equal(got, expt) {
+		t.Errorf("expected paging to visit %v, got %v", expt, got)
+	}
+
+	req := httptest.NewRequest("GET", "/ticker?cursor=yesterday", nil)
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	if code := res.Result().StatusCode; code != http.StatusBadRequest {
+		t.Errorf("expected invalid cursor to return 400, got %d", code)
+	}
+}
+
+// Test GET /ticker?expand=tracks
+func TestIgcServerTickerExpand(t *testing.T) {
+	server, tracks, ticker, start := makeTickerTestServer(0)
+	for _, meta := range makeIGCTestData("localhost") {
+		meta.Timestamp = start
+		meta.Takeoff = NewGeoPoint(60.0, 10.0)
+		tracks.Append(meta)
+		ticker.Reporter(meta.Timestamp)
+	}
+
+	for _, data := range []struct {
+		path   string
+		fields []string
+	}{
+		{"/ticker?expand=tracks", []string{"id", "timestamp", "H_date", "pilot", "glider", "glider_id", "track_length", "track_src_url", "source_format", "motor_run", "signature_status", "takeoff"}},
+		{"/ticker?expand=tracks&fields=pilot,track_length", []string{"id", "pilot", "track_length"}},
+		{"/ticker/before/" + start.Add(time.Hour).Format(time.RFC3339) + "?expand=tracks&fields=glider", []string{"id", "glider"}},
+	} {
+		req := httptest.NewRequest("GET", data.path, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		var report struct {
+			Tracks   []TrackID                `json:"tracks"`
+			Expanded []map[string]interface{} `json:"expanded"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+			t.Errorf("received response body: '%s'", res.Body)
+			t.Fatalf("failed when trying to decode body as json")
+		}
+		if len(report.Expanded) != len(report.Tracks) {
+			t.Fatalf("expected `GET %s` to expand all %d tracks, got %d", data.path, len(report.Tracks), len(report.Expanded))
+		}
+		for i, summary := range report.Expanded {
+			if TrackID(summary["id"].(float64)) != report.Tracks[i] {
+				t.Errorf("expected summary %d to be of track '%d', got %v", i, report.Tracks[i], summary["id"])
+			}
+			var fields []string
+			for field := range summary {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			sort.Strings(data.fields)
+			if !cmp.Equal(fields, data.fields) {
+				t.Errorf("expected `GET %s` to contain fields %v, got %v", data.path, data.fields, fields)
+			}
+		}
+	}
+
+	for _, path := range []string{"/ticker?expand=webhooks", "/ticker?expand=tracks&fields=secret"} {
+		req := httptest.NewRequest("GET", path, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != http.StatusBadRequest {
+			t.Errorf("expected `GET %s` to return 400, got %d", path, code)
+		}
+	}
+}
+
+// Test that ticker reports are filtered and that the latest timestamp is the
+// latest of the filtered tracks
+func TestIgcServerTickerFilter(t *testing.T) {
+	server, tracks, ticker, start := makeTickerTestServer(0)
+	for i, data := range []struct {
+		pilot   string
+		length  float64
+		takeoff *GeoPoint
+	}{
+		{"John Normal", 10, NewGeoPoint(60.0, 10.0)},
+		{"Aladin Special", 50, NewGeoPoint(61.0, 10.0)},
+		{"John Normal", 60, NewGeoPoint(60.0, 10.01)},
+		{"Aladin Special", 5, nil},
+	} {
+		tracks.Append(TrackMeta{
+			ID:          TrackID(i + 1),
+			Timestamp:   start.Add(time.Duration(i) * time.Minute),
+			Pilot:       data.pilot,
+			TrackLength: data.length,
+			Takeoff:     data.takeoff,
+		})
+		ticker.Reporter(start.Add(time.Duration(i) * time.Minute))
+	}
+
+	for _, data := range []struct {
+		path   string
+		ids    []TrackID
+		latest time.Duration
+	}{
+		{"/ticker?pilot=john%20normal", []TrackID{1, 3}, 2 * time.Minute},
+		{"/ticker?min_length=40", []TrackID{2, 3}, 2 * time.Minute},
+		{"/ticker?site=60,10,2", []TrackID{1, 3}, 2 * time.Minute},
+		{"/ticker?pilot=Aladin%20Special&min_length=1", []TrackID{2, 4}, 3 * time.Minute},
+		{"/ticker?pilot=Aladin%20Special&site=61,10,1", []TrackID{2}, time.Minute},
+		{"/ticker/" + start.Format(time.RFC3339) + "?pilot=John%20Normal", []TrackID{3}, 2 * time.Minute},
+	} {
+		req := httptest.NewRequest("GET", data.path, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		var report TickerReport
+		if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+			t.Errorf("received response body: '%s'", res.Body)
+			t.Fatalf("failed when trying to decode body as json")
+		}
+		if !cmp.Equal(report.Tracks, data.ids) {
+			t.Errorf("expected `GET %s` to report %v, got %v", data.path, data.ids, report.Tracks)
+		}
+		if latest := start.Add(data.latest); !report.Latest.Equal(latest) {
+			t.Errorf("expected latest of `GET %s` to be '%s', got '%s'", data.path, latest, report.Latest)
+		}
+	}
+
+	for _, path := range []string{"/ticker?site=60,10", "/ticker?min_length=far", "/ticker?pilot=John&site=a,b,c"} {
+		req := httptest.NewRequest("GET", path, nil)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != http.StatusBadRequest {
+			t.Errorf("expected `GET %s` to return 400, got %d", path, code)
+		}
+	}
+}
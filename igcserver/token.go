@@ -0,0 +1,40 @@
+package igcserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	// TokenHeader is the header used to return a generated token, which has
+	// to be given as a bearer token to manage what was created
+	TokenHeader = "X-Paragliding-Token"
+)
+
+// newToken creates a random token
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// bearerToken returns the bearer token in the authorization header of a
+// request, or an empty string if there is none
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+// hashToken hashes a token, so that only the hash has to be stored
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,223 @@
+package igcserver
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"github.com/marni/goigc"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TrackFormatIGC is the source format of tracks uploaded as igc files
+	TrackFormatIGC = "igc"
+
+	// TrackFormatGPX is the source format of tracks uploaded as gpx files
+	TrackFormatGPX = "gpx"
+
+	// TrackFormatKML is the source format of tracks uploaded as kml files
+	TrackFormatKML = "kml"
+
+	// sniffLen is how much of the content is inspected to detect the format
+	sniffLen = 1024
+)
+
+var (
+	// ErrNoTrackPoints is returned if a gpx or kml file did not contain any
+	// track points
+	ErrNoTrackPoints = errors.New("no track points found")
+)
+
+// detectFormat detects the format of a track from its content, falling back
+// to the extension of the name if the content is xml of an unknown kind
+func detectFormat(name string, content string) string {
+	head := content
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	head = strings.TrimLeft(strings.TrimPrefix(head, "\ufeff"), " \t\r\n")
+	if !strings.HasPrefix(head, "<") {
+		return TrackFormatIGC
+	}
+	if strings.Contains(head, "<gpx") {
+		return TrackFormatGPX
+	}
+	if strings.Contains(head, "<kml") {
+		return TrackFormatKML
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gpx":
+		return TrackFormatGPX
+	case ".kml":
+		return TrackFormatKML
+	}
+	return TrackFormatIGC
+}
+
+// parseTrack parses the content of a track in any of the supported formats
+func parseTrack(format string, content string) (igc.Track, error) {
+	switch format {
+	case TrackFormatGPX:
+		return parseGPX(content)
+	case TrackFormatKML:
+		return parseKML(content)
+	default:
+		return igc.Parse(content)
+	}
+}
+
+// newPointAt creates a point where the time is the time of day of the given
+// timestamp, which is how points of igc tracks are represented
+func newPointAt(lat, lng, ele float64, t time.Time) igc.Point {
+	point := igc.NewPointFromLatLng(lat, lng)
+	t = t.UTC()
+	point.Time = time.Date(0, 1, 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	point.FixValidity = 'A'
+	point.GNSSAltitude = int64(math.Round(ele))
+	return point
+}
+
+// newTrackFrom creates a track from points with absolute timestamps, where
+// the date of the track is the date of the first point
+func newTrackFrom(pilot string, lats, lngs, eles []float64, times []time.Time) (track igc.Track, err error) {
+	if len(lats) == 0 {
+		err = ErrNoTrackPoints
+		return
+	}
+	track = igc.NewTrack()
+	track.Pilot = pilot
+	if !times[0].IsZero() {
+		first := times[0].UTC()
+		track.Date = time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	for i := range lats {
+		track.Points = append(track.Points, newPointAt(lats[i], lngs[i], eles[i], times[i]))
+	}
+	return
+}
+
+// gpxFile contains the parts of a gpx file which are used
+type gpxFile struct {
+	Metadata struct {
+		Author struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+	} `xml:"metadata"`
+	Tracks []struct {
+		Segments []struct {
+			Points []struct {
+				Lat  float64   `xml:"lat,attr"`
+				Lon  float64   `xml:"lon,attr"`
+				Ele  float64   `xml:"ele"`
+				Time time.Time `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// parseGPX converts the tracks of a gpx file into a single track, the pilot
+// is the author of the file and the other header fields are left empty
+func parseGPX(content string) (track igc.Track, err error) {
+	var gpx gpxFile
+	if err = xml.Unmarshal([]byte(content), &gpx); err != nil {
+		return
+	}
+	var lats, lngs, eles []float64
+	var times []time.Time
+	for _, trk := range gpx.Tracks {
+		for _, seg := range trk.Segments {
+			for _, pt := range seg.Points {
+				lats = append(lats, pt.Lat)
+				lngs = append(lngs, pt.Lon)
+				eles = append(eles, pt.Ele)
+				times = append(times, pt.Time)
+			}
+		}
+	}
+	return newTrackFrom(gpx.Metadata.Author.Name, lats, lngs, eles, times)
+}
+
+// parseKML converts the `gx:Track` elements of a kml file into a single
+// track, falling back to `LineString` coordinates (which have no time) if the
+// file contains no tracks
+func parseKML(content string) (track igc.Track, err error) {
+	dec := xml.NewDecoder(strings.NewReader(content))
+
+	var lats, lngs, eles []float64
+	var whens []time.Time
+	var lineLats, lineLngs, lineEles []float64
+	var elem string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return track, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			elem = tok.Name.Local
+		case xml.EndElement:
+			elem = ""
+		case xml.CharData:
+			text := string(bytes.TrimSpace(tok))
+			switch elem {
+			case "when":
+				when, err := time.Parse(time.RFC3339, text)
+				if err != nil {
+					return track, err
+				}
+				whens = append(whens, when)
+			case "coord":
+				// Coordinates of a track are separated by spaces
+				lng, lat, ele, err := parseKMLCoord(strings.Fields(text))
+				if err != nil {
+					return track, err
+				}
+				lats, lngs, eles = append(lats, lat), append(lngs, lng), append(eles, ele)
+			case "coordinates":
+				// Coordinates of a line are separated by commas and each
+				// tuple is separated by whitespace
+				for _, tuple := range strings.Fields(text) {
+					lng, lat, ele, err := parseKMLCoord(strings.Split(tuple, ","))
+					if err != nil {
+						return track, err
+					}
+					lineLats, lineLngs, lineEles = append(lineLats, lat), append(lineLngs, lng), append(lineEles, ele)
+				}
+			}
+		}
+	}
+
+	if len(lats) > 0 {
+		if len(whens) != len(lats) {
+			return track, errors.New("number of timestamps does not match number of coordinates")
+		}
+		return newTrackFrom("", lats, lngs, eles, whens)
+	}
+	return newTrackFrom("", lineLats, lineLngs, lineEles, make([]time.Time, len(lineLats)))
+}
+
+// parseKMLCoord parses a kml coordinate given as longitude, latitude and an
+// optional altitude
+func parseKMLCoord(parts []string) (lng, lat, ele float64, err error) {
+	if len(parts) < 2 || len(parts) > 3 {
+		err = errors.New("invalid kml coordinate")
+		return
+	}
+	if lng, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return
+	}
+	if lat, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return
+	}
+	if len(parts) == 3 {
+		ele, err = strconv.ParseFloat(parts[2], 64)
+	}
+	return
+}
@@ -0,0 +1,196 @@
+package igcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="phone" xmlns="http://www.topografix.com/GPX/1/1">
+  <metadata>
+    <author><name>John Normal</name></author>
+  </metadata>
+  <trk>
+    <trkseg>
+      <trkpt lat="60.0" lon="10.0"><ele>1000.4</ele><time>2018-06-01T12:00:00Z</time></trkpt>
+      <trkpt lat="60.01" lon="10.0"><ele>1010</ele><time>2018-06-01T12:00:10Z</time></trkpt>
+    </trkseg>
+    <trkseg>
+      <trkpt lat="60.02" lon="10.0"><ele>1020</ele><time>2018-06-01T12:00:20Z</time></trkpt>
+    </trkseg>
+  </trk>
+</gpx>`
+
+const testKML = `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2" xmlns:gx="http://www.google.com/kml/ext/2.2">
+  <Document>
+    <Placemark>
+      <gx:Track>
+        <when>2018-06-01T12:00:00Z</when>
+        <when>2018-06-01T12:00:10Z</when>
+        <gx:coord>10.0 60.0 1000</gx:coord>
+        <gx:coord>10.0 60.01 1010</gx:coord>
+      </gx:Track>
+    </Placemark>
+  </Document>
+</kml>`
+
+const testKMLLine = `<kml xmlns="http://www.opengis.net/kml/2.2">
+  <Placemark>
+    <LineString>
+      <coordinates>10.0,60.0,1000 10.0,60.01,1010
+        10.0,60.02</coordinates>
+    </LineString>
+  </Placemark>
+</kml>`
+
+// Test that the format of tracks is detected from content and extension
+func TestDetectFormat(t *testing.T) {
+	for _, data := range []struct {
+		name    string
+		content string
+		expt    string
+	}{
+		{"track.igc", "AXXX001\nHFDTE010618\n", TrackFormatIGC},
+		{"track.gpx", "AXXX001\nHFDTE010618\n", TrackFormatIGC},
+		{"track", testGPX, TrackFormatGPX},
+		{"track.igc", testGPX, TrackFormatGPX},
+		{"track", "\ufeff  " + testKML, TrackFormatKML},
+		{"track", testKMLLine, TrackFormatKML},
+		{"track.kml", "<?xml version=\"1.0\"?><!-- unknown -->", TrackFormatKML},
+		{"track.gpx", "<?xml version=\"1.0\"?><!-- unknown -->", TrackFormatGPX},
+	} {
+		if got := detectFormat(data.name, data.content); got != data.expt {
+			t.Errorf("expected '%s' to be detected as '%s', got '%s'", data.name, data.expt, got)
+		}
+	}
+}
+
+// Test that gpx and kml files are converted into tracks
+func TestParseTrackFormats(t *testing.T) {
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, data := range []struct {
+		format  string
+		content string
+		pilot   string
+		points  int
+		date    time.Time
+	}{
+		{TrackFormatGPX, testGPX, "John Normal", 3, date},
+		{TrackFormatKML, testKML, "", 2, date},
+		{TrackFormatKML, testKMLLine, "", 3, time.Time{}},
+	} {
+		track, err := parseTrack(data.format, data.content)
+		if err != nil {
+			t.Errorf("unable to parse %s: %s", data.format, err)
+			continue
+		}
+		if track.Pilot != data.pilot {
+			t.Errorf("expected pilot of %s to be '%s', got '%s'", data.format, data.pilot, track.Pilot)
+		}
+		if !track.Date.Equal(data.date) {
+			t.Errorf("expected date of %s to be '%s', got '%s'", data.format, data.date, track.Date)
+		}
+		if len(track.Points) != data.points {
+			t.Fatalf("expected %s to contain %d points, got %d", data.format, data.points, len(track.Points))
+		}
+		second := track.Points[1]
+		if lat := second.Lat.Degrees(); lat < 60.0099 || lat > 60.0101 {
+			t.Errorf("expected latitude of second point in %s to be 60.01, got %f", data.format, lat)
+		}
+		if second.GNSSAltitude != 1010 {
+			t.Errorf("expected altitude of second point in %s to be 1010, got %d", data.format, second.GNSSAltitude)
+		}
+		if !data.date.IsZero() {
+			if h, m, s := second.Time.Clock(); h != 12 || m != 0 || s != 10 {
+				t.Errorf("expected time of second point in %s to be 12:00:10, got %s", data.format, second.Time)
+			}
+		}
+	}
+
+	for _, data := range []struct {
+		format  string
+		content string
+	}{
+		{TrackFormatGPX, "<gpx><trk></trk></gpx>"},
+		{TrackFormatGPX, "<gpx><trk>"},
+		{TrackFormatKML, "<kml><Placemark></Placemark></kml>"},
+		{TrackFormatKML, "<kml><coordinates>a,b</coordinates></kml>"},
+		{TrackFormatKML, "<kml><when>2018-06-01T12:00:00Z</when></kml><coord>1 2 3</coord><coord>1 2 3</coord>"},
+	} {
+		if _, err := parseTrack(data.format, data.content); err == nil {
+			t.Errorf("expected '%s' to be rejected as %s", data.content, data.format)
+		}
+	}
+}
+
+// Test POST /track of a gpx file
+func TestIgcServerPostTrackGPX(t *testing.T) {
+	gpxServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testGPX)
+	}))
+	defer gpxServer.Close()
+
+	server, fileserver := makeTestServers()
+	defer fileserver.Close()
+
+	body := fmt.Sprintf("{\"url\":\"%s\"}", gpxServer.URL+"/phone.gpx")
+	req := httptest.NewRequest("POST", "/track", bytes.NewReader([]byte(body)))
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var data map[string]TrackID
+	if err := json.Unmarshal(res.Body.Bytes(), &data); err != nil {
+		t.Errorf("received response body: '%s'", res.Body)
+		t.Fatalf("failed when trying to decode body as json")
+	}
+	meta, err := server.tracks.Get(data["id"])
+	if err != nil {
+		t.Fatalf("unable to get registered track: %s", err)
+	}
+	if meta.SourceFormat != TrackFormatGPX {
+		t.Errorf("expected source format to be '%s', got '%s'", TrackFormatGPX, meta.SourceFormat)
+	}
+	if meta.Pilot != "John Normal" || meta.Glider != "" || meta.TrackLength == 0 {
+		t.Errorf("unexpected metadata of gpx track: %v", meta)
+	}
+	if _, err := server.getTrack(meta.ID); err != nil {
+		t.Errorf("unable to get stored gpx track: %s", err)
+	}
+}
+
+// Test that stored tracks are parsed with the format they were registered
+// with, even if the format can not be detected from the content alone
+func TestGetTrackSourceFormat(t *testing.T) {
+	content := "<!--" + strings.Repeat(" ", 2*sniffLen) + "-->\n" + testGPX
+	gpxServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, content)
+	}))
+	defer gpxServer.Close()
+
+	server, fileserver := makeTestServers()
+	defer fileserver.Close()
+
+	body := fmt.Sprintf("{\"url\":\"%s\"}", gpxServer.URL+"/commented.gpx")
+	req := httptest.NewRequest("POST", "/track", bytes.NewReader([]byte(body)))
+	res := httptest.NewRecorder()
+
+	server.ServeHTTP(res, req)
+
+	var data map[string]TrackID
+	if err := json.Unmarshal(res.Body.Bytes(), &data); err != nil {
+		t.Errorf("received response body: '%s'", res.Body)
+		t.Fatalf("failed when trying to decode body as json")
+	}
+	if _, err := server.getTrack(data["id"]); err != nil {
+		t.Errorf("unable to get stored gpx track: %s", err)
+	}
+}
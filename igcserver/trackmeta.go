@@ -1,6 +1,7 @@
 package igcserver
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/mux"
@@ -9,12 +10,20 @@ import (
 	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// leaderboardSize is how many of the longest tracks are on the
+	// leaderboard
+	leaderboardSize = 10
+)
+
 var (
 	// ErrTrackNotFound is returned if a request did not result in a TrackMeta
 	ErrTrackNotFound = errors.New("track not found")
@@ -29,6 +38,14 @@ type TrackMetas interface {
 	Get(id TrackID) (TrackMeta, error)
 	Append(meta TrackMeta) error
 	GetAllIDs() ([]TrackID, error)
+	GetFilteredIDs(filter TrackFilter) ([]TrackID, error)
+	GetByDate(date time.Time) ([]TrackMeta, error)
+	AddRelation(id TrackID, relation TrackRelation) error
+	RemoveRelations(id TrackID) error
+	GetContent(id TrackID) (string, error)
+	AppendContent(id TrackID, content string) error
+	Update(meta TrackMeta, content string) error
+	Delete(id TrackID) (TrackMeta, error)
 }
 
 // TrackID is a unique id for a track
@@ -51,6 +68,160 @@ type TrackMeta struct {
 	GliderID    string    `json:"glider_id" bson:"glider_id"`
 	TrackLength float64   `json:"track_length" bson:"track_length"`
 	TrackSrcURL string    `json:"track_src_url" bson:"track_src_url"`
+
+	SourceFormat    string    `json:"source_format" bson:"source_format"`
+	MotorRun        bool      `json:"motor_run" bson:"motor_run"`
+	SignatureStatus string    `json:"signature_status" bson:"signature_status"`
+	Takeoff         *GeoPoint `json:"takeoff,omitempty" bson:"takeoff,omitempty"`
+	Owner           string    `json:"-" bson:"owner"`
+
+	Related []TrackRelation `json:"-" bson:"related"`
+}
+
+// GeoPoint is a point in GeoJSON format, which mongodb is able to index
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// NewGeoPoint creates a point from a latitude and a longitude in degrees
+func NewGeoPoint(lat float64, lng float64) *GeoPoint {
+	return &GeoPoint{"Point", []float64{lng, lat}}
+}
+
+// takeoffOf returns the first point of the track, if it has any
+func takeoffOf(points []igc.Point) *GeoPoint {
+	if len(points) == 0 {
+		return nil
+	}
+	return NewGeoPoint(points[0].Lat.Degrees(), points[0].Lng.Degrees())
+}
+
+// SiteFilter selects the tracks which took off within a radius (in km) of a
+// point
+type SiteFilter struct {
+	Lat    float64 `json:"lat" bson:"lat"`
+	Lng    float64 `json:"lng" bson:"lng"`
+	Radius float64 `json:"radius" bson:"radius"`
+}
+
+// TrackFilter selects the tracks matching all of the set fields, where empty
+// fields match any track. The dates are compared to the date of the flight
+// and are inclusive.
+type TrackFilter struct {
+	SignatureStatus string      `json:"signature_status,omitempty" bson:"signature_status,omitempty"`
+	Pilot           string      `json:"pilot,omitempty" bson:"pilot,omitempty"`
+	Glider          string      `json:"glider,omitempty" bson:"glider,omitempty"`
+	Site            *SiteFilter `json:"site,omitempty" bson:"site,omitempty"`
+	MinLength       float64     `json:"min_length,omitempty" bson:"min_length,omitempty"`
+	MaxLength       float64     `json:"max_length,omitempty" bson:"max_length,omitempty"`
+	DateFrom        time.Time   `json:"date_from,omitempty" bson:"date_from,omitempty"`
+	DateTo          time.Time   `json:"date_to,omitempty" bson:"date_to,omitempty"`
+}
+
+// TrackFilterFrom creates a filter from the query parameters of a request.
+// The site is given as `<lat>,<lng>,<radius in km>` and dates as
+// `YYYY-MM-DD`.
+func TrackFilterFrom(query url.Values) (filter TrackFilter, err error) {
+	filter.SignatureStatus = query.Get("signature_status")
+	filter.Pilot = query.Get("pilot")
+	filter.Glider = query.Get("glider")
+	if siteStr := query.Get("site"); siteStr != "" {
+		parts := strings.Split(siteStr, ",")
+		if len(parts) != 3 {
+			err = errors.New("site must be given as '<lat>,<lng>,<radius>'")
+			return
+		}
+		var values [3]float64
+		for i, part := range parts {
+			if values[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+				return
+			}
+		}
+		filter.Site = &SiteFilter{values[0], values[1], values[2]}
+	}
+	if minLengthStr := query.Get("min_length"); minLengthStr != "" {
+		if filter.MinLength, err = strconv.ParseFloat(minLengthStr, 64); err != nil {
+			return
+		}
+	}
+	if maxLengthStr := query.Get("max_length"); maxLengthStr != "" {
+		if filter.MaxLength, err = strconv.ParseFloat(maxLengthStr, 64); err != nil {
+			return
+		}
+	}
+	if dateFromStr := query.Get("date_from"); dateFromStr != "" {
+		if filter.DateFrom, err = time.Parse("2006-01-02", dateFromStr); err != nil {
+			return
+		}
+	}
+	if dateToStr := query.Get("date_to"); dateToStr != "" {
+		if filter.DateTo, err = time.Parse("2006-01-02", dateToStr); err != nil {
+			return
+		}
+	}
+	err = filter.Validate()
+	return
+}
+
+// Validate checks that the fields of the filter are within range
+func (filter *TrackFilter) Validate() error {
+	switch filter.SignatureStatus {
+	case "", SignatureValid, SignatureInvalid, SignatureMissing, SignatureUnsupported:
+	default:
+		return errors.New("unknown signature status")
+	}
+	if site := filter.Site; site != nil {
+		if math.Abs(site.Lat) > 90 || math.Abs(site.Lng) > 180 || site.Radius <= 0 {
+			return errors.New("site is out of range")
+		}
+	}
+	if filter.MinLength < 0 || filter.MaxLength < 0 {
+		return errors.New("length must not be negative")
+	}
+	if filter.MaxLength > 0 && filter.MinLength > filter.MaxLength {
+		return errors.New("minimum length must not be greater than maximum length")
+	}
+	if !filter.DateFrom.IsZero() && !filter.DateTo.IsZero() && filter.DateFrom.After(filter.DateTo) {
+		return errors.New("date from must not be after date to")
+	}
+	return nil
+}
+
+// Matches returns true if the track meta matches the filter
+func (filter *TrackFilter) Matches(meta TrackMeta) bool {
+	if filter.SignatureStatus != "" && filter.SignatureStatus != meta.SignatureStatus {
+		return false
+	}
+	if filter.Pilot != "" && !strings.EqualFold(filter.Pilot, meta.Pilot) {
+		return false
+	}
+	if filter.Glider != "" && !strings.EqualFold(filter.Glider, meta.Glider) {
+		return false
+	}
+	if filter.Site != nil {
+		if meta.Takeoff == nil {
+			return false
+		}
+		site := igc.NewPointFromLatLng(filter.Site.Lat, filter.Site.Lng)
+		takeoff := igc.NewPointFromLatLng(meta.Takeoff.Coordinates[1], meta.Takeoff.Coordinates[0])
+		if site.Distance(takeoff) > filter.Site.Radius {
+			return false
+		}
+	}
+	if meta.TrackLength < filter.MinLength {
+		return false
+	}
+	if filter.MaxLength > 0 && meta.TrackLength > filter.MaxLength {
+		return false
+	}
+	if !filter.DateFrom.IsZero() && meta.Date.Before(filter.DateFrom) {
+		return false
+	}
+	if !filter.DateTo.IsZero() && meta.Date.After(filter.DateTo) {
+		return false
+	}
+	return true
 }
 
 // calcTotalDistance returns the total distance between the points in order
@@ -72,7 +243,213 @@ func TrackMetaFrom(url url.URL, track igc.Track) TrackMeta {
 		track.GliderID,
 		calcTotalDistance(track.Points),
 		url.String(),
+		"",
+		hasMotorRun(track.Points),
+		"",
+		takeoffOf(track.Points),
+		"",
+		nil,
+	}
+}
+
+// getTrack fetches the stored content of a track and parses it according to
+// the format it was registered with
+func (server *Server) getTrack(id TrackID) (track igc.Track, err error) {
+	meta, err := server.tracks.Get(id)
+	if err != nil {
+		return
+	}
+	content, err := server.tracks.GetContent(id)
+	if err != nil {
+		return
+	}
+	format := meta.SourceFormat
+	if format == "" {
+		// Tracks registered before the format was recorded
+		format = detectFormat("", content)
+	}
+	return parseTrack(format, content)
+}
+
+// registerTrack stores a parsed track, which can be deleted using the token
+// of the given hash, and notifies the rest of the service that a new track
+// was added
+func (server *Server) registerTrack(url url.URL, content string, track igc.Track, owner string) (trackMeta TrackMeta, err error) {
+	// Store the raw content before the metadata so that a registered track
+	// always has its fixes available. Content which is already stored is
+	// kept, hence registering a duplicate track never changes its content.
+	trackMeta = TrackMetaFrom(url, track)
+	trackMeta.SourceFormat = detectFormat(url.Path, content)
+	trackMeta.SignatureStatus = verifySignature(trackMeta.SourceFormat, content, track)
+	trackMeta.Owner = owner
+	if err = server.tracks.AppendContent(trackMeta.ID, content); err != nil {
+		return
+	}
+	if err = server.tracks.Append(trackMeta); err != nil {
+		return
+	}
+
+	// Notify the ticker, webhooks, group flights and event subscribers
+	server.events.Publish(NewTrackEvent(EventTrackRegistered, trackMeta))
+	server.publishRankings(trackMeta)
+	return
+}
+
+// refreshTrack replaces the stored track with a newly fetched version of it,
+// keeping when it was registered and who owns it. Its group flights are
+// removed and linked again from the new version of the track. The rankings
+// are only published again if the length of the track changed.
+func (server *Server) refreshTrack(meta TrackMeta, srcURL url.URL, content string, track igc.Track) (trackMeta TrackMeta, err error) {
+	trackMeta = TrackMetaFrom(srcURL, track)
+	trackMeta.ID = meta.ID
+	trackMeta.Timestamp = meta.Timestamp
+	trackMeta.SourceFormat = detectFormat(srcURL.Path, content)
+	trackMeta.SignatureStatus = verifySignature(trackMeta.SourceFormat, content, track)
+	trackMeta.Owner = meta.Owner
+	if err = server.tracks.Update(trackMeta, content); err != nil {
+		return
+	}
+	if err = server.tracks.RemoveRelations(trackMeta.ID); err != nil {
+		return
+	}
+
+	server.events.Publish(NewTrackEvent(EventTrackRefreshed, trackMeta))
+	if trackMeta.TrackLength != meta.TrackLength {
+		server.publishRankings(trackMeta)
+	}
+	return
+}
+
+// publishRankings publishes the personal best and the place on the
+// leaderboard of a track which was just stored
+func (server *Server) publishRankings(trackMeta TrackMeta) {
+	if server.isPersonalBest(trackMeta) {
+		server.events.Publish(NewTrackEvent(EventPersonalBest, trackMeta))
+	}
+	if rank := server.leaderboardRank(trackMeta); rank > 0 {
+		server.events.Publish(NewLeaderboardEvent(trackMeta, rank))
+	}
+}
+
+// isPersonalBest checks if no other track of the pilot is at least as long as
+// the given track
+func (server *Server) isPersonalBest(trackMeta TrackMeta) bool {
+	if trackMeta.Pilot == "" {
+		return false
+	}
+	ids, err := server.tracks.GetFilteredIDs(TrackFilter{
+		Pilot:     trackMeta.Pilot,
+		MinLength: trackMeta.TrackLength,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"trackmeta": trackMeta,
+			"error":     err,
+		}).Error("unable to get tracks of pilot")
+		return false
+	}
+	return len(ids) == 1 && ids[0] == trackMeta.ID
+}
+
+// leaderboardRank returns the place of the track among the longest tracks,
+// where tracks of the same length share the lowest place, or 0 if it is not
+// on the leaderboard
+func (server *Server) leaderboardRank(trackMeta TrackMeta) int {
+	if trackMeta.TrackLength <= 0 {
+		return 0
+	}
+	ids, err := server.tracks.GetFilteredIDs(TrackFilter{MinLength: trackMeta.TrackLength})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"trackmeta": trackMeta,
+			"error":     err,
+		}).Error("unable to get tracks at least as long as track")
+		return 0
+	}
+	if len(ids) > leaderboardSize {
+		return 0
+	}
+	return len(ids)
+}
+
+// fetchTrack fetches and parses the track at the url, and responds with an
+// error and publishes that the ingestion failed if it is unable to
+func (server *Server) fetchTrack(w http.ResponseWriter, logger *log.Entry, trackURL url.URL) (content string, track igc.Track, ok bool) {
+	resp, err := server.httpClient.Get(trackURL.String())
+	if err != nil {
+		logger.WithField("error", err).Info("unable to fetch data from provided url")
+		server.events.Publish(NewIngestionFailedEvent(trackURL.String(), err))
+		http.Error(w, "unable to fetch data from provided url", http.StatusBadRequest)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to read all data from response")
+		server.events.Publish(NewIngestionFailedEvent(trackURL.String(), err))
+		http.Error(w, "unable to read data from provided url", http.StatusInternalServerError)
+		return
 	}
+	content = string(body)
+	format := detectFormat(trackURL.Path, content)
+	track, err = parseTrack(format, content)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"format": format,
+			"error":  err,
+		}).Info("unable to parse content as track")
+		server.events.Publish(NewIngestionFailedEvent(trackURL.String(), err))
+		http.Error(w, "unable to parse "+format+" content", http.StatusBadRequest)
+		return
+	}
+	return content, track, true
+}
+
+// trackOfRequest gets the track of the id in the path of a request, which
+// requires the token the track was registered with, or the admin token, as a
+// bearer token, and responds with an error if it is unable to. A wrong token
+// gives the same response as an unknown id.
+func (server *Server) trackOfRequest(w http.ResponseWriter, r *http.Request, logger *log.Entry) (meta TrackMeta, ok bool) {
+	vars := mux.Vars(r)
+	idStr, _ := vars["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logger.WithField("id", idStr).Info("id must be a valid number")
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	idlog := logger.WithField("id", id)
+	token := bearerToken(r)
+	if token == "" {
+		idlog.Info("request to manage track without a token")
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	meta, err = server.tracks.Get(TrackID(id))
+	if err == ErrTrackNotFound {
+		idlog.Info("unable to find metadata of id")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Info("error when getting metadata of id")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	owner := meta.Owner != "" && subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(meta.Owner)) == 1
+	if !owner && !server.isAdmin(token) {
+		idlog.Info("request to manage track with wrong token")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	}
+	return meta, true
+}
+
+// isAdmin checks if a token is the admin token of the server
+func (server *Server) isAdmin(token string) bool {
+	if server.config.AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(hashToken(server.config.AdminToken))) == 1
 }
 
 // --------- //
@@ -87,7 +464,9 @@ func TrackMetaFrom(url url.URL, track igc.Track) TrackMeta {
 // }
 // ```
 //
-// If a valid url to a `.igc` file is provided, the response will be in the
+// If a valid url to a `.igc`, `.gpx` or `.kml` file is provided, the track
+// can be deleted using the bearer token of the request, or a generated token
+// returned in the `X-Paragliding-Token` header. The response will be in the
 // following structure
 //
 // ```json
@@ -124,29 +503,25 @@ func (server *Server) trackRegHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "track with same url already exists", http.StatusForbidden)
 		return
 	}
-	resp, err := server.httpClient.Get(reqURL.String())
-	if err != nil {
-		logger.WithField("error", err).Info("unable to fetch data from provided url")
-		http.Error(w, "unable to fetch data from provided url", http.StatusBadRequest)
-		return
-	}
-	defer resp.Body.Close()
-	content, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		logger.WithField("error", err).Error("unable to read all data from response")
-		http.Error(w, "unable to read data from provided url", http.StatusInternalServerError)
+	content, track, ok := server.fetchTrack(w, logger, *reqURL)
+	if !ok {
 		return
 	}
-	track, err := igc.Parse(string(content))
-	if err != nil {
-		logger.WithField("error", err).Info("unable to parse igc content as track")
-		http.Error(w, "unable to parse igc content", http.StatusBadRequest)
-		return
+
+	// The caller may reuse its token for several tracks, otherwise a new
+	// token is generated
+	token := bearerToken(r)
+	generatedToken := false
+	if token == "" {
+		if token, err = newToken(); err != nil {
+			logger.WithField("error", err).Error("unable to generate track token")
+			http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+			return
+		}
+		generatedToken = true
 	}
 
-	// Create and add new trackmeta object
-	trackMeta := TrackMetaFrom(*reqURL, track)
-	err = server.tracks.Append(trackMeta)
+	trackMeta, err := server.registerTrack(*reqURL, content, track, hashToken(token))
 	if err == ErrTrackAlreadyExists {
 		logger.WithFields(log.Fields{
 			"trackmeta": trackMeta,
@@ -162,11 +537,6 @@ func (server *Server) trackRegHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Send the ticker information that we just added a track
-	server.ticker.Reporter(trackMeta.Timestamp)
-	// Trigger webhooks
-	server.webhooks.Trigger()
-
 	result := map[string]interface{}{
 		"id": trackMeta.ID,
 	}
@@ -175,6 +545,11 @@ func (server *Server) trackRegHandler(w http.ResponseWriter, r *http.Request) {
 		"trackmeta": trackMeta,
 	}).Info("responding with id of inserted track metadata")
 
+	// A generated token is only ever returned in the response to the
+	// registration
+	if generatedToken {
+		w.Header().Set(TokenHeader, token)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
@@ -184,13 +559,25 @@ type TrackRegRequest struct {
 	URLstr string `json:"url"`
 }
 
-// trackGetAllHandler returns all ids of registered igc files
+// trackGetAllHandler returns all ids of registered igc files, optionally
+// filtered by the signature status using `?signature_status=<status>`
 func (server *Server) trackGetAllHandler(w http.ResponseWriter, r *http.Request) {
 	logger := newReqLogger(r)
 
 	logger.Info("processing request to get all track ids")
 
-	ids, err := server.tracks.GetAllIDs()
+	filter, err := TrackFilterFrom(r.URL.Query())
+	if err != nil {
+		logger.WithField("error", err).Info("unable to parse filter")
+		http.Error(w, "invalid filter", http.StatusBadRequest)
+		return
+	}
+	var ids []TrackID
+	if filter == (TrackFilter{}) {
+		ids, err = server.tracks.GetAllIDs()
+	} else {
+		ids, err = server.tracks.GetFilteredIDs(filter)
+	}
 	if err != nil {
 		logger.WithField("error", err).Error("unable to respond to request of all IDs")
 		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
@@ -236,6 +623,81 @@ func (server *Server) trackGetHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(meta)
 }
 
+// trackDeleteHandler deletes a track and responds with its metadata, which
+// requires the token the track was registered with as a bearer token. A
+// wrong token gives the same response as an unknown id.
+func (server *Server) trackDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to delete specific track")
+
+	meta, ok := server.trackOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
+	idlog := logger.WithField("id", meta.ID)
+	meta, err := server.tracks.Delete(meta.ID)
+	if err == ErrTrackNotFound {
+		idlog.Info("unable to find metadata of id")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Info("error when deleting track of id")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	server.events.Publish(NewTrackEvent(EventTrackDeleted, meta))
+
+	idlog.WithFields(log.Fields{
+		"trackmeta": meta,
+	}).Info("responding with track meta of deleted track")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// trackRefreshHandler fetches a track again from the url it was registered
+// with and responds with its updated metadata, which requires the token the
+// track was registered with as a bearer token
+func (server *Server) trackRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to refresh specific track")
+
+	meta, ok := server.trackOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
+	idlog := logger.WithField("id", meta.ID)
+	srcURL, err := url.Parse(meta.TrackSrcURL)
+	if err != nil {
+		idlog.WithField("error", err).Error("unable to parse url of stored track")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	content, track, ok := server.fetchTrack(w, idlog, *srcURL)
+	if !ok {
+		return
+	}
+	meta, err = server.refreshTrack(meta, *srcURL, content, track)
+	if err == ErrTrackNotFound {
+		idlog.Info("track was deleted while it was refreshed")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Info("error when refreshing track of id")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+
+	idlog.WithFields(log.Fields{
+		"trackmeta": meta,
+	}).Info("responding with track meta of refreshed track")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
 // trackGetFieldHandler should return the field specified in the url
 func (server *Server) trackGetFieldHandler(w http.ResponseWriter, r *http.Request) {
 	logger := newReqLogger(r)
@@ -284,6 +746,15 @@ func (server *Server) trackGetFieldHandler(w http.ResponseWriter, r *http.Reques
 	case "track_src_url":
 		flog.Info("responding with track src url")
 		io.WriteString(w, meta.TrackSrcURL)
+	case "source_format":
+		flog.Info("responding with track source format")
+		io.WriteString(w, meta.SourceFormat)
+	case "motor_run":
+		flog.Info("responding with track motor run")
+		io.WriteString(w, strconv.FormatBool(meta.MotorRun))
+	case "signature_status":
+		flog.Info("responding with track signature status")
+		io.WriteString(w, meta.SignatureStatus)
 	default:
 		flog.Info("unable to find field of metadata")
 		http.Error(w, "invalid field", http.StatusBadRequest)
@@ -3,12 +3,23 @@ package igcserver
 import (
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
+	"github.com/marni/goigc"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"time"
 )
 
 const (
-	trackCollection = "igctracks"
+	trackCollection        = "igctracks"
+	trackContentCollection = "igccontents"
 )
 
+// trackContent is the raw igc content of a track as stored in the database
+type trackContent struct {
+	ID      TrackID `bson:"id"`
+	Content string  `bson:"content"`
+}
+
 // TrackMetasDB contains a map to many TrackMeta objects which are protected
 // by a RWMutex and indexed by a unique id
 type TrackMetasDB struct {
@@ -17,6 +28,16 @@ type TrackMetasDB struct {
 
 // NewTrackMetasDB creates a new mutex and mapping from ID to TrackMeta
 func NewTrackMetasDB(session *mgo.Session) TrackMetasDB {
+	// Tracks are filtered on where they took off
+	conn := session.Copy()
+	defer conn.Close()
+	err := conn.DB("").C(trackCollection).EnsureIndex(mgo.Index{
+		Key: []string{"$2dsphere:takeoff"},
+	})
+	if err != nil {
+		log.WithField("error", err).Warn("unable to ensure index on takeoff")
+	}
+
 	return TrackMetasDB{
 		session,
 	}
@@ -68,3 +89,179 @@ func (metas *TrackMetasDB) GetAllIDs() (ids []TrackID, err error) {
 	}
 	return
 }
+
+// GetFilteredIDs fetches the ids of all tracks matching the filter
+func (metas *TrackMetasDB) GetFilteredIDs(filter TrackFilter) (ids []TrackID, err error) {
+	conn := metas.session.Copy()
+	defer conn.Close()
+	tracks := conn.DB("").C(trackCollection)
+
+	var trackMetas []TrackMeta
+	err = tracks.Find(filter.query()).Select(bson.M{"id": 1}).All(&trackMetas)
+	if err == nil {
+		ids = make([]TrackID, len(trackMetas))
+		for i, v := range trackMetas {
+			ids[i] = v.ID
+		}
+	}
+	return
+}
+
+// query converts the filter into a mongodb query
+func (filter *TrackFilter) query() bson.M {
+	query := bson.M{}
+	if filter.SignatureStatus != "" {
+		query["signature_status"] = filter.SignatureStatus
+	}
+	if filter.Pilot != "" {
+		query["pilot"] = equalFoldRegex(filter.Pilot)
+	}
+	if filter.Glider != "" {
+		query["glider"] = equalFoldRegex(filter.Glider)
+	}
+	if filter.Site != nil {
+		query["takeoff"] = bson.M{"$geoWithin": bson.M{
+			"$centerSphere": []interface{}{
+				[]float64{filter.Site.Lng, filter.Site.Lat},
+				filter.Site.Radius / igc.EarthRadius,
+			},
+		}}
+	}
+	length := bson.M{}
+	if filter.MinLength > 0 {
+		length["$gte"] = filter.MinLength
+	}
+	if filter.MaxLength > 0 {
+		length["$lte"] = filter.MaxLength
+	}
+	if len(length) > 0 {
+		query["track_length"] = length
+	}
+	date := bson.M{}
+	if !filter.DateFrom.IsZero() {
+		date["$gte"] = filter.DateFrom
+	}
+	if !filter.DateTo.IsZero() {
+		date["$lte"] = filter.DateTo
+	}
+	if len(date) > 0 {
+		query["H_date"] = date
+	}
+	return query
+}
+
+// equalFoldRegex matches strings which are equal to s, ignoring case
+func equalFoldRegex(s string) bson.RegEx {
+	return bson.RegEx{Pattern: "^" + regexp.QuoteMeta(s) + "$", Options: "i"}
+}
+
+// GetByDate fetches all track metas which were flown on the given date
+func (metas *TrackMetasDB) GetByDate(date time.Time) (trackMetas []TrackMeta, err error) {
+	conn := metas.session.Copy()
+	defer conn.Close()
+	tracks := conn.DB("").C(trackCollection)
+
+	err = tracks.Find(bson.M{"H_date": date}).All(&trackMetas)
+	return
+}
+
+// AddRelation links a track to another track it was flown together with
+func (metas *TrackMetasDB) AddRelation(id TrackID, relation TrackRelation) (err error) {
+	conn := metas.session.Copy()
+	defer conn.Close()
+	tracks := conn.DB("").C(trackCollection)
+
+	err = tracks.Update(
+		bson.M{"id": id},
+		bson.M{"$addToSet": bson.M{"related": relation}},
+	)
+	if err == mgo.ErrNotFound {
+		err = ErrTrackNotFound
+	}
+	return
+}
+
+// RemoveRelations removes a track from the related tracks of every track
+func (metas *TrackMetasDB) RemoveRelations(id TrackID) (err error) {
+	conn := metas.session.Copy()
+	defer conn.Close()
+	tracks := conn.DB("").C(trackCollection)
+
+	_, err = tracks.UpdateAll(
+		bson.M{"related.id": id},
+		bson.M{"$pull": bson.M{"related": bson.M{"id": id}}},
+	)
+	return
+}
+
+// GetContent fetches the raw igc content of a specific id if it exists
+func (metas *TrackMetasDB) GetContent(id TrackID) (content string, err error) {
+	conn := metas.session.Copy()
+	defer conn.Close()
+	contents := conn.DB("").C(trackContentCollection)
+
+	var c trackContent
+	err = contents.Find(bson.M{"id": id}).One(&c)
+	if err == mgo.ErrNotFound {
+		err = ErrTrackNotFound
+	} else if err == nil {
+		content = c.Content
+	}
+	return
+}
+
+// AppendContent stores the raw igc content of a track, keeping any content
+// previously stored for the same id
+func (metas *TrackMetasDB) AppendContent(id TrackID, content string) (err error) {
+	conn := metas.session.Copy()
+	defer conn.Close()
+	contents := conn.DB("").C(trackContentCollection)
+
+	_, err = contents.Upsert(bson.M{"id": id}, bson.M{"$setOnInsert": trackContent{id, content}})
+	return
+}
+
+// Update replaces the metadata and the content of an existing track
+func (metas *TrackMetasDB) Update(meta TrackMeta, content string) (err error) {
+	conn := metas.session.Copy()
+	defer conn.Close()
+	tracks := conn.DB("").C(trackCollection)
+
+	err = tracks.Update(bson.M{"id": meta.ID}, meta)
+	if err == mgo.ErrNotFound {
+		err = ErrTrackNotFound
+		return
+	} else if err != nil {
+		return
+	}
+	_, err = conn.DB("").C(trackContentCollection).Upsert(bson.M{"id": meta.ID}, trackContent{meta.ID, content})
+	return
+}
+
+// Delete removes the metadata and the content of a track, and removes it from
+// the related tracks of the tracks it was flown together with
+func (metas *TrackMetasDB) Delete(id TrackID) (meta TrackMeta, err error) {
+	conn := metas.session.Copy()
+	defer conn.Close()
+	tracks := conn.DB("").C(trackCollection)
+
+	err = tracks.Find(bson.M{"id": id}).One(&meta)
+	if err == mgo.ErrNotFound {
+		err = ErrTrackNotFound
+		return
+	} else if err != nil {
+		return
+	}
+	if err = tracks.Remove(bson.M{"id": id}); err != nil {
+		return
+	}
+	err = conn.DB("").C(trackContentCollection).Remove(bson.M{"id": id})
+	if err != nil && err != mgo.ErrNotFound {
+		return
+	}
+	_, err = tracks.UpdateAll(
+		bson.M{"related.id": id},
+		bson.M{"$pull": bson.M{"related": bson.M{"id": id}}},
+	)
+	return
+}
@@ -1,9 +1,14 @@
 package igcserver
 
 import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/marni/goigc"
+	"io/ioutil"
 	"math/rand"
+	"net/url"
 	"sync"
 	"testing"
+	"time"
 )
 
 // Test that all returned ids from 'Append' are found when using 'Get'
@@ -25,6 +30,62 @@ func TestTrackMetaDuplicate(t *testing.T) {
 	}
 }
 
+// Test that registering a duplicate track keeps the content of the track
+// which was registered first
+func TestRegisterTrackDuplicate(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	ticker := NewTickerDummy(2)
+	webhooks := NewWebhooksMap()
+	server := NewServer(nil, &trackMetasMap, &ticker, &webhooks, nil, nil)
+
+	content, err := ioutil.ReadFile("../assets/test.igc")
+	if err != nil {
+		t.Fatalf("unable to read 'test.igc': %s", err)
+	}
+	track, err := igc.Parse(string(content))
+	if err != nil {
+		t.Fatalf("unable to parse 'test.igc': %s", err)
+	}
+
+	trackURL := url.URL{Scheme: "http", Host: "example.com", Path: "/test.igc"}
+	meta, err := server.registerTrack(trackURL, string(content), track, "")
+	if err != nil {
+		t.Fatalf("unable to register track: %s", err)
+	}
+	if _, err := server.registerTrack(trackURL, "changed", track, ""); err != ErrTrackAlreadyExists {
+		t.Fatalf("expected duplicate track to be rejected, got '%v'", err)
+	}
+	if stored, _ := trackMetasMap.GetContent(meta.ID); stored != string(content) {
+		t.Errorf("expected content of duplicate track not to replace the stored content")
+	}
+}
+
+// Test that only the longest tracks are on the leaderboard, where tracks of
+// the same length share a place
+func TestLeaderboardRank(t *testing.T) {
+	trackMetasMap := NewTrackMetasMap()
+	server := NewServer(nil, &trackMetasMap, nil, nil, nil, nil)
+	for i := 1; i <= leaderboardSize+2; i++ {
+		trackMetasMap.Append(TrackMeta{ID: TrackID(i), TrackLength: float64(10 * i)})
+	}
+	trackMetasMap.Append(TrackMeta{ID: 100, TrackLength: 10 * leaderboardSize})
+
+	for _, data := range []struct {
+		length float64
+		expt   int
+	}{
+		{10 * (leaderboardSize + 2), 1},
+		{10 * leaderboardSize, 4},
+		{40, leaderboardSize},
+		{30, 0},
+		{0, 0},
+	} {
+		if got := server.leaderboardRank(TrackMeta{TrackLength: data.length}); got != data.expt {
+			t.Errorf("expected track of %.0f km to have rank %d, got %d", data.length, data.expt, got)
+		}
+	}
+}
+
 // Test that all returned ids from 'Append' are found when using 'Get'
 func TestTrackMetasGet(t *testing.T) {
 	const metaCount = 10
@@ -132,16 +193,108 @@ func TestTrackMetasGetAllIDs(t *testing.T) {
 	}
 }
 
+// Test that filters are parsed from query parameters and rejected if invalid
+func TestTrackFilterFrom(t *testing.T) {
+	filter, err := TrackFilterFrom(url.Values{
+		"pilot":      {"John Normal"},
+		"glider":     {"Boeng 777"},
+		"site":       {"60.5, 10.25,3"},
+		"min_length": {"12.5"},
+		"max_length": {"50"},
+		"date_from":  {"2018-06-01"},
+		"date_to":    {"2018-06-30"},
+	})
+	expt := TrackFilter{
+		"",
+		"John Normal",
+		"Boeng 777",
+		&SiteFilter{60.5, 10.25, 3},
+		12.5,
+		50,
+		time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2018, 6, 30, 0, 0, 0, 0, time.UTC),
+	}
+	if err != nil || !cmp.Equal(filter, expt) {
+		t.Errorf("expected filter %v, got %v and '%v'", expt, filter, err)
+	}
+
+	for _, query := range []url.Values{
+		{"signature_status": {"forged"}},
+		{"site": {"60,10"}},
+		{"site": {"60,10,a"}},
+		{"site": {"91,10,3"}},
+		{"site": {"60,10,0"}},
+		{"min_length": {"long"}},
+		{"min_length": {"-1"}},
+		{"max_length": {"-1"}},
+		{"min_length": {"20"}, "max_length": {"10"}},
+		{"date_from": {"01.06.2018"}},
+		{"date_from": {"2018-06-02"}, "date_to": {"2018-06-01"}},
+	} {
+		if _, err := TrackFilterFrom(query); err == nil {
+			t.Errorf("expected '%s' to be an invalid filter", query.Encode())
+		}
+	}
+}
+
+// Test that tracks are matched on pilot, glider, site, length and date
+func TestTrackFilterMatches(t *testing.T) {
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	meta := TrackMeta{
+		Date:        date,
+		Pilot:       "John Normal",
+		Glider:      "Boeng 777",
+		TrackLength: 20,
+		Takeoff:     NewGeoPoint(60.0, 10.0),
+	}
+	for _, data := range []struct {
+		filter TrackFilter
+		expt   bool
+	}{
+		{TrackFilter{}, true},
+		{TrackFilter{Pilot: "john normal"}, true},
+		{TrackFilter{Pilot: "John"}, false},
+		{TrackFilter{Glider: "BOENG 777"}, true},
+		{TrackFilter{Glider: "Magical Carpet"}, false},
+		// 0.01 degrees of latitude is about 1.1 km
+		{TrackFilter{Site: &SiteFilter{60.01, 10.0, 1.2}}, true},
+		{TrackFilter{Site: &SiteFilter{60.01, 10.0, 1.0}}, false},
+		{TrackFilter{MinLength: 20}, true},
+		{TrackFilter{MinLength: 20.1}, false},
+		{TrackFilter{Pilot: "John Normal", MinLength: 30}, false},
+		{TrackFilter{MaxLength: 20}, true},
+		{TrackFilter{MaxLength: 19.9}, false},
+		{TrackFilter{DateFrom: date, DateTo: date}, true},
+		{TrackFilter{DateFrom: date.AddDate(0, 0, 1)}, false},
+		{TrackFilter{DateTo: date.AddDate(0, 0, -1)}, false},
+	} {
+		if got := data.filter.Matches(meta); got != data.expt {
+			t.Errorf("expected filter %v to give %t, got %t", data.filter, data.expt, got)
+		}
+	}
+
+	meta.Takeoff = nil
+	filter := TrackFilter{Site: &SiteFilter{60.0, 10.0, 100}}
+	if filter.Matches(meta) {
+		t.Errorf("expected track without takeoff to not match a site")
+	}
+}
+
 // TrackMetasMap contains a map to many TrackMeta objects which are protected
 // by a RWMutex and indexed by a unique id
 type TrackMetasMap struct {
 	sync.RWMutex
-	data map[TrackID]TrackMeta
+	data     map[TrackID]TrackMeta
+	contents map[TrackID]string
 }
 
 // NewTrackMetasMap creates a new mutex and mapping from ID to TrackMeta
 func NewTrackMetasMap() TrackMetasMap {
-	return TrackMetasMap{sync.RWMutex{}, make(map[TrackID]TrackMeta)}
+	return TrackMetasMap{
+		sync.RWMutex{},
+		make(map[TrackID]TrackMeta),
+		make(map[TrackID]string),
+	}
 }
 
 // Get fetches the track meta of a specific id if it exists
@@ -177,3 +330,142 @@ func (metas *TrackMetasMap) GetAllIDs() (ids []TrackID, err error) {
 	}
 	return
 }
+
+// GetFilteredIDs fetches the ids of all tracks matching the filter
+func (metas *TrackMetasMap) GetFilteredIDs(filter TrackFilter) (ids []TrackID, err error) {
+	metas.RLock()
+	defer metas.RUnlock()
+	ids = make([]TrackID, 0, len(metas.data))
+	for id, meta := range metas.data {
+		if filter.Matches(meta) {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// GetByDate fetches all track metas which were flown on the given date
+func (metas *TrackMetasMap) GetByDate(date time.Time) (trackMetas []TrackMeta, err error) {
+	metas.RLock()
+	defer metas.RUnlock()
+	for _, meta := range metas.data {
+		if meta.Date.Equal(date) {
+			trackMetas = append(trackMetas, meta)
+		}
+	}
+	return
+}
+
+// AddRelation links a track to another track it was flown together with
+func (metas *TrackMetasMap) AddRelation(id TrackID, relation TrackRelation) (err error) {
+	metas.Lock()
+	defer metas.Unlock()
+	meta, ok := metas.data[id]
+	if !ok {
+		return ErrTrackNotFound
+	}
+	meta.Related = append(meta.Related, relation)
+	metas.data[id] = meta
+	return
+}
+
+// RemoveRelations removes a track from the related tracks of every track
+func (metas *TrackMetasMap) RemoveRelations(id TrackID) (err error) {
+	metas.Lock()
+	defer metas.Unlock()
+	metas.removeRelations(id)
+	return
+}
+
+// removeRelations removes a track from the related tracks of every track,
+// while the map is locked
+func (metas *TrackMetasMap) removeRelations(id TrackID) {
+	for otherID, meta := range metas.data {
+		related := meta.Related[:0:0]
+		for _, relation := range meta.Related {
+			if relation.ID != id {
+				related = append(related, relation)
+			}
+		}
+		meta.Related = related
+		metas.data[otherID] = meta
+	}
+}
+
+// GetContent fetches the raw content of a specific id if it exists
+func (metas *TrackMetasMap) GetContent(id TrackID) (content string, err error) {
+	metas.RLock()
+	defer metas.RUnlock()
+	content, ok := metas.contents[id]
+	if !ok {
+		err = ErrTrackNotFound
+	}
+	return
+}
+
+// AppendContent stores the raw content of a track unless it is already stored
+func (metas *TrackMetasMap) AppendContent(id TrackID, content string) (err error) {
+	metas.Lock()
+	defer metas.Unlock()
+	if _, ok := metas.contents[id]; !ok {
+		metas.contents[id] = content
+	}
+	return
+}
+
+// Update replaces the metadata and the content of an existing track
+func (metas *TrackMetasMap) Update(meta TrackMeta, content string) (err error) {
+	metas.Lock()
+	defer metas.Unlock()
+	if _, ok := metas.data[meta.ID]; !ok {
+		return ErrTrackNotFound
+	}
+	metas.data[meta.ID] = meta
+	metas.contents[meta.ID] = content
+	return
+}
+
+// Delete removes the metadata and the content of a track
+func (metas *TrackMetasMap) Delete(id TrackID) (meta TrackMeta, err error) {
+	metas.Lock()
+	defer metas.Unlock()
+	meta, ok := metas.data[id]
+	if !ok {
+		err = ErrTrackNotFound
+		return
+	}
+	delete(metas.data, id)
+	delete(metas.contents, id)
+	metas.removeRelations(id)
+	return
+}
+
+// Test that deleting a track removes it from the related tracks of the
+// tracks it was flown together with
+func TestTrackMetasDBDeleteRelations(t *testing.T) {
+	session := makeTestSession(t)
+	defer session.Close()
+	defer session.DB("").DropDatabase()
+
+	tracks := NewTrackMetasDB(session.Copy())
+	for _, meta := range []TrackMeta{
+		{ID: 1, Related: []TrackRelation{{2, 1}, {3, 1}}},
+		{ID: 2, Related: []TrackRelation{{1, 1}}},
+		{ID: 3, Related: []TrackRelation{{1, 1}}},
+	} {
+		if err := tracks.Append(meta); err != nil {
+			t.Fatalf("unable to add track: %s", err)
+		}
+	}
+
+	if _, err := tracks.Delete(2); err != nil {
+		t.Fatalf("unable to delete track: %s", err)
+	}
+	meta, err := tracks.Get(1)
+	if err != nil {
+		t.Fatalf("unable to get track: %s", err)
+	}
+	if !cmp.Equal(meta.Related, []TrackRelation{{3, 1}}) {
+		t.Errorf("expected deleted track to be removed from related tracks, got %v", meta.Related)
+	}
+}
@@ -1,9 +1,14 @@
 package igcserver
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/barskern/paragliding/isodur"
+	"github.com/globalsign/mgo/bson"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"hash/fnv"
@@ -18,25 +23,170 @@ var (
 	// ErrWebhookNotFound is returned if a request did not result in a webhook
 	ErrWebhookNotFound = errors.New("webhook not found")
 
-	// ErrWebhookAlreadyExists is returned to request to add a webhook which
-	// already exists
+	// ErrWebhookAlreadyExists is returned to request to add a webhook, or to
+	// change the url of a webhook, to the url of another webhook
 	ErrWebhookAlreadyExists = errors.New("webhook already exists")
+
+	// ErrInvalidEventType is returned if a webhook registers for an event
+	// type which does not exist
+	ErrInvalidEventType = errors.New("invalid event type")
 )
 
+// WebhookEventNewTrack is the event type of webhooks which are notified of
+// new tracks in batches of at least `minTriggerValue` tracks, or sooner if
+// the oldest track has waited for `maxDelay`
+const WebhookEventNewTrack = "new_track"
+
+// webhookEventTypes are the events, other than new tracks, which webhooks
+// can register for. Each event is sent to the webhook as it happens.
+var webhookEventTypes = map[string]bool{
+	EventTrackDeleted:         true,
+	EventTrackRefreshed:       true,
+	EventTrackIngestionFailed: true,
+	EventPersonalBest:         true,
+	EventLeaderboardChange:    true,
+	EventAirspaceInfringement: true,
+}
+
 // Webhooks is a interface for all storages containing WebhookInfo
 type Webhooks interface {
 	Trigger()
+	QueueDepth() int
+	Dispatch(event Event)
 	Get(id WebhookID) (WebhookInfo, error)
 	Append(webhook WebhookInfo) error
 	Delete(id WebhookID) (WebhookInfo, error)
+	List(owner string) ([]WebhookInfo, error)
+	Update(webhook WebhookInfo) error
+	SetPaused(id WebhookID, paused bool) (WebhookInfo, error)
+	Activate(id WebhookID) (WebhookInfo, error)
+	Deliveries(id WebhookID, state string) ([]Delivery, error)
+	Redeliver(id WebhookID, deliveryID bson.ObjectId) (Delivery, error)
 }
 
 // WebhookInfo contains information about a webhook
 type WebhookInfo struct {
-	ID            WebhookID `json:"-" bson:"id"`
-	URLstr        string    `json:"webhookURL" bson:"webhookURL"`
-	TriggerRate   uint      `json:"minTriggerValue" bson:"minTriggerValue"`
-	LastTriggered time.Time `json:"-" bson:"lastTriggered"`
+	ID            WebhookID    `json:"-" bson:"id"`
+	URLstr        string       `json:"webhookURL" bson:"webhookURL"`
+	TriggerRate   uint         `json:"minTriggerValue" bson:"minTriggerValue"`
+	LastTriggered time.Time    `json:"-" bson:"lastTriggered"`
+	Secret        string       `json:"-" bson:"secret"`
+	Format        string       `json:"format,omitempty" bson:"format"`
+	Template      string       `json:"template,omitempty" bson:"template"`
+	EmbedTracks   bool         `json:"embedTracks,omitempty" bson:"embedTracks"`
+	Events        []string     `json:"events,omitempty" bson:"events"`
+	Filter        *TrackFilter `json:"filter,omitempty" bson:"filter,omitempty"`
+	MaxDelay      string       `json:"maxDelay,omitempty" bson:"maxDelay"`
+	Owner         string       `json:"-" bson:"owner"`
+	Paused        bool         `json:"paused" bson:"paused"`
+	Pending       bool         `json:"pending,omitempty" bson:"pending"`
+	VerifyBefore  time.Time    `json:"-" bson:"verifyBefore,omitempty"`
+}
+
+// Subscribes checks if the webhook is registered for the event type, where
+// webhooks without any event types only get new tracks
+func (webhook *WebhookInfo) Subscribes(eventType string) bool {
+	if len(webhook.Events) == 0 {
+		return eventType == WebhookEventNewTrack
+	}
+	for _, t := range webhook.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Due checks if the webhook should be notified of the pending tracks, sorted
+// by timestamp, which is the case when there are at least `minTriggerValue`
+// of them or the oldest has waited for the `maxDelay` of the webhook
+func (webhook *WebhookInfo) Due(pending []TrackMeta, now time.Time) bool {
+	if len(pending) == 0 {
+		return false
+	} else if len(pending) >= int(webhook.TriggerRate) {
+		return true
+	}
+	if webhook.MaxDelay == "" {
+		return false
+	}
+	maxDelay, err := isodur.ParseISO8601(webhook.MaxDelay)
+	return err == nil && !pending[0].Timestamp.Add(maxDelay).After(now)
+}
+
+// validateWebhook checks that a webhook can be notified, returning an error
+// describing the first invalid field
+func validateWebhook(webhook WebhookInfo) error {
+	if _, err := url.Parse(webhook.URLstr); err != nil {
+		return errors.New("invalid url")
+	}
+	if webhook.TriggerRate < 1 {
+		return errors.New("invalid trigger value")
+	}
+	if err := validateWebhookEvents(webhook); err != nil {
+		return err
+	}
+	if webhook.Filter != nil {
+		if err := webhook.Filter.Validate(); err != nil {
+			return fmt.Errorf("invalid filter: %s", err)
+		}
+	}
+	if webhook.MaxDelay != "" {
+		if d, err := isodur.ParseISO8601(webhook.MaxDelay); err != nil || d <= 0 {
+			return errors.New("invalid max delay")
+		}
+	}
+	return validateWebhookFormat(webhook)
+}
+
+// validateWebhookEvents checks that all event types of the webhook exist
+func validateWebhookEvents(webhook WebhookInfo) error {
+	for _, t := range webhook.Events {
+		if t != WebhookEventNewTrack && !webhookEventTypes[t] {
+			return fmt.Errorf("%s: '%s'", ErrInvalidEventType, t)
+		}
+	}
+	return nil
+}
+
+// String formats the webhook without its secret, so that it is never written
+// to the logs
+func (webhook WebhookInfo) String() string {
+	return fmt.Sprintf("{%d %s %d %s}", webhook.ID, webhook.URLstr, webhook.TriggerRate, webhook.LastTriggered)
+}
+
+// webhookRegistration is the body of a request to register a webhook, which
+// may contain the secret used to sign deliveries
+type webhookRegistration struct {
+	WebhookInfo
+	Secret string `json:"secret"`
+}
+
+// webhookPatch is the body of a request to update a webhook, where only the
+// fields which are present are changed. An empty filter removes the filter.
+type webhookPatch struct {
+	URLstr      *string      `json:"webhookURL"`
+	TriggerRate *uint        `json:"minTriggerValue"`
+	Filter      *TrackFilter `json:"filter"`
+	MaxDelay    *string      `json:"maxDelay"`
+}
+
+// apply changes the fields of the webhook which are present in the patch
+func (patch *webhookPatch) apply(webhook *WebhookInfo) {
+	if patch.URLstr != nil {
+		webhook.URLstr = *patch.URLstr
+	}
+	if patch.TriggerRate != nil {
+		webhook.TriggerRate = *patch.TriggerRate
+	}
+	if patch.Filter != nil {
+		webhook.Filter = patch.Filter
+		if *patch.Filter == (TrackFilter{}) {
+			webhook.Filter = nil
+		}
+	}
+	if patch.MaxDelay != nil {
+		webhook.MaxDelay = *patch.MaxDelay
+	}
 }
 
 // WebhookID is a unique id for a track
@@ -49,6 +199,16 @@ func NewWebhookID(v []byte) WebhookID {
 	return WebhookID(hasher.Sum32())
 }
 
+// newRandomWebhookID creates a random id for a new webhook, so that the id
+// does not depend on the url which can be changed later
+func newRandomWebhookID() (WebhookID, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return 0, err
+	}
+	return WebhookID(binary.BigEndian.Uint32(b)), nil
+}
+
 // ----------- //
 // WEBHOOK API //
 // ----------- //
@@ -61,24 +221,58 @@ func (server *Server) webhookRegHandler(w http.ResponseWriter, r *http.Request)
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 
-	webhook := WebhookInfo{TriggerRate: 1}
-	if err := dec.Decode(&webhook); err != nil {
+	reg := webhookRegistration{WebhookInfo: WebhookInfo{TriggerRate: 1}}
+	if err := dec.Decode(&reg); err != nil {
 		logger.WithField("error", err).Info("unable to decode request body")
 		http.Error(w, "invalid json object", http.StatusBadRequest)
 		return
 	}
-	reqURL, err := url.Parse(webhook.URLstr)
-	if err != nil {
-		logger.WithField("error", err).Info("unable to parse url")
-		http.Error(w, "invalid url", http.StatusBadRequest)
+	webhook := reg.WebhookInfo
+	webhook.Secret = reg.Secret
+	generated := false
+	if webhook.Secret == "" {
+		secret, err := NewWebhookSecret()
+		if err != nil {
+			logger.WithField("error", err).Error("unable to generate webhook secret")
+			http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+			return
+		}
+		webhook.Secret = secret
+		generated = true
+	}
+	// The caller may reuse its token for several webhooks, so that they are
+	// listed together, otherwise a new token is generated
+	token := bearerToken(r)
+	generatedToken := false
+	if token == "" {
+		var err error
+		if token, err = newToken(); err != nil {
+			logger.WithField("error", err).Error("unable to generate webhook token")
+			http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+			return
+		}
+		generatedToken = true
+	}
+	webhook.Owner = hashToken(token)
+	if err := validateWebhook(webhook); err != nil {
+		logger.WithField("error", err).Info("invalid webhook")
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if webhook.TriggerRate < 1 {
-		logger.WithField("error", err).Info("invalid trigger value")
-		http.Error(w, "invalid trigger value", http.StatusBadRequest)
+	id, err := newRandomWebhookID()
+	if err != nil {
+		logger.WithField("error", err).Error("unable to generate webhook id")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
 		return
 	}
-	webhook.ID = NewWebhookID([]byte(reqURL.String()))
+	webhook.ID = id
+	// A webhook which has to be verified is not notified until it has echoed
+	// a challenge, and is removed if that does not happen in time
+	verification := server.config.WebhookVerification
+	if verification.Enabled {
+		webhook.Pending = true
+		webhook.VerifyBefore = time.Now().Add(verification.Timeout)
+	}
 	err = server.webhooks.Append(webhook)
 	if err == ErrWebhookAlreadyExists {
 		logger.WithFields(log.Fields{
@@ -94,18 +288,46 @@ func (server *Server) webhookRegHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
 		return
 	}
+	if webhook.Pending {
+		if err := challengeWebhook(server.httpClient, webhook); err != nil {
+			logger.WithFields(log.Fields{
+				"webhook": webhook,
+				"error":   err,
+			}).Info("unable to verify webhook, leaving it pending")
+		} else if activated, err := server.webhooks.Activate(webhook.ID); err != nil {
+			logger.WithFields(log.Fields{
+				"webhook": webhook,
+				"error":   err,
+			}).Info("unable to activate verified webhook")
+		} else {
+			webhook = activated
+		}
+	}
+	server.events.Publish(NewWebhookEvent(EventWebhookRegistered, webhook.ID))
+
 	logger.WithFields(log.Fields{
 		"webhook": webhook,
 	}).Info("added webhook")
 
+	// A generated secret or token is only ever returned in the response to
+	// the registration
+	if generated {
+		w.Header().Set(WebhookSecretHeader, webhook.Secret)
+	}
+	if generatedToken {
+		w.Header().Set(TokenHeader, token)
+	}
+	if webhook.Pending {
+		w.WriteHeader(http.StatusAccepted)
+	}
 	io.WriteString(w, fmt.Sprintf("%d", webhook.ID))
 }
 
-func (server *Server) webhookGetHandler(w http.ResponseWriter, r *http.Request) {
-	logger := newReqLogger(r)
-
-	logger.Info("processing request to get webhook")
-
+// webhookOfRequest gets the webhook of the id in the request if the request
+// has the management token of the webhook. Otherwise an error is written to
+// the response and ok is false. A wrong token gives the same response as an
+// unknown id, so that ids can not be probed.
+func (server *Server) webhookOfRequest(w http.ResponseWriter, r *http.Request, logger *log.Entry) (webhook WebhookInfo, ok bool) {
 	vars := mux.Vars(r)
 	idStr, _ := vars["webhookID"]
 	id, err := strconv.Atoi(idStr)
@@ -115,7 +337,13 @@ func (server *Server) webhookGetHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	idlog := logger.WithField("id", id)
-	webhook, err := server.webhooks.Get(WebhookID(id))
+	token := bearerToken(r)
+	if token == "" {
+		idlog.Info("request to manage webhook without a token")
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	webhook, err = server.webhooks.Get(WebhookID(id))
 	if err == ErrWebhookNotFound {
 		idlog.Info("unable to find webhook")
 		http.Error(w, "content not found", http.StatusNotFound)
@@ -125,6 +353,23 @@ func (server *Server) webhookGetHandler(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
 		return
 	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(webhook.Owner)) != 1 {
+		idlog.Info("request to manage webhook with wrong token")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	}
+	return webhook, true
+}
+
+func (server *Server) webhookGetHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to get webhook")
+
+	webhook, ok := server.webhookOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
 	logger.WithFields(log.Fields{
 		"webhook": webhook,
 	}).Info("responding with info about webhook")
@@ -138,16 +383,12 @@ func (server *Server) webhookDeleteHandler(w http.ResponseWriter, r *http.Reques
 
 	logger.Info("processing request to delete webhook")
 
-	vars := mux.Vars(r)
-	idStr, _ := vars["webhookID"]
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		logger.WithField("id", idStr).Info("id must be a valid number")
-		http.Error(w, "invalid id", http.StatusBadRequest)
+	webhook, ok := server.webhookOfRequest(w, r, logger)
+	if !ok {
 		return
 	}
-	idlog := logger.WithField("id", id)
-	webhook, err := server.webhooks.Delete(WebhookID(id))
+	idlog := logger.WithField("id", webhook.ID)
+	webhook, err := server.webhooks.Delete(webhook.ID)
 	if err == ErrWebhookNotFound {
 		idlog.Info("unable to find metadata of id")
 		http.Error(w, "content not found", http.StatusNotFound)
@@ -164,3 +405,161 @@ func (server *Server) webhookDeleteHandler(w http.ResponseWriter, r *http.Reques
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(webhook)
 }
+
+func (server *Server) webhookListHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to list webhooks")
+
+	token := bearerToken(r)
+	if token == "" {
+		logger.Info("request to list webhooks without a token")
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	webhooks, err := server.webhooks.List(hashToken(token))
+	if err != nil {
+		logger.WithField("error", err).Info("error when listing webhooks")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	ids := make([]WebhookID, len(webhooks))
+	for i, webhook := range webhooks {
+		ids[i] = webhook.ID
+	}
+	logger.WithField("ids", ids).Info("responding with ids of webhooks of caller")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ids)
+}
+
+func (server *Server) webhookPatchHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to update webhook")
+
+	webhook, ok := server.webhookOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
+	idlog := logger.WithField("id", webhook.ID)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	var patch webhookPatch
+	if err := dec.Decode(&patch); err != nil {
+		idlog.WithField("error", err).Info("unable to decode request body")
+		http.Error(w, "invalid json object", http.StatusBadRequest)
+		return
+	}
+	urlStr := webhook.URLstr
+	patch.apply(&webhook)
+	if err := validateWebhook(webhook); err != nil {
+		idlog.WithField("error", err).Info("invalid update of webhook")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// A new url has to be verified before it is used, so that verification
+	// can not be bypassed by changing the url afterwards
+	if webhook.URLstr != urlStr && server.config.WebhookVerification.Enabled {
+		if err := challengeWebhook(server.httpClient, webhook); err != nil {
+			idlog.WithField("error", err).Info("unable to verify new url of webhook")
+			http.Error(w, ErrChallengeFailed.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	err := server.webhooks.Update(webhook)
+	if err == ErrWebhookNotFound {
+		idlog.Info("webhook was deleted before it was updated")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err == ErrWebhookAlreadyExists {
+		idlog.WithField("url", webhook.URLstr).Info("request attempted to change url to the url of another webhook")
+		http.Error(w, "webhook already exists", http.StatusForbidden)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Info("error when updating webhook of id")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	idlog.WithFields(log.Fields{
+		"webhook": webhook,
+	}).Info("responding with updated webhook")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func (server *Server) webhookVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to verify webhook")
+
+	webhook, ok := server.webhookOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
+	idlog := logger.WithField("id", webhook.ID)
+	if webhook.Pending {
+		if err := challengeWebhook(server.httpClient, webhook); err != nil {
+			idlog.WithField("error", err).Info("unable to verify webhook")
+			http.Error(w, ErrChallengeFailed.Error(), http.StatusBadGateway)
+			return
+		}
+		var err error
+		webhook, err = server.webhooks.Activate(webhook.ID)
+		if err == ErrWebhookNotFound {
+			idlog.Info("webhook expired before it was verified")
+			http.Error(w, "content not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			idlog.WithField("error", err).Info("error when activating webhook")
+			http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+			return
+		}
+	}
+	idlog.WithFields(log.Fields{
+		"webhook": webhook,
+	}).Info("responding with verified webhook")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+}
+
+func (server *Server) webhookPauseHandler(w http.ResponseWriter, r *http.Request) {
+	server.setWebhookPaused(w, r, true)
+}
+
+func (server *Server) webhookResumeHandler(w http.ResponseWriter, r *http.Request) {
+	server.setWebhookPaused(w, r, false)
+}
+
+// setWebhookPaused pauses or resumes the webhook of the request
+func (server *Server) setWebhookPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	logger := newReqLogger(r).WithField("paused", paused)
+
+	logger.Info("processing request to pause or resume webhook")
+
+	webhook, ok := server.webhookOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
+	idlog := logger.WithField("id", webhook.ID)
+	webhook, err := server.webhooks.SetPaused(webhook.ID, paused)
+	if err == ErrWebhookNotFound {
+		idlog.Info("unable to find webhook")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Info("error when pausing or resuming webhook")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	idlog.WithFields(log.Fields{
+		"webhook": webhook,
+	}).Info("responding with paused or resumed webhook")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webhook)
+}
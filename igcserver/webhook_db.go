@@ -1,18 +1,51 @@
 package igcserver
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	webhookCollection = "webhooks"
+	outboxCollection  = "outbox"
+
+	// webhookClaimTimeout is how long a claimed delivery is left alone before
+	// it is attempted again, in case the instance attempting it crashed
+	webhookClaimTimeout = time.Minute
+
+	// webhookDeliveryRetention is how long delivered updates are kept
+	webhookDeliveryRetention = 7 * 24 * time.Hour
+
+	// webhookWorkers is the number of webhooks which are updated or
+	// delivered to at the same time
+	webhookWorkers = 8
+
+	// webhookQueueSize is the number of jobs which can wait for a worker
+	webhookQueueSize = 64
+
+	// webhookHostConcurrency is the number of deliveries which are sent to
+	// the same host at the same time
+	webhookHostConcurrency = 2
+)
+
+var (
+	// webhookOutboxPollInterval is how often the outbox is checked for
+	// retries which are due
+	webhookOutboxPollInterval = time.Second
+
+	// webhookSchedulerInterval is how often webhooks with a max delay are
+	// checked, so that tracks are announced even if no more are added
+	webhookSchedulerInterval = time.Minute
+
+	// webhookDispatchTimeout is how long an event waits for room in the
+	// worker queue before it is dropped
+	webhookDispatchTimeout = 100 * time.Millisecond
 )
 
 // WebhooksDB contains a map to many WebhookInfo objects which are protected
@@ -21,6 +54,50 @@ type WebhooksDB struct {
 	session    *mgo.Session
 	httpClient *http.Client
 	trigger    chan bool
+	wake       chan bool
+	events     *EventBus
+	queue      chan webhookJob
+
+	dispatching *sync.WaitGroup
+	dropped     *uint64
+}
+
+// webhookJob is work done by one of the webhook workers, using the outbox of
+// the connection of the worker
+type webhookJob func(store outboxStore)
+
+// hostLimiter limits the number of concurrent deliveries to each host, so
+// that a slow receiver can not occupy every worker
+type hostLimiter struct {
+	sync.Mutex
+	limit    int
+	inFlight map[string]int
+}
+
+// newHostLimiter creates a limiter allowing limit deliveries to each host
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, inFlight: make(map[string]int)}
+}
+
+// acquire reserves a delivery to the host, returning false if the host
+// already has the maximum number of deliveries
+func (hosts *hostLimiter) acquire(host string) bool {
+	hosts.Lock()
+	defer hosts.Unlock()
+	if hosts.inFlight[host] >= hosts.limit {
+		return false
+	}
+	hosts.inFlight[host]++
+	return true
+}
+
+// release frees a delivery to the host reserved by acquire
+func (hosts *hostLimiter) release(host string) {
+	hosts.Lock()
+	defer hosts.Unlock()
+	if hosts.inFlight[host]--; hosts.inFlight[host] <= 0 {
+		delete(hosts.inFlight, host)
+	}
 }
 
 // DiscordMsg is a webhook message that can be sent to discord
@@ -43,21 +120,116 @@ func NewDiscordMsg(latest time.Time, ids []TrackID, processing time.Duration) Di
 }
 
 // NewWebhooksDB creates a new mutex and mapping from ID to WebhookInfo
-func NewWebhooksDB(session *mgo.Session, httpClient *http.Client) WebhooksDB {
-	trigger := make(chan bool)
+func NewWebhooksDB(session *mgo.Session, httpClient *http.Client, events *EventBus) WebhooksDB {
+	trigger := make(chan bool, 1)
+	wake := make(chan bool, 1)
+	queue := make(chan webhookJob, webhookQueueSize)
+	hosts := newHostLimiter(webhookHostConcurrency)
 
+	conn := session.Copy()
+	outbox := conn.DB("").C(outboxCollection)
+	err := outbox.EnsureIndex(mgo.Index{
+		Key: []string{"state", "nextAttempt"},
+	})
+	if err == nil {
+		// Only one webhook can be registered for each url
+		err = conn.DB("").C(webhookCollection).EnsureIndex(mgo.Index{
+			Key:    []string{"webhookURL"},
+			Unique: true,
+		})
+	}
+	if err == nil {
+		// Delivered updates are only kept for a while for inspection
+		err = outbox.EnsureIndex(mgo.Index{
+			Key:           []string{"created"},
+			ExpireAfter:   webhookDeliveryRetention,
+			PartialFilter: bson.M{"state": DeliveryDelivered},
+		})
+	}
+	if err == nil {
+		// Webhooks which are not verified in time are removed
+		err = conn.DB("").C(webhookCollection).EnsureIndex(mgo.Index{
+			Key:           []string{"verifyBefore"},
+			ExpireAfter:   time.Second,
+			PartialFilter: bson.M{"pending": true},
+		})
+	}
+	conn.Close()
+	if err != nil {
+		log.WithField("error", err).Error("unable to ensure indexes of webhooks")
+	}
+
+	// Every worker keeps its own connection, so that the number of
+	// connections does not grow with the number of webhooks
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			conn := session.Copy()
+			defer conn.Close()
+			for job := range queue {
+				job(&outboxDB{conn})
+			}
+		}()
+	}
+
+	// Triggers are coalesced, so that all tracks added while webhooks are
+	// being updated are handled by the next update
+	schedule := time.NewTicker(webhookSchedulerInterval)
 	go func() {
 		conn := session.Copy()
 		defer conn.Close()
 		for {
-			<-trigger
-			iter := conn.DB("").C(webhookCollection).Find(nil).Iter()
+			// Webhooks without any event types are only notified of new
+			// tracks, and paused or unverified webhooks are not notified
+			query := bson.M{
+				"$or": []bson.M{
+					{"events": WebhookEventNewTrack},
+					{"events": nil},
+					{"events": bson.M{"$size": 0}},
+				},
+				"paused":  bson.M{"$ne": true},
+				"pending": bson.M{"$ne": true},
+			}
+			select {
+			case <-trigger:
+			case <-schedule.C:
+				// Only webhooks with a max delay can become due without new
+				// tracks being added
+				query = bson.M{"$and": []bson.M{
+					query,
+					{"maxDelay": bson.M{"$nin": []interface{}{nil, ""}}},
+				}}
+			}
+			iter := conn.DB("").C(webhookCollection).Find(query).Iter()
+			var wg sync.WaitGroup
 			var webhook WebhookInfo
 			for iter.Next(&webhook) {
 				log.WithField("webhook", webhook).Info("checking if update is needed for webhook")
-				go updateWebhook(session.Copy(), httpClient, webhook)
+				wg.Add(1)
+				queue <- func(webhook WebhookInfo) webhookJob {
+					return func(store outboxStore) {
+						defer wg.Done()
+						updateWebhook(store, webhook)
+					}
+				}(webhook)
 			}
 			iter.Close()
+			wg.Wait()
+			coalesce(wake)
+		}
+	}()
+
+	// Deliver pending deliveries when woken, and poll for retries which are
+	// due or which were added by other instances
+	poll := time.NewTicker(webhookOutboxPollInterval)
+	go func() {
+		for {
+			select {
+			case <-wake:
+			case <-poll.C:
+			}
+			conn := session.Copy()
+			deliverOutbox(&outboxDB{conn}, queue, hosts, httpClient, events)
+			conn.Close()
 		}
 	}()
 
@@ -65,53 +237,69 @@ func NewWebhooksDB(session *mgo.Session, httpClient *http.Client) WebhooksDB {
 		session,
 		httpClient,
 		trigger,
+		wake,
+		events,
+		queue,
+		&sync.WaitGroup{},
+		new(uint64),
 	}
 }
 
-func updateWebhook(conn *mgo.Session, httpClient *http.Client, webhook WebhookInfo) {
-	defer conn.Close()
-
-	start := time.Now()
-
-	var trackMetas []TrackMeta
-	err := conn.DB("").C(trackCollection).
-		Find(bson.M{"timestamp": bson.M{"$gt": webhook.LastTriggered}}).
-		Sort("timestamp").
-		All(&trackMetas)
-
-	weblog := log.WithField("webhook", webhook)
-
-	if err != nil {
-		weblog.WithField("error", err).Error("unable to get track metas after given timestamp")
+// coalesce signals a channel without blocking, where signals sent while one
+// is already waiting are merged into it
+func coalesce(wake chan bool) {
+	select {
+	case wake <- true:
+	default:
 	}
+}
 
-	if len(trackMetas) >= int(webhook.TriggerRate) {
-		laststamp := trackMetas[len(trackMetas)-1].Timestamp
-		ids := make([]TrackID, len(trackMetas))
-		for i, meta := range trackMetas {
-			ids[i] = meta.ID
-		}
-		processing := time.Since(start)
-		msg := NewDiscordMsg(laststamp, ids, processing)
+// Trigger checks if webhooks should be notified of new tracks, without
+// waiting for the check to be done
+func (db *WebhooksDB) Trigger() {
+	coalesce(db.trigger)
+}
 
-		b := new(bytes.Buffer)
-		json.NewEncoder(b).Encode(msg)
+// QueueDepth returns the number of jobs waiting for a webhook worker
+func (db *WebhooksDB) QueueDepth() int {
+	return len(db.queue)
+}
 
-		weblog.WithField("msg", msg).Info("sending update to webhook")
-		httpClient.Post(webhook.URLstr, "application/json", b)
+// DroppedEvents returns the number of events which were dropped because the
+// worker queue stayed full
+func (db *WebhooksDB) DroppedEvents() uint64 {
+	return atomic.LoadUint64(db.dropped)
+}
 
-		// Update last triggered for current webhook
-		webhook.LastTriggered = laststamp
-		err = conn.DB("").C(webhookCollection).
-			Update(bson.M{"id": webhook.ID}, webhook)
-	} else {
-		weblog.Info("update not needed for webhook")
+// Dispatch queues the event for the workers, which add a delivery of it to
+// the outbox of every webhook registered for its type, so that publishing an
+// event never waits for the webhooks to be found. If the queue stays full for
+// `webhookDispatchTimeout` the event is dropped, so that neither the
+// publisher nor the number of connections grow without bound.
+func (db *WebhooksDB) Dispatch(event Event) {
+	wake := db.wake
+	db.dispatching.Add(1)
+	job := func(store outboxStore) {
+		defer db.dispatching.Done()
+		dispatchEvent(store, event)
+		coalesce(wake)
+	}
+	select {
+	case db.queue <- job:
+	case <-time.After(webhookDispatchTimeout):
+		db.dispatching.Done()
+		dropped := atomic.AddUint64(db.dropped, 1)
+		log.WithFields(log.Fields{
+			"event":   event.Type,
+			"dropped": dropped,
+		}).Error("webhook queue is full, dropping event")
 	}
 }
 
-// Trigger returns a channel to trigger webhooks based on the number of tracks
-func (db *WebhooksDB) Trigger() {
-	db.trigger <- true
+// waitForDispatch waits until all queued events have been added to the
+// outboxes of the webhooks
+func (db *WebhooksDB) waitForDispatch() {
+	db.dispatching.Wait()
 }
 
 // Get fetches the track webhook of a specific id if it exists
@@ -127,13 +315,17 @@ func (db *WebhooksDB) Get(id WebhookID) (webhook WebhookInfo, err error) {
 	return
 }
 
-// Append appends a track webhook and returns the given id
+// Append appends a track webhook, unless a webhook with the same id or url
+// already exists
 func (db *WebhooksDB) Append(webhook WebhookInfo) (err error) {
 	conn := db.session.Copy()
 	defer conn.Close()
 	webhooks := conn.DB("").C(webhookCollection)
 
-	n, err := webhooks.Find(bson.M{"id": webhook.ID}).Count()
+	n, err := webhooks.Find(bson.M{"$or": []bson.M{
+		{"id": webhook.ID},
+		{"webhookURL": webhook.URLstr},
+	}}).Count()
 	if err == nil {
 		if n == 0 {
 			err = webhooks.Insert(webhook)
@@ -141,6 +333,9 @@ func (db *WebhooksDB) Append(webhook WebhookInfo) (err error) {
 			err = ErrWebhookAlreadyExists
 		}
 	}
+	if mgo.IsDup(err) {
+		err = ErrWebhookAlreadyExists
+	}
 	return
 }
 
@@ -156,5 +351,342 @@ func (db *WebhooksDB) Delete(id WebhookID) (webhook WebhookInfo, err error) {
 	} else if err == nil {
 		err = webhooks.Remove(bson.M{"id": id})
 	}
+	if err == nil {
+		_, err = conn.DB("").C(outboxCollection).RemoveAll(bson.M{"webhookID": id})
+	}
+	return
+}
+
+// List returns all webhooks registered by the owner
+func (db *WebhooksDB) List(owner string) (webhooks []WebhookInfo, err error) {
+	conn := db.session.Copy()
+	defer conn.Close()
+
+	webhooks = make([]WebhookInfo, 0)
+	err = conn.DB("").C(webhookCollection).Find(bson.M{"owner": owner}).Sort("id").All(&webhooks)
+	return
+}
+
+// Update changes the url, trigger value, filter and max delay of a webhook,
+// unless another webhook already has the url
+func (db *WebhooksDB) Update(webhook WebhookInfo) (err error) {
+	conn := db.session.Copy()
+	defer conn.Close()
+
+	n, err := conn.DB("").C(webhookCollection).Find(bson.M{
+		"webhookURL": webhook.URLstr,
+		"id":         bson.M{"$ne": webhook.ID},
+	}).Count()
+	if err != nil {
+		return
+	} else if n > 0 {
+		return ErrWebhookAlreadyExists
+	}
+	set := bson.M{
+		"webhookURL":      webhook.URLstr,
+		"minTriggerValue": webhook.TriggerRate,
+		"maxDelay":        webhook.MaxDelay,
+	}
+	update := bson.M{"$set": set}
+	if webhook.Filter != nil {
+		set["filter"] = webhook.Filter
+	} else {
+		update["$unset"] = bson.M{"filter": ""}
+	}
+	err = conn.DB("").C(webhookCollection).Update(bson.M{"id": webhook.ID}, update)
+	if err == mgo.ErrNotFound {
+		err = ErrWebhookNotFound
+	} else if mgo.IsDup(err) {
+		err = ErrWebhookAlreadyExists
+	}
+	return
+}
+
+// SetPaused pauses or resumes a webhook. Pending deliveries of a resumed
+// webhook are attempted right away, and tracks added while it was paused are
+// included in its next update.
+func (db *WebhooksDB) SetPaused(id WebhookID, paused bool) (webhook WebhookInfo, err error) {
+	conn := db.session.Copy()
+	defer conn.Close()
+
+	webhook, err = setWebhookPaused(&outboxDB{conn}, id, paused)
+	if err == nil && !paused {
+		coalesce(db.wake)
+		db.Trigger()
+	}
+	return
+}
+
+// Activate marks a pending webhook as verified, so that it is notified. An
+// unverified webhook which has expired is not found.
+func (db *WebhooksDB) Activate(id WebhookID) (webhook WebhookInfo, err error) {
+	conn := db.session.Copy()
+	defer conn.Close()
+
+	_, err = conn.DB("").C(webhookCollection).
+		Find(bson.M{"id": id, "$or": []bson.M{
+			{"pending": bson.M{"$ne": true}},
+			{"verifyBefore": bson.M{"$gt": time.Now()}},
+		}}).
+		Apply(mgo.Change{
+			Update: bson.M{
+				"$set":   bson.M{"pending": false},
+				"$unset": bson.M{"verifyBefore": ""},
+			},
+			ReturnNew: true,
+		}, &webhook)
+	if err == mgo.ErrNotFound {
+		err = ErrWebhookNotFound
+	}
+	return
+}
+
+// Deliveries returns the deliveries to a webhook with their attempts, newest
+// first, where an empty state gives the deliveries of all states
+func (db *WebhooksDB) Deliveries(id WebhookID, state string) (deliveries []Delivery, err error) {
+	conn := db.session.Copy()
+	defer conn.Close()
+
+	n, err := conn.DB("").C(webhookCollection).Find(bson.M{"id": id}).Count()
+	if err != nil {
+		return
+	} else if n == 0 {
+		err = ErrWebhookNotFound
+		return
+	}
+	query := bson.M{"webhookID": id}
+	if state != "" {
+		query["state"] = state
+	}
+	deliveries = make([]Delivery, 0)
+	err = conn.DB("").C(outboxCollection).
+		Find(query).
+		Sort("-created").
+		All(&deliveries)
+	return
+}
+
+// Redeliver sends a previous delivery to a webhook again. A dead letter is
+// moved back to the outbox so that it is attempted again, while any other
+// delivery is added to the outbox again as a new delivery with the same
+// payload.
+func (db *WebhooksDB) Redeliver(id WebhookID, deliveryID bson.ObjectId) (redelivery Delivery, err error) {
+	conn := db.session.Copy()
+	defer conn.Close()
+
+	redelivery, err = redeliver(&outboxDB{conn}, id, deliveryID)
+	if err == nil {
+		coalesce(db.wake)
+	}
+	return
+}
+
+// outboxDB is the outbox of the webhooks in mongodb, using the connection of
+// a single worker or request
+type outboxDB struct {
+	conn *mgo.Session
+}
+
+func (store *outboxDB) webhooks() *mgo.Collection {
+	return store.conn.DB("").C(webhookCollection)
+}
+
+func (store *outboxDB) outbox() *mgo.Collection {
+	return store.conn.DB("").C(outboxCollection)
+}
+
+// logAttempt adds an attempt to the log of a delivery, dropping the oldest
+// attempts when the log is full
+func logAttempt(attempt Attempt) bson.M {
+	return bson.M{"log": bson.M{"$each": []Attempt{attempt}, "$slice": -webhookLogLimit}}
+}
+
+func (store *outboxDB) getWebhook(id WebhookID) (webhook WebhookInfo, err error) {
+	err = store.webhooks().Find(bson.M{"id": id}).One(&webhook)
+	if err == mgo.ErrNotFound {
+		err = ErrWebhookNotFound
+	}
+	return
+}
+
+func (store *outboxDB) eventWebhooks(eventType string) (webhooks []WebhookInfo, err error) {
+	err = store.webhooks().Find(bson.M{
+		"events":  eventType,
+		"paused":  bson.M{"$ne": true},
+		"pending": bson.M{"$ne": true},
+	}).All(&webhooks)
+	return
+}
+
+func (store *outboxDB) tracksSince(webhook WebhookInfo) (trackMetas []TrackMeta, err error) {
+	// Only tracks matching the filter of the webhook count towards its
+	// trigger value
+	query := bson.M{"timestamp": bson.M{"$gt": webhook.LastTriggered}}
+	if webhook.Filter != nil {
+		query = bson.M{"$and": []bson.M{query, webhook.Filter.query()}}
+	}
+	err = store.conn.DB("").C(trackCollection).
+		Find(query).
+		Sort("timestamp").
+		All(&trackMetas)
+	return
+}
+
+func (store *outboxDB) advanceLastTriggered(id WebhookID, latest time.Time) (err error) {
+	err = store.webhooks().Update(
+		bson.M{"id": id},
+		bson.M{"$max": bson.M{"lastTriggered": latest}},
+	)
+	if err == mgo.ErrNotFound {
+		err = ErrWebhookNotFound
+	}
+	return
+}
+
+func (store *outboxDB) setPaused(id WebhookID, paused bool) (webhook WebhookInfo, err error) {
+	_, err = store.webhooks().
+		Find(bson.M{"id": id}).
+		Apply(mgo.Change{
+			Update:    bson.M{"$set": bson.M{"paused": paused}},
+			ReturnNew: true,
+		}, &webhook)
+	if err == mgo.ErrNotFound {
+		err = ErrWebhookNotFound
+	}
+	return
+}
+
+func (store *outboxDB) addDelivery(delivery Delivery) error {
+	return store.outbox().Insert(delivery)
+}
+
+func (store *outboxDB) putUpdate(delivery Delivery) (err error) {
+	_, err = store.outbox().Upsert(
+		bson.M{
+			"webhookID":  delivery.WebhookID,
+			"event":      bson.M{"$in": []interface{}{nil, WebhookEventNewTrack}},
+			"state":      DeliveryPending,
+			"redelivery": bson.M{"$ne": true},
+		},
+		bson.M{
+			"$set": bson.M{"payload": delivery.Payload, "latest": delivery.Latest},
+			"$setOnInsert": bson.M{
+				"_id":         delivery.ID,
+				"event":       delivery.Event,
+				"attempts":    delivery.Attempts,
+				"nextAttempt": delivery.NextAttempt,
+				"created":     delivery.Created,
+				"log":         delivery.Log,
+			},
+		},
+	)
+	return
+}
+
+func (store *outboxDB) getDelivery(webhookID WebhookID, id bson.ObjectId) (delivery Delivery, err error) {
+	err = store.outbox().Find(bson.M{"_id": id, "webhookID": webhookID}).One(&delivery)
+	if err == mgo.ErrNotFound {
+		err = ErrDeliveryNotFound
+	}
+	return
+}
+
+func (store *outboxDB) dueDeliveries(now time.Time) (due []Delivery, err error) {
+	err = store.outbox().Find(bson.M{
+		"state":       DeliveryPending,
+		"nextAttempt": bson.M{"$lte": now},
+	}).All(&due)
+	return
+}
+
+func (store *outboxDB) claimDelivery(delivery Delivery, until time.Time) (bool, error) {
+	err := store.outbox().Update(
+		bson.M{"_id": delivery.ID, "state": DeliveryPending, "nextAttempt": delivery.NextAttempt},
+		bson.M{"$set": bson.M{"nextAttempt": until}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (store *outboxDB) releaseDelivery(id bson.ObjectId, at time.Time) (err error) {
+	err = store.outbox().Update(
+		bson.M{"_id": id, "state": DeliveryPending},
+		bson.M{"$set": bson.M{"nextAttempt": at}},
+	)
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+func (store *outboxDB) releaseDeliveries(webhookID WebhookID, at time.Time) (err error) {
+	_, err = store.outbox().UpdateAll(
+		bson.M{"webhookID": webhookID, "state": DeliveryPending},
+		bson.M{"$set": bson.M{"nextAttempt": at}},
+	)
+	return
+}
+
+func (store *outboxDB) removeDelivery(id bson.ObjectId) (err error) {
+	err = store.outbox().Remove(bson.M{"_id": id})
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+func (store *outboxDB) recordFailure(delivery Delivery, attempt Attempt) error {
+	return store.outbox().Update(bson.M{"_id": delivery.ID}, bson.M{
+		"$set": bson.M{
+			"state":       delivery.State,
+			"attempts":    delivery.Attempts,
+			"nextAttempt": delivery.NextAttempt,
+			"lastError":   delivery.LastError,
+		},
+		"$push": logAttempt(attempt),
+	})
+}
+
+func (store *outboxDB) markDelivered(delivery Delivery, attempt Attempt) (bool, error) {
+	err := store.outbox().Update(bson.M{"_id": delivery.ID, "latest": delivery.Latest}, bson.M{
+		"$set":  bson.M{"state": DeliveryDelivered},
+		"$push": logAttempt(attempt),
+	})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (store *outboxDB) restartDelivery(id bson.ObjectId, attempt Attempt, at time.Time) (err error) {
+	err = store.outbox().Update(bson.M{"_id": id}, bson.M{
+		"$set": bson.M{
+			"attempts":    0,
+			"nextAttempt": at,
+		},
+		"$push": logAttempt(attempt),
+	})
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+func (store *outboxDB) reviveDelivery(webhookID WebhookID, id bson.ObjectId, at time.Time) (delivery Delivery, err error) {
+	_, err = store.outbox().
+		Find(bson.M{"_id": id, "webhookID": webhookID, "state": DeliveryDead}).
+		Apply(mgo.Change{
+			Update: bson.M{"$set": bson.M{
+				"state":       DeliveryPending,
+				"attempts":    0,
+				"nextAttempt": at,
+			}},
+			ReturnNew: true,
+		}, &delivery)
+	if err == mgo.ErrNotFound {
+		err = ErrDeliveryNotFound
+	}
 	return
 }
@@ -0,0 +1,218 @@
+package igcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+const (
+	// WebhookFormatDiscord formats updates as a discord message
+	WebhookFormatDiscord = "discord"
+
+	// WebhookFormatSlack formats updates as a slack message using blocks
+	WebhookFormatSlack = "slack"
+
+	// WebhookFormatJSON formats updates as a structured json event
+	WebhookFormatJSON = "json"
+
+	// WebhookFormatTemplate formats updates using a go template given when
+	// the webhook is registered
+	WebhookFormatTemplate = "template"
+)
+
+var (
+	// ErrInvalidFormat is returned if the format of a webhook is unknown
+	ErrInvalidFormat = errors.New("invalid format")
+
+	// ErrInvalidTemplate is returned if the template of a webhook can not be
+	// parsed or executed
+	ErrInvalidTemplate = errors.New("invalid template")
+)
+
+// SlackMsg is a webhook message that can be sent to slack
+type SlackMsg struct {
+	Text   string       `json:"text"`
+	Blocks []SlackBlock `json:"blocks"`
+}
+
+// SlackBlock is a single block of a slack message
+type SlackBlock struct {
+	Type string     `json:"type"`
+	Text *SlackText `json:"text,omitempty"`
+}
+
+// SlackText is the text of a slack block
+type SlackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// NewSlackMsg creates a new slack message with a header and a section
+// listing the new tracks
+func NewSlackMsg(latest time.Time, ids []TrackID, processing time.Duration) SlackMsg {
+	summary := fmt.Sprintf("%d new tracks", len(ids))
+	return SlackMsg{
+		summary,
+		[]SlackBlock{
+			{"header", &SlackText{"plain_text", summary}},
+			{"section", &SlackText{"mrkdwn", fmt.Sprintf(
+				"*Latest timestamp:* %s\n*Tracks:* %v\n*Processing:* %ds %dms",
+				latest.Format(time.RFC3339),
+				ids,
+				int(processing.Seconds()),
+				(processing.Nanoseconds()/1000)%1000,
+			)}},
+		},
+	}
+}
+
+// WebhookEventMsg is a structured webhook message containing the same
+// fields as a ticker report
+type WebhookEventMsg struct {
+	Event string `json:"event"`
+	TickerReport
+}
+
+// webhookTemplateData is the data templates are executed with, so that the
+// same template can be used for every event type. Updates about new tracks
+// contain the ticker report and the type `new_track`, while other events
+// only contain the event.
+type webhookTemplateData struct {
+	TickerReport
+	Event
+}
+
+// validateWebhookFormat checks that the format of a webhook is known, and
+// that its template can be parsed and executed
+func validateWebhookFormat(webhook WebhookInfo) error {
+	if webhook.Template != "" && webhook.Format != WebhookFormatTemplate {
+		return fmt.Errorf("%s: a template requires the format '%s'", ErrInvalidFormat, WebhookFormatTemplate)
+	}
+	switch webhook.Format {
+	case "", WebhookFormatDiscord, WebhookFormatSlack, WebhookFormatJSON:
+		return nil
+	case WebhookFormatTemplate:
+		if webhook.Template == "" {
+			return fmt.Errorf("%s: template is empty", ErrInvalidTemplate)
+		}
+		// Execute the template with an example of every event the webhook is
+		// registered for, so that references to fields which do not exist
+		// are caught before anything is sent
+		if webhook.Subscribes(WebhookEventNewTrack) {
+			example := newTickerReport(time.Now(), []TrackMeta{{ID: 1, Timestamp: time.Now()}}, time.Now())
+			if _, err := formatWebhookPayload(webhook, example); err != nil {
+				return err
+			}
+		}
+		for eventType := range webhookEventTypes {
+			if webhook.Subscribes(eventType) {
+				example := NewTrackEvent(eventType, TrackMeta{ID: 1, Timestamp: time.Now()})
+				if _, err := formatEventPayload(webhook, example); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return ErrInvalidFormat
+	}
+}
+
+// formatWebhookPayload formats a report of the new tracks using the format
+// of the webhook
+func formatWebhookPayload(webhook WebhookInfo, report TickerReport) ([]byte, error) {
+	var msg interface{}
+	switch webhook.Format {
+	case "", WebhookFormatDiscord:
+		msg = NewDiscordMsg(report.Latest, report.Tracks, report.Processing)
+	case WebhookFormatSlack:
+		msg = NewSlackMsg(report.Latest, report.Tracks, report.Processing)
+	case WebhookFormatJSON:
+		if webhook.EmbedTracks {
+			report.expand(nil)
+		}
+		msg = WebhookEventMsg{"new_tracks", report}
+	case WebhookFormatTemplate:
+		tmpl, err := template.New("webhook").Parse(webhook.Template)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrInvalidTemplate, err)
+		}
+		b := new(bytes.Buffer)
+		data := webhookTemplateData{report, Event{Type: WebhookEventNewTrack, Timestamp: report.Latest}}
+		if err := tmpl.Execute(b, data); err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrInvalidTemplate, err)
+		}
+		return b.Bytes(), nil
+	default:
+		return nil, ErrInvalidFormat
+	}
+
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(msg)
+	return b.Bytes(), nil
+}
+
+// formatEventPayload formats an event using the format of the webhook
+func formatEventPayload(webhook WebhookInfo, event Event) ([]byte, error) {
+	var msg interface{}
+	switch webhook.Format {
+	case "", WebhookFormatDiscord:
+		msg = DiscordMsg{eventSummary(event)}
+	case WebhookFormatSlack:
+		summary := eventSummary(event)
+		msg = SlackMsg{summary, []SlackBlock{{"section", &SlackText{"mrkdwn", summary}}}}
+	case WebhookFormatJSON:
+		msg = event
+	case WebhookFormatTemplate:
+		tmpl, err := template.New("webhook").Parse(webhook.Template)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrInvalidTemplate, err)
+		}
+		b := new(bytes.Buffer)
+		if err := tmpl.Execute(b, webhookTemplateData{TickerReport{}, event}); err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrInvalidTemplate, err)
+		}
+		return b.Bytes(), nil
+	default:
+		return nil, ErrInvalidFormat
+	}
+
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(msg)
+	return b.Bytes(), nil
+}
+
+// eventSummary describes an event in a single sentence
+func eventSummary(event Event) string {
+	switch event.Type {
+	case EventTrackDeleted:
+		return fmt.Sprintf("Track %d was deleted", event.TrackID)
+	case EventTrackRefreshed:
+		return fmt.Sprintf("Track %d was refreshed from %s", event.TrackID, event.Track.TrackSrcURL)
+	case EventTrackIngestionFailed:
+		return fmt.Sprintf("Unable to register track from %s: %s", event.URL, event.Error)
+	case EventPersonalBest:
+		return fmt.Sprintf(
+			"%s set a new personal best of %.1f km with track %d",
+			event.Track.Pilot,
+			event.Track.TrackLength,
+			event.TrackID,
+		)
+	case EventLeaderboardChange:
+		return fmt.Sprintf(
+			"%s is number %d on the leaderboard with %.1f km in track %d",
+			event.Track.Pilot,
+			event.Rank,
+			event.Track.TrackLength,
+			event.TrackID,
+		)
+	case EventAirspaceInfringement:
+		return fmt.Sprintf("Track %d of %s was flown inside %s", event.TrackID, event.Track.Pilot, event.Airspace)
+	default:
+		return fmt.Sprintf("Event %s happened at %s", event.Type, event.Timestamp.Format(time.RFC3339))
+	}
+}
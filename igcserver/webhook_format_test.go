@@ -0,0 +1,121 @@
+package igcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that updates are formatted using the format of the webhook
+func TestFormatWebhookPayload(t *testing.T) {
+	latest := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	metas := []TrackMeta{
+		{ID: 1, Timestamp: latest.Add(-time.Minute), Pilot: "John Normal"},
+		{ID: 2, Timestamp: latest, Pilot: "Aladin Special"},
+	}
+	report := newTickerReport(latest, metas, time.Now())
+
+	format := func(webhook WebhookInfo) []byte {
+		payload, err := formatWebhookPayload(webhook, report)
+		if err != nil {
+			t.Fatalf("unable to format payload as '%s': %s", webhook.Format, err)
+		}
+		return payload
+	}
+
+	var discord DiscordMsg
+	json.Unmarshal(format(WebhookInfo{}), &discord)
+	if !strings.Contains(discord.Content, "the 2 new tracks are: [1 2]") {
+		t.Errorf("expected discord message by default, got '%s'", discord.Content)
+	}
+
+	var slack SlackMsg
+	json.Unmarshal(format(WebhookInfo{Format: WebhookFormatSlack}), &slack)
+	if slack.Text != "2 new tracks" || len(slack.Blocks) != 2 || !strings.Contains(slack.Blocks[1].Text.Text, "[1 2]") {
+		t.Errorf("expected slack message with blocks, got %v", slack)
+	}
+
+	var event map[string]interface{}
+	json.Unmarshal(format(WebhookInfo{Format: WebhookFormatJSON}), &event)
+	if event["event"] != "new_tracks" || len(event["tracks"].([]interface{})) != 2 || event["expanded"] != nil {
+		t.Errorf("expected json event without tracks embedded, got %v", event)
+	}
+	event = nil
+	json.Unmarshal(format(WebhookInfo{Format: WebhookFormatJSON, EmbedTracks: true}), &event)
+	expanded, _ := event["expanded"].([]interface{})
+	if len(expanded) != 2 || expanded[1].(map[string]interface{})["pilot"] != "Aladin Special" {
+		t.Errorf("expected json event with tracks embedded, got %v", event)
+	}
+
+	tmpl := "{{.Latest.Format \"2006-01-02\"}}:{{range .Metas}} {{.Pilot}}{{end}}"
+	if got := string(format(WebhookInfo{Format: WebhookFormatTemplate, Template: tmpl})); got != "2018-06-01: John Normal Aladin Special" {
+		t.Errorf("expected template to be executed, got '%s'", got)
+	}
+}
+
+// Test that events are formatted using the format of the webhook
+func TestFormatEventPayload(t *testing.T) {
+	event := NewTrackEvent(EventPersonalBest, TrackMeta{ID: 3, Pilot: "John Normal", TrackLength: 42})
+
+	format := func(webhook WebhookInfo) []byte {
+		payload, err := formatEventPayload(webhook, event)
+		if err != nil {
+			t.Fatalf("unable to format event as '%s': %s", webhook.Format, err)
+		}
+		return payload
+	}
+
+	expt := "John Normal set a new personal best of 42.0 km with track 3"
+	var discord DiscordMsg
+	json.Unmarshal(format(WebhookInfo{}), &discord)
+	if discord.Content != expt {
+		t.Errorf("expected discord message '%s', got '%s'", expt, discord.Content)
+	}
+	var slack SlackMsg
+	json.Unmarshal(format(WebhookInfo{Format: WebhookFormatSlack}), &slack)
+	if slack.Text != expt {
+		t.Errorf("expected slack message '%s', got '%s'", expt, slack.Text)
+	}
+	var got Event
+	json.Unmarshal(format(WebhookInfo{Format: WebhookFormatJSON}), &got)
+	if got.Type != EventPersonalBest || got.TrackID != 3 || got.Track.Pilot != "John Normal" {
+		t.Errorf("expected the event as json, got %v", got)
+	}
+	tmpl := "{{.Type}}:{{len .Tracks}}:{{with .Track}}{{.Pilot}}{{end}}"
+	if got := string(format(WebhookInfo{Format: WebhookFormatTemplate, Template: tmpl})); got != "personal_best:0:John Normal" {
+		t.Errorf("expected template to be executed with the event, got '%s'", got)
+	}
+}
+
+// Test that invalid formats and templates are rejected when registering a
+// webhook
+func TestRegWebhookFormat(t *testing.T) {
+	webhooksMap := NewWebhooksMap()
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
+
+	for _, data := range []struct {
+		body string
+		expt int
+	}{
+		{"{\"webhookURL\":\"http://a.com\",\"format\":\"slack\"}", 200},
+		{"{\"webhookURL\":\"http://b.com\",\"format\":\"json\",\"embedTracks\":true}", 200},
+		{"{\"webhookURL\":\"http://c.com\",\"format\":\"template\",\"template\":\"{{.Tracks}}\"}", 200},
+		{"{\"webhookURL\":\"http://d.com\",\"format\":\"teams\"}", 400},
+		{"{\"webhookURL\":\"http://e.com\",\"format\":\"template\"}", 400},
+		{"{\"webhookURL\":\"http://f.com\",\"format\":\"template\",\"template\":\"{{.Tracks\"}", 400},
+		{"{\"webhookURL\":\"http://g.com\",\"format\":\"template\",\"template\":\"{{.Unknown}}\"}", 400},
+		{"{\"webhookURL\":\"http://h.com\",\"template\":\"{{.Tracks}}\"}", 400},
+	} {
+		req := httptest.NewRequest("POST", "/webhook/new_track", bytes.NewReader([]byte(data.body)))
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != data.expt {
+			t.Errorf("expected registering '%s' to give '%d', got '%d'", data.body, data.expt, code)
+		}
+	}
+}
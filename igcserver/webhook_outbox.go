@@ -0,0 +1,492 @@
+package igcserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// DeliveryPending is the state of a delivery which will be attempted
+	DeliveryPending = "pending"
+
+	// DeliveryDelivered is the state of a delivery which has been received by
+	// the webhook
+	DeliveryDelivered = "delivered"
+
+	// DeliveryDead is the state of a delivery which has failed too many times
+	// or was rejected by the receiver, and will only be attempted if replayed
+	DeliveryDead = "dead"
+
+	// webhookMaxAttempts is the number of attempts before a delivery is moved
+	// to the dead letters
+	webhookMaxAttempts = 8
+
+	// webhookBaseBackoff is the delay before the first retry, which is
+	// doubled for every failed attempt
+	webhookBaseBackoff = 5 * time.Second
+
+	// webhookMaxBackoff caps the delay between two attempts
+	webhookMaxBackoff = time.Hour
+
+	// webhookResponseLimit is the maximum number of bytes of a response which
+	// is recorded for an attempt
+	webhookResponseLimit = 1024
+
+	// webhookLogLimit is the maximum number of attempts recorded for a
+	// delivery, where the oldest are dropped first
+	webhookLogLimit = 50
+)
+
+var (
+	// ErrDeliveryNotFound is returned if a request did not result in a
+	// delivery
+	ErrDeliveryNotFound = errors.New("delivery not found")
+)
+
+// outboxStore is the storage used by the webhook workers to move deliveries
+// between their states, so that the state transitions do not depend on the
+// database
+type outboxStore interface {
+	// getWebhook fetches a webhook, or gives ErrWebhookNotFound
+	getWebhook(id WebhookID) (WebhookInfo, error)
+	// eventWebhooks fetches the active webhooks registered for an event type
+	eventWebhooks(eventType string) ([]WebhookInfo, error)
+	// tracksSince fetches the tracks matching the filter of the webhook which
+	// were added after it was last triggered, oldest first
+	tracksSince(webhook WebhookInfo) ([]TrackMeta, error)
+	// advanceLastTriggered raises the last triggered timestamp of a webhook
+	advanceLastTriggered(id WebhookID, latest time.Time) error
+	// setPaused pauses or resumes a webhook and returns it
+	setPaused(id WebhookID, paused bool) (WebhookInfo, error)
+
+	// addDelivery adds a new delivery to the outbox
+	addDelivery(delivery Delivery) error
+	// putUpdate adds an update of new tracks to the outbox, or replaces the
+	// payload of the pending update of the webhook
+	putUpdate(delivery Delivery) error
+	// getDelivery fetches a delivery of a webhook, or gives
+	// ErrDeliveryNotFound
+	getDelivery(webhookID WebhookID, id bson.ObjectId) (Delivery, error)
+	// dueDeliveries fetches the pending deliveries which are due
+	dueDeliveries(now time.Time) ([]Delivery, error)
+	// claimDelivery moves the next attempt of a pending delivery forward,
+	// unless it was changed since it was fetched
+	claimDelivery(delivery Delivery, until time.Time) (bool, error)
+	// releaseDelivery moves the next attempt of a pending delivery
+	releaseDelivery(id bson.ObjectId, at time.Time) error
+	// releaseDeliveries moves the next attempt of every pending delivery of
+	// a webhook
+	releaseDeliveries(webhookID WebhookID, at time.Time) error
+	// removeDelivery removes a delivery from the outbox
+	removeDelivery(id bson.ObjectId) error
+	// recordFailure stores the state of a failed delivery and its attempt
+	recordFailure(delivery Delivery, attempt Attempt) error
+	// markDelivered marks a delivery as delivered and stores its attempt,
+	// unless its payload was replaced while it was sent
+	markDelivered(delivery Delivery, attempt Attempt) (bool, error)
+	// restartDelivery stores the attempt of a delivery which was replaced,
+	// and attempts the replacement from the start
+	restartDelivery(id bson.ObjectId, attempt Attempt, at time.Time) error
+	// reviveDelivery moves a dead letter back to the pending deliveries, or
+	// gives ErrDeliveryNotFound if it is not a dead letter
+	reviveDelivery(webhookID WebhookID, id bson.ObjectId, at time.Time) (Delivery, error)
+}
+
+// Delivery is a notification to a webhook stored in the outbox until it is
+// delivered, retried with a backoff if the receiver is unavailable
+type Delivery struct {
+	ID          bson.ObjectId `json:"id" bson:"_id"`
+	WebhookID   WebhookID     `json:"webhook_id" bson:"webhookID"`
+	Event       string        `json:"event" bson:"event"`
+	State       string        `json:"state" bson:"state"`
+	Payload     string        `json:"payload" bson:"payload"`
+	Latest      time.Time     `json:"latest" bson:"latest"`
+	Attempts    int           `json:"attempts" bson:"attempts"`
+	NextAttempt time.Time     `json:"next_attempt" bson:"nextAttempt"`
+	LastError   string        `json:"last_error,omitempty" bson:"lastError"`
+	Created     time.Time     `json:"created" bson:"created"`
+	Redelivery  bool          `json:"redelivery" bson:"redelivery"`
+	Log         []Attempt     `json:"log" bson:"log"`
+}
+
+// Attempt is a record of a single attempt to deliver to a webhook
+type Attempt struct {
+	Timestamp  time.Time `json:"timestamp" bson:"timestamp"`
+	Payload    string    `json:"payload" bson:"payload"`
+	StatusCode int       `json:"status_code,omitempty" bson:"statusCode"`
+	LatencyMs  int64     `json:"latency_ms" bson:"latencyMs"`
+	Error      string    `json:"error,omitempty" bson:"error"`
+	Response   string    `json:"response,omitempty" bson:"response"`
+}
+
+// NewDelivery creates a pending delivery of new tracks to a webhook, where
+// latest is the timestamp of the newest track in the payload
+func NewDelivery(webhookID WebhookID, payload []byte, latest time.Time) Delivery {
+	now := time.Now()
+	return Delivery{
+		ID:          bson.NewObjectId(),
+		WebhookID:   webhookID,
+		Event:       WebhookEventNewTrack,
+		State:       DeliveryPending,
+		Payload:     string(payload),
+		Latest:      latest,
+		NextAttempt: now,
+		Created:     now,
+		Log:         []Attempt{},
+	}
+}
+
+// NewEventDelivery creates a pending delivery of an event to a webhook
+func NewEventDelivery(webhookID WebhookID, payload []byte, event Event) Delivery {
+	delivery := NewDelivery(webhookID, payload, time.Time{})
+	delivery.Event = event.Type
+	return delivery
+}
+
+// NewRedelivery creates a pending delivery which sends the payload of a
+// previous delivery again
+func NewRedelivery(delivery Delivery) Delivery {
+	redelivery := NewDelivery(delivery.WebhookID, []byte(delivery.Payload), delivery.Latest)
+	redelivery.Event = delivery.Event
+	redelivery.Redelivery = true
+	return redelivery
+}
+
+// webhookBackoff returns the delay before the next attempt after the given
+// number of failed attempts. Half of the delay is random so that receivers
+// coming back up are not hit by every retry at once.
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookMaxBackoff
+	if attempts < 20 {
+		if d := webhookBaseBackoff << uint(attempts-1); d < delay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// deliver posts a delivery to the webhook and records the attempt. If the
+// attempt failed, retry tells if the failure is temporary, which is the case
+// for network errors, server errors and rate limiting.
+func deliver(httpClient *http.Client, webhook WebhookInfo, delivery Delivery) (attempt Attempt, retry bool, err error) {
+	attempt = Attempt{Timestamp: time.Now(), Payload: delivery.Payload}
+	defer func() {
+		attempt.LatencyMs = int64(time.Since(attempt.Timestamp) / time.Millisecond)
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+	}()
+
+	req, err := newWebhookRequest(webhook, []byte(delivery.Payload))
+	if err != nil {
+		return attempt, false, err
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return attempt, true, err
+	}
+	defer res.Body.Close()
+	attempt.StatusCode = res.StatusCode
+	response, _ := ioutil.ReadAll(io.LimitReader(res.Body, webhookResponseLimit))
+	attempt.Response = string(response)
+	if res.StatusCode >= 300 {
+		retry = res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		return attempt, retry, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return attempt, false, nil
+}
+
+// failDelivery records a failed attempt of a delivery, moving it to the dead
+// letters if it should not be retried or has been attempted too many times
+func failDelivery(delivery Delivery, retry bool, err error) Delivery {
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	if !retry || delivery.Attempts >= webhookMaxAttempts {
+		delivery.State = DeliveryDead
+	} else {
+		delivery.NextAttempt = time.Now().Add(webhookBackoff(delivery.Attempts))
+	}
+	return delivery
+}
+
+// updateWebhook adds a delivery to the outbox if enough tracks have been
+// added since the webhook was last triggered, or if the oldest of them has
+// waited for the max delay of the webhook. A pending delivery which has not
+// been delivered yet is replaced, so that it contains all new tracks.
+func updateWebhook(store outboxStore, webhook WebhookInfo) {
+	start := time.Now()
+
+	weblog := log.WithField("webhook", webhook)
+
+	trackMetas, err := store.tracksSince(webhook)
+	if err != nil {
+		weblog.WithField("error", err).Error("unable to get track metas after given timestamp")
+		return
+	}
+
+	if !webhook.Due(trackMetas, start) {
+		weblog.Info("update not needed for webhook")
+		return
+	}
+	laststamp := trackMetas[len(trackMetas)-1].Timestamp
+	report := newTickerReport(laststamp, trackMetas, start)
+	payload, err := formatWebhookPayload(webhook, report)
+	if err != nil {
+		weblog.WithField("error", err).Error("unable to format update of webhook")
+		return
+	}
+
+	weblog.WithField("payload", string(payload)).Info("adding update of webhook to outbox")
+	if err := store.putUpdate(NewDelivery(webhook.ID, payload, laststamp)); err != nil {
+		weblog.WithField("error", err).Error("unable to add update of webhook to outbox")
+	}
+}
+
+// dispatchEvent adds a delivery of the event to the outbox of every webhook
+// which is registered for its type
+func dispatchEvent(store outboxStore, event Event) {
+	webhooks, err := store.eventWebhooks(event.Type)
+	if err != nil {
+		log.WithField("error", err).Error("unable to get webhooks registered for event")
+		return
+	}
+	for _, webhook := range webhooks {
+		weblog := log.WithFields(log.Fields{
+			"webhook": webhook,
+			"event":   event.Type,
+		})
+		payload, err := formatEventPayload(webhook, event)
+		if err != nil {
+			weblog.WithField("error", err).Error("unable to format event for webhook")
+			continue
+		}
+		weblog.Info("adding event to outbox of webhook")
+		if err := store.addDelivery(NewEventDelivery(webhook.ID, payload, event)); err != nil {
+			weblog.WithField("error", err).Error("unable to add event to outbox of webhook")
+		}
+	}
+}
+
+// deliverOutbox queues all pending deliveries which are due for the workers.
+// Deliveries which do not fit in the queue are left for the next poll.
+func deliverOutbox(store outboxStore, queue chan webhookJob, hosts *hostLimiter, httpClient *http.Client, events *EventBus) {
+	due, err := store.dueDeliveries(time.Now())
+	if err != nil {
+		log.WithField("error", err).Error("unable to get due deliveries from outbox")
+		return
+	}
+	for _, delivery := range due {
+		if len(queue) == cap(queue) {
+			log.WithField("remaining", len(due)).Info("webhook queue is full, waiting for next poll")
+			return
+		}
+		// Claim the delivery by moving the next attempt forward, so that it
+		// is not attempted by another poll or instance at the same time
+		claimed, err := store.claimDelivery(delivery, time.Now().Add(webhookClaimTimeout))
+		if err != nil {
+			log.WithField("error", err).Error("unable to claim delivery")
+			continue
+		} else if !claimed {
+			continue
+		}
+		queue <- func(delivery Delivery) webhookJob {
+			return func(store outboxStore) {
+				attemptDelivery(store, hosts, httpClient, events, delivery)
+			}
+		}(delivery)
+	}
+}
+
+// attemptDelivery attempts a claimed delivery, advancing the last triggered
+// timestamp of the webhook only if it succeeded
+func attemptDelivery(store outboxStore, hosts *hostLimiter, httpClient *http.Client, events *EventBus, delivery Delivery) {
+	deliverylog := log.WithField("delivery", delivery)
+
+	webhook, err := store.getWebhook(delivery.WebhookID)
+	if err == ErrWebhookNotFound {
+		deliverylog.Info("removing delivery of deleted webhook")
+		if err := store.removeDelivery(delivery.ID); err != nil {
+			deliverylog.WithField("error", err).Error("unable to remove delivery of deleted webhook")
+		}
+		return
+	} else if err != nil {
+		deliverylog.WithField("error", err).Error("unable to get webhook of delivery")
+		return
+	}
+
+	if webhook.Paused {
+		// The delivery stays claimed, and is released when the webhook is
+		// resumed
+		deliverylog.Info("not sending update to paused webhook")
+		return
+	}
+
+	// The claim is released if the host already has too many deliveries, so
+	// that the delivery is attempted by a later poll
+	host := webhook.URLstr
+	if u, err := url.Parse(webhook.URLstr); err == nil {
+		host = u.Host
+	}
+	if !hosts.acquire(host) {
+		deliverylog.WithField("host", host).Info("too many deliveries to host of webhook, postponing")
+		if err := store.releaseDelivery(delivery.ID, time.Now()); err != nil {
+			deliverylog.WithField("error", err).Error("unable to release claim of delivery")
+		}
+		return
+	}
+	defer hosts.release(host)
+
+	deliverylog.Info("sending update to webhook")
+	attempt, retry, err := deliver(httpClient, webhook, delivery)
+	if err != nil {
+		delivery = failDelivery(delivery, retry, err)
+		deliverylog.WithFields(log.Fields{
+			"error":    err,
+			"attempts": delivery.Attempts,
+			"state":    delivery.State,
+		}).Warn("unable to deliver update to webhook")
+		events.Publish(NewWebhookEvent(EventWebhookDeliveryFailed, webhook.ID))
+
+		if err := store.recordFailure(delivery, attempt); err != nil {
+			deliverylog.WithField("error", err).Error("unable to record failed delivery")
+		}
+		return
+	}
+
+	// Update last triggered for current webhook
+	if err := store.advanceLastTriggered(webhook.ID, delivery.Latest); err != nil {
+		deliverylog.WithField("error", err).Error("unable to update last triggered of webhook")
+	}
+
+	// The delivery is only finished if it was not replaced with newer tracks
+	// while it was sent, otherwise the replacement is sent right away
+	delivered, err := store.markDelivered(delivery, attempt)
+	if err == nil && !delivered {
+		err = store.restartDelivery(delivery.ID, attempt, time.Now())
+	}
+	if err != nil {
+		deliverylog.WithField("error", err).Error("unable to record delivered update")
+	}
+}
+
+// setWebhookPaused pauses or resumes a webhook. The claims of deliveries which
+// were kept while the webhook was paused are released when it is resumed, so
+// that they are attempted right away.
+func setWebhookPaused(store outboxStore, id WebhookID, paused bool) (webhook WebhookInfo, err error) {
+	webhook, err = store.setPaused(id, paused)
+	if err != nil || paused {
+		return
+	}
+	err = store.releaseDeliveries(id, time.Now())
+	return
+}
+
+// redeliver sends a previous delivery to a webhook again. A dead letter is
+// moved back to the outbox, while any other delivery is added to the outbox
+// again as a new delivery with the same payload.
+func redeliver(store outboxStore, id WebhookID, deliveryID bson.ObjectId) (redelivery Delivery, err error) {
+	if _, err = store.getWebhook(id); err != nil {
+		return
+	}
+	redelivery, err = store.reviveDelivery(id, deliveryID, time.Now())
+	if err != ErrDeliveryNotFound {
+		return
+	}
+	delivery, err := store.getDelivery(id, deliveryID)
+	if err != nil {
+		return
+	}
+	redelivery = NewRedelivery(delivery)
+	err = store.addDelivery(redelivery)
+	return
+}
+
+// ------------ //
+// DELIVERY API //
+// ------------ //
+
+// webhookDeliveriesHandler returns the deliveries to a webhook, newest first,
+// optionally filtered by their state using `?state=<state>`
+func (server *Server) webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to get deliveries of webhook")
+
+	webhook, ok := server.webhookOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
+	id := webhook.ID
+	idlog := logger.WithField("id", id)
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryDead:
+	default:
+		idlog.WithField("state", state).Info("unknown delivery state")
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	deliveries, err := server.webhooks.Deliveries(id, state)
+	if err == ErrWebhookNotFound {
+		idlog.Info("unable to find webhook")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Info("error when getting deliveries of webhook")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	idlog.WithField("count", len(deliveries)).Info("responding with deliveries of webhook")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// webhookRedeliverHandler sends a delivery to a webhook again, where a dead
+// letter is replayed and any other delivery is sent again as a new delivery
+func (server *Server) webhookRedeliverHandler(w http.ResponseWriter, r *http.Request) {
+	logger := newReqLogger(r)
+
+	logger.Info("processing request to redeliver to webhook")
+
+	webhook, ok := server.webhookOfRequest(w, r, logger)
+	if !ok {
+		return
+	}
+	id := webhook.ID
+	deliveryIDStr, _ := mux.Vars(r)["deliveryID"]
+	if !bson.IsObjectIdHex(deliveryIDStr) {
+		logger.WithField("deliveryID", deliveryIDStr).Info("delivery id must be a valid object id")
+		http.Error(w, "invalid delivery id", http.StatusBadRequest)
+		return
+	}
+	deliveryID := bson.ObjectIdHex(deliveryIDStr)
+	idlog := logger.WithFields(log.Fields{
+		"id":         id,
+		"deliveryID": deliveryID,
+	})
+	delivery, err := server.webhooks.Redeliver(id, deliveryID)
+	if err == ErrWebhookNotFound || err == ErrDeliveryNotFound {
+		idlog.WithField("error", err).Info("unable to find delivery")
+		http.Error(w, "content not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		idlog.WithField("error", err).Info("error when redelivering")
+		http.Error(w, "internal server error occurred", http.StatusInternalServerError)
+		return
+	}
+	idlog.WithField("redelivery", delivery).Info("responding with redelivery")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
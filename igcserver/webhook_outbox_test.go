@@ -0,0 +1,1027 @@
+package igcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that the backoff grows exponentially with jitter and is capped
+func TestWebhookBackoff(t *testing.T) {
+	for attempts := 1; attempts < 30; attempts++ {
+		expt := webhookMaxBackoff
+		if attempts < 20 && webhookBaseBackoff<<uint(attempts-1) < expt {
+			expt = webhookBaseBackoff << uint(attempts-1)
+		}
+		for i := 0; i < 10; i++ {
+			if got := webhookBackoff(attempts); got < expt/2 || got > expt {
+				t.Fatalf("expected backoff after %d attempts to be within [%s, %s], got %s", attempts, expt/2, expt, got)
+			}
+		}
+	}
+}
+
+// Test that only temporary failures are retried, and that deliveries become
+// dead letters after too many attempts
+func TestDeliver(t *testing.T) {
+	status := http.StatusOK
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write(bytes.Repeat([]byte("a"), webhookResponseLimit+1))
+	}))
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	defer receiver.Close()
+
+	delivery := NewDelivery(1, []byte("{}"), time.Now())
+	for _, data := range []struct {
+		url    string
+		status int
+		retry  bool
+		failed bool
+	}{
+		{receiver.URL, http.StatusOK, false, false},
+		{receiver.URL, http.StatusNoContent, false, false},
+		{receiver.URL, http.StatusInternalServerError, true, true},
+		{receiver.URL, http.StatusServiceUnavailable, true, true},
+		{receiver.URL, http.StatusTooManyRequests, true, true},
+		{receiver.URL, http.StatusBadRequest, false, true},
+		{receiver.URL, http.StatusGone, false, true},
+		{closed.URL, 0, true, true},
+	} {
+		status = data.status
+		attempt, retry, err := deliver(receiver.Client(), WebhookInfo{URLstr: data.url}, delivery)
+		if retry != data.retry || (err != nil) != data.failed {
+			t.Errorf("expected delivery with status %d to give retry %t and failure %t, got %t and '%v'", data.status, data.retry, data.failed, retry, err)
+		}
+		if attempt.StatusCode != data.status || attempt.Payload != delivery.Payload || (attempt.Error != "") != data.failed {
+			t.Errorf("expected attempt to record status %d and payload, got %v", data.status, attempt)
+		}
+		if data.status != 0 && data.status != http.StatusNoContent && len(attempt.Response) != webhookResponseLimit {
+			t.Errorf("expected response to be truncated to %d bytes, got %d", webhookResponseLimit, len(attempt.Response))
+		}
+	}
+
+	failed := failDelivery(delivery, true, fmt.Errorf("timeout"))
+	if failed.State != DeliveryPending || failed.Attempts != 1 || !failed.NextAttempt.After(delivery.NextAttempt) {
+		t.Errorf("expected delivery to be retried later, got %v", failed)
+	}
+	if rejected := failDelivery(delivery, false, fmt.Errorf("gone")); rejected.State != DeliveryDead {
+		t.Errorf("expected rejected delivery to be dead, got %v", rejected)
+	}
+	for failed.Attempts < webhookMaxAttempts {
+		failed = failDelivery(failed, true, fmt.Errorf("timeout"))
+	}
+	if failed.State != DeliveryDead || failed.LastError != "timeout" {
+		t.Errorf("expected delivery to be dead after %d attempts, got %v", webhookMaxAttempts, failed)
+	}
+}
+
+// Test GET /webhook/new_track/<id>/deliveries?state=dead and replaying a
+// dead letter
+func TestWebhookDeadLetters(t *testing.T) {
+	webhooksMap := NewWebhooksMap()
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
+
+	webhook := makeWebhooksTestData()[0]
+	webhooksMap.Append(webhook)
+	dead := NewDelivery(webhook.ID, []byte("{}"), time.Now())
+	dead.State = DeliveryDead
+	dead.Attempts = webhookMaxAttempts
+	pending := NewDelivery(webhook.ID, []byte("{}"), time.Now())
+	webhooksMap.deliveries[dead.ID] = dead
+	webhooksMap.deliveries[pending.ID] = pending
+
+	do := func(method, path string, exptCode int) *bytes.Buffer {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+testWebhookToken)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != exptCode {
+			t.Fatalf("expected `%s %s` to return %d, got '%d'", method, path, exptCode, code)
+		}
+		return res.Body
+	}
+	deadLetters := func() (deliveries []Delivery) {
+		body := do("GET", fmt.Sprintf("/webhook/new_track/%d/deliveries?state=dead", webhook.ID), 200)
+		if err := json.NewDecoder(body).Decode(&deliveries); err != nil {
+			t.Fatalf("unable to decode dead letters: %s", err)
+		}
+		return
+	}
+
+	if got := deadLetters(); len(got) != 1 || got[0].ID != dead.ID {
+		t.Fatalf("expected only the dead delivery, got %v", got)
+	}
+
+	replayPath := fmt.Sprintf("/webhook/new_track/%d/deliveries/%s/redeliver", webhook.ID, dead.ID.Hex())
+	var replayed Delivery
+	json.NewDecoder(do("POST", replayPath, 200)).Decode(&replayed)
+	if replayed.ID != dead.ID || replayed.State != DeliveryPending || replayed.Attempts != 0 {
+		t.Errorf("expected dead letter to be pending again, got %v", replayed)
+	}
+	if got := deadLetters(); len(got) != 0 {
+		t.Errorf("expected no dead letters after replay, got %v", got)
+	}
+
+	do("GET", fmt.Sprintf("/webhook/new_track/%d/deliveries?state=unknown", webhook.ID), 400)
+	do("GET", "/webhook/new_track/1/deliveries?state=dead", 404)
+}
+
+// Test GET /webhook/new_track/<id>/deliveries and redelivering a delivery
+func TestWebhookDeliveries(t *testing.T) {
+	webhooksMap := NewWebhooksMap()
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
+
+	webhook := makeWebhooksTestData()[0]
+	webhooksMap.Append(webhook)
+	delivered := NewDelivery(webhook.ID, []byte("{\"content\":\"hello\"}"), time.Now())
+	delivered.State = DeliveryDelivered
+	delivered.Created = delivered.Created.Add(-time.Minute)
+	delivered.Log = []Attempt{{Timestamp: delivered.Created, Payload: delivered.Payload, StatusCode: 200}}
+	webhooksMap.deliveries[delivered.ID] = delivered
+
+	do := func(method, path string, exptCode int) *bytes.Buffer {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+testWebhookToken)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != exptCode {
+			t.Fatalf("expected `%s %s` to return %d, got '%d'", method, path, exptCode, code)
+		}
+		return res.Body
+	}
+
+	var redelivery Delivery
+	body := do("POST", fmt.Sprintf("/webhook/new_track/%d/deliveries/%s/redeliver", webhook.ID, delivered.ID.Hex()), 200)
+	json.NewDecoder(body).Decode(&redelivery)
+	if redelivery.ID == delivered.ID || redelivery.State != DeliveryPending || redelivery.Payload != delivered.Payload || !redelivery.Redelivery {
+		t.Errorf("expected a new pending delivery with the same payload, got %v", redelivery)
+	}
+
+	var deliveries []Delivery
+	body = do("GET", fmt.Sprintf("/webhook/new_track/%d/deliveries", webhook.ID), 200)
+	if err := json.NewDecoder(body).Decode(&deliveries); err != nil {
+		t.Fatalf("unable to decode deliveries: %s", err)
+	}
+	if len(deliveries) != 2 || deliveries[0].ID != redelivery.ID || deliveries[1].ID != delivered.ID {
+		t.Fatalf("expected redelivery and delivery, newest first, got %v", deliveries)
+	}
+	if log := deliveries[1].Log; len(log) != 1 || log[0].StatusCode != 200 {
+		t.Errorf("expected the attempt of the delivery to be included, got %v", log)
+	}
+
+	do("POST", fmt.Sprintf("/webhook/new_track/%d/deliveries/%s/redeliver", webhook.ID, bson.NewObjectId().Hex()), 404)
+	do("POST", fmt.Sprintf("/webhook/new_track/%d/deliveries/abc/redeliver", webhook.ID), 400)
+	do("GET", "/webhook/new_track/1/deliveries", 404)
+	do("GET", "/webhook/new_track/abc/deliveries", 400)
+}
+
+// Test that the last triggered timestamp of a webhook is only advanced when
+// the update is delivered, and that failed updates are retried
+func TestWebhooksDBOutbox(t *testing.T) {
+	session := makeTestSession(t)
+	defer session.Close()
+	defer session.DB("").DropDatabase()
+
+	webhookOutboxPollInterval = 10 * time.Millisecond
+	defer func() { webhookOutboxPollInterval = time.Second }()
+
+	statuses := make(chan int, 10)
+	statuses <- http.StatusServiceUnavailable
+	statuses <- http.StatusOK
+	received := make(chan bool, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(<-statuses)
+		received <- true
+	}))
+	defer receiver.Close()
+
+	tracks := NewTrackMetasDB(session.Copy())
+	webhooks := NewWebhooksDB(session.Copy(), receiver.Client(), NewEventBus())
+
+	webhook := WebhookInfo{ID: 1, URLstr: receiver.URL, TriggerRate: 1}
+	if err := webhooks.Append(webhook); err != nil {
+		t.Fatalf("unable to add webhook: %s", err)
+	}
+	latest := time.Now().Truncate(time.Millisecond)
+	if err := tracks.Append(TrackMeta{ID: 1, Timestamp: latest}); err != nil {
+		t.Fatalf("unable to add track: %s", err)
+	}
+	webhooks.Trigger()
+
+	wait := func() {
+		select {
+		case <-received:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected webhook to receive update")
+		}
+	}
+	lastTriggered := func() time.Time {
+		// Give the delivery time to be recorded
+		time.Sleep(50 * time.Millisecond)
+		webhook, err := webhooks.Get(webhook.ID)
+		if err != nil {
+			t.Fatalf("unable to get webhook: %s", err)
+		}
+		return webhook.LastTriggered
+	}
+
+	wait()
+	if got := lastTriggered(); !got.IsZero() {
+		t.Errorf("expected last triggered not to advance after failed delivery, got '%s'", got)
+	}
+
+	// Make the retry due right away
+	err := session.DB("").C(outboxCollection).Update(
+		bson.M{"webhookID": webhook.ID},
+		bson.M{"$set": bson.M{"nextAttempt": time.Now()}},
+	)
+	if err != nil {
+		t.Fatalf("unable to update delivery: %s", err)
+	}
+
+	wait()
+	if got := lastTriggered(); !got.Equal(latest) {
+		t.Errorf("expected last triggered to be '%s' after delivery, got '%s'", latest, got)
+	}
+	deliveries, err := webhooks.Deliveries(webhook.ID, "")
+	if err != nil {
+		t.Fatalf("unable to get deliveries: %s", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].State != DeliveryDelivered || len(deliveries[0].Log) != 2 {
+		t.Fatalf("expected a delivered update with two attempts, got %v", deliveries)
+	}
+	if log := deliveries[0].Log; log[0].StatusCode != http.StatusServiceUnavailable || log[1].StatusCode != http.StatusOK {
+		t.Errorf("expected attempts to record the failure and the success, got %v", log)
+	}
+}
+
+// Test that only tracks matching the filter of a webhook count towards its
+// trigger value and max delay, and are included in the update
+func TestWebhooksDBFilter(t *testing.T) {
+	session := makeTestSession(t)
+	defer session.Close()
+	defer session.DB("").DropDatabase()
+
+	tracks := NewTrackMetasDB(session.Copy())
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	for i, meta := range []TrackMeta{
+		{ID: 1, Pilot: "John Normal", TrackLength: 60},
+		{ID: 2, Pilot: "John Normal", TrackLength: 10},
+		{ID: 3, Pilot: "Aladin Special", TrackLength: 80},
+	} {
+		meta.Timestamp = start.Add(time.Duration(i) * time.Second)
+		if err := tracks.Append(meta); err != nil {
+			t.Fatalf("unable to add track: %s", err)
+		}
+	}
+
+	filter := &TrackFilter{Pilot: "john normal", MinLength: 50}
+	for _, data := range []struct {
+		webhook WebhookInfo
+		expt    bool
+	}{
+		{WebhookInfo{ID: 1, TriggerRate: 1, Format: WebhookFormatJSON, Filter: filter}, true},
+		{WebhookInfo{ID: 2, TriggerRate: 2, Format: WebhookFormatJSON, Filter: filter}, false},
+		{WebhookInfo{ID: 3, TriggerRate: 2, Format: WebhookFormatJSON, Filter: filter, MaxDelay: "PT30M"}, true},
+		{WebhookInfo{ID: 4, TriggerRate: 2, Format: WebhookFormatJSON, Filter: filter, MaxDelay: "PT2H"}, false},
+	} {
+		updateWebhook(&outboxDB{session}, data.webhook)
+
+		var delivery Delivery
+		err := session.DB("").C(outboxCollection).Find(bson.M{"webhookID": data.webhook.ID}).One(&delivery)
+		if !data.expt {
+			if err == nil {
+				t.Errorf("expected no update of webhook '%d', got %v", data.webhook.ID, delivery)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected update of webhook '%d': %s", data.webhook.ID, err)
+		}
+		var msg WebhookEventMsg
+		json.Unmarshal([]byte(delivery.Payload), &msg)
+		if len(msg.Tracks) != 1 || msg.Tracks[0] != 1 || !delivery.Latest.Equal(start) {
+			t.Errorf("expected update to only contain the matching track, got %v", msg)
+		}
+	}
+}
+
+// Test that webhooks are listed by owner, that updates remove the filter and
+// that paused webhooks are not sent events
+func TestWebhooksDBManagement(t *testing.T) {
+	session := makeTestSession(t)
+	defer session.Close()
+	defer session.DB("").DropDatabase()
+
+	webhooks := NewWebhooksDB(session.Copy(), http.DefaultClient, NewEventBus())
+	for _, webhook := range []WebhookInfo{
+		{ID: 1, URLstr: "http://a.com/1", TriggerRate: 1, Owner: "a", Events: []string{EventTrackDeleted}, Filter: &TrackFilter{Pilot: "John Normal"}},
+		{ID: 2, URLstr: "http://b.com", TriggerRate: 1, Owner: "b"},
+	} {
+		if err := webhooks.Append(webhook); err != nil {
+			t.Fatalf("unable to add webhook: %s", err)
+		}
+	}
+
+	listed, err := webhooks.List("a")
+	if err != nil || len(listed) != 1 || listed[0].ID != 1 {
+		t.Errorf("expected only the webhook of the owner to be listed, got %v (%v)", listed, err)
+	}
+
+	if err := webhooks.Update(WebhookInfo{ID: 1, URLstr: "http://a.com", TriggerRate: 2}); err != nil {
+		t.Fatalf("unable to update webhook: %s", err)
+	}
+	webhook, _ := webhooks.Get(1)
+	if webhook.URLstr != "http://a.com" || webhook.TriggerRate != 2 || webhook.Filter != nil || webhook.Owner != "a" {
+		t.Errorf("expected url, trigger value and filter to be updated, got %v", webhook)
+	}
+	if err := webhooks.Update(WebhookInfo{ID: 1, URLstr: "http://b.com", TriggerRate: 2}); err != ErrWebhookAlreadyExists {
+		t.Errorf("expected changing url to the url of another webhook to fail, got %v", err)
+	}
+	if err := webhooks.Append(WebhookInfo{ID: 3, URLstr: "http://b.com", TriggerRate: 1}); err != ErrWebhookAlreadyExists {
+		t.Errorf("expected adding webhook with the url of another webhook to fail, got %v", err)
+	}
+	if err := webhooks.Update(WebhookInfo{ID: 3}); err != ErrWebhookNotFound {
+		t.Errorf("expected updating unknown webhook to fail, got %v", err)
+	}
+
+	if webhook, err = webhooks.SetPaused(1, true); err != nil || !webhook.Paused {
+		t.Fatalf("expected webhook to be paused, got %v (%v)", webhook, err)
+	}
+	webhooks.Dispatch(NewTrackEvent(EventTrackDeleted, TrackMeta{ID: 1}))
+	webhooks.waitForDispatch()
+	if n, _ := session.DB("").C(outboxCollection).Find(bson.M{"webhookID": 1}).Count(); n != 0 {
+		t.Errorf("expected paused webhook not to get events, got %d deliveries", n)
+	}
+	if _, err = webhooks.SetPaused(3, false); err != ErrWebhookNotFound {
+		t.Errorf("expected resuming unknown webhook to fail, got %v", err)
+	}
+}
+
+// Test that deliveries to a host are limited, and that other hosts are not
+// affected
+func TestHostLimiter(t *testing.T) {
+	hosts := newHostLimiter(2)
+	for i, data := range []struct {
+		host    string
+		acquire bool
+		expt    bool
+	}{
+		{"a.com", true, true},
+		{"a.com", true, true},
+		{"a.com", true, false},
+		{"b.com", true, true},
+		{"a.com", false, true},
+		{"a.com", true, true},
+		{"a.com", true, false},
+	} {
+		if !data.acquire {
+			hosts.release(data.host)
+			continue
+		}
+		if got := hosts.acquire(data.host); got != data.expt {
+			t.Errorf("expected acquire %d of '%s' to give %t, got %t", i, data.host, data.expt, got)
+		}
+	}
+}
+
+// Test that triggering webhooks never waits for them to be updated
+func TestWebhooksDBTrigger(t *testing.T) {
+	session := makeTestSession(t)
+	defer session.Close()
+	defer session.DB("").DropDatabase()
+
+	webhooks := NewWebhooksDB(session.Copy(), http.DefaultClient, NewEventBus())
+	for i := 0; i < 100; i++ {
+		webhooks.Append(WebhookInfo{ID: WebhookID(i), URLstr: fmt.Sprintf("http://localhost:1/%d", i), TriggerRate: 1})
+	}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			webhooks.Trigger()
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected triggers to be coalesced without blocking")
+	}
+	if depth := webhooks.QueueDepth(); depth > webhookQueueSize {
+		t.Errorf("expected queue depth to be bounded, got %d", depth)
+	}
+}
+
+// Test that dispatching an event only queues it for the workers, so that the
+// publisher never waits for the webhooks to be found
+func TestWebhooksDBDispatch(t *testing.T) {
+	webhooks := WebhooksDB{queue: make(chan webhookJob, 1), dispatching: &sync.WaitGroup{}, dropped: new(uint64)}
+
+	done := make(chan bool)
+	go func() {
+		webhooks.Dispatch(NewTrackEvent(EventTrackDeleted, TrackMeta{ID: 1}))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected dispatch not to wait for the event to be handled")
+	}
+	if depth := webhooks.QueueDepth(); depth != 1 {
+		t.Errorf("expected event to be queued for the workers, got queue depth %d", depth)
+	}
+}
+
+// Test that events are dropped and counted when the worker queue stays full,
+// instead of being dispatched outside of the workers
+func TestWebhooksDBDispatchOverflow(t *testing.T) {
+	webhookDispatchTimeout = 10 * time.Millisecond
+	defer func() { webhookDispatchTimeout = 100 * time.Millisecond }()
+
+	webhooks := WebhooksDB{queue: make(chan webhookJob, 1), dispatching: &sync.WaitGroup{}, dropped: new(uint64)}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			webhooks.Dispatch(NewTrackEvent(EventTrackDeleted, TrackMeta{ID: TrackID(i)}))
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected dispatch to give up when the queue stays full")
+	}
+	if depth := webhooks.QueueDepth(); depth != 1 {
+		t.Errorf("expected only the first event to be queued, got queue depth %d", depth)
+	}
+	if dropped := webhooks.DroppedEvents(); dropped != 2 {
+		t.Errorf("expected 2 events to be dropped, got %d", dropped)
+	}
+
+	// The queued event is still waited for, but not the dropped ones
+	job := <-webhooks.queue
+	waited := make(chan bool)
+	go func() {
+		webhooks.waitForDispatch()
+		waited <- true
+	}()
+	select {
+	case <-waited:
+		t.Fatalf("expected to wait for the queued event")
+	case <-time.After(10 * time.Millisecond):
+	}
+	job(newOutboxMap())
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatalf("expected not to wait for the dropped events")
+	}
+}
+
+// outboxMap is an in-memory outbox, used to test the state transitions of
+// deliveries without a database
+type outboxMap struct {
+	sync.Mutex
+	webhooks   map[WebhookID]WebhookInfo
+	tracks     []TrackMeta
+	deliveries map[bson.ObjectId]Delivery
+}
+
+// newOutboxMap creates a new outbox without any webhooks, tracks or
+// deliveries
+func newOutboxMap() *outboxMap {
+	return &outboxMap{
+		sync.Mutex{},
+		make(map[WebhookID]WebhookInfo),
+		make([]TrackMeta, 0),
+		make(map[bson.ObjectId]Delivery),
+	}
+}
+
+// appendLog adds an attempt to a log, dropping the oldest attempts when the
+// log is full
+func appendLog(log []Attempt, attempt Attempt) []Attempt {
+	log = append(log, attempt)
+	if len(log) > webhookLogLimit {
+		log = log[len(log)-webhookLogLimit:]
+	}
+	return log
+}
+
+func (store *outboxMap) getWebhook(id WebhookID) (webhook WebhookInfo, err error) {
+	store.Lock()
+	defer store.Unlock()
+	webhook, ok := store.webhooks[id]
+	if !ok {
+		err = ErrWebhookNotFound
+	}
+	return
+}
+
+func (store *outboxMap) eventWebhooks(eventType string) (webhooks []WebhookInfo, err error) {
+	store.Lock()
+	defer store.Unlock()
+	for _, webhook := range store.webhooks {
+		if webhook.Paused || webhook.Pending {
+			continue
+		}
+		for _, t := range webhook.Events {
+			if t == eventType {
+				webhooks = append(webhooks, webhook)
+				break
+			}
+		}
+	}
+	return
+}
+
+func (store *outboxMap) tracksSince(webhook WebhookInfo) (trackMetas []TrackMeta, err error) {
+	store.Lock()
+	defer store.Unlock()
+	for _, meta := range store.tracks {
+		if !meta.Timestamp.After(webhook.LastTriggered) {
+			continue
+		}
+		if webhook.Filter != nil && !webhook.Filter.Matches(meta) {
+			continue
+		}
+		trackMetas = append(trackMetas, meta)
+	}
+	sort.Slice(trackMetas, func(i, j int) bool {
+		return trackMetas[i].Timestamp.Before(trackMetas[j].Timestamp)
+	})
+	return
+}
+
+func (store *outboxMap) advanceLastTriggered(id WebhookID, latest time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+	webhook, ok := store.webhooks[id]
+	if !ok {
+		return ErrWebhookNotFound
+	}
+	if latest.After(webhook.LastTriggered) {
+		webhook.LastTriggered = latest
+		store.webhooks[id] = webhook
+	}
+	return nil
+}
+
+func (store *outboxMap) setPaused(id WebhookID, paused bool) (webhook WebhookInfo, err error) {
+	store.Lock()
+	defer store.Unlock()
+	webhook, ok := store.webhooks[id]
+	if !ok {
+		err = ErrWebhookNotFound
+		return
+	}
+	webhook.Paused = paused
+	store.webhooks[id] = webhook
+	return
+}
+
+func (store *outboxMap) addDelivery(delivery Delivery) error {
+	store.Lock()
+	defer store.Unlock()
+	store.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (store *outboxMap) putUpdate(delivery Delivery) error {
+	store.Lock()
+	defer store.Unlock()
+	for id, pending := range store.deliveries {
+		if pending.WebhookID == delivery.WebhookID &&
+			(pending.Event == "" || pending.Event == WebhookEventNewTrack) &&
+			pending.State == DeliveryPending && !pending.Redelivery {
+			pending.Payload = delivery.Payload
+			pending.Latest = delivery.Latest
+			store.deliveries[id] = pending
+			return nil
+		}
+	}
+	store.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (store *outboxMap) getDelivery(webhookID WebhookID, id bson.ObjectId) (delivery Delivery, err error) {
+	store.Lock()
+	defer store.Unlock()
+	delivery, ok := store.deliveries[id]
+	if !ok || delivery.WebhookID != webhookID {
+		err = ErrDeliveryNotFound
+	}
+	return
+}
+
+func (store *outboxMap) dueDeliveries(now time.Time) (due []Delivery, err error) {
+	store.Lock()
+	defer store.Unlock()
+	for _, delivery := range store.deliveries {
+		if delivery.State == DeliveryPending && !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	return
+}
+
+func (store *outboxMap) claimDelivery(delivery Delivery, until time.Time) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	current, ok := store.deliveries[delivery.ID]
+	if !ok || current.State != DeliveryPending || !current.NextAttempt.Equal(delivery.NextAttempt) {
+		return false, nil
+	}
+	current.NextAttempt = until
+	store.deliveries[delivery.ID] = current
+	return true, nil
+}
+
+func (store *outboxMap) releaseDelivery(id bson.ObjectId, at time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+	if delivery, ok := store.deliveries[id]; ok && delivery.State == DeliveryPending {
+		delivery.NextAttempt = at
+		store.deliveries[id] = delivery
+	}
+	return nil
+}
+
+func (store *outboxMap) releaseDeliveries(webhookID WebhookID, at time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+	for id, delivery := range store.deliveries {
+		if delivery.WebhookID == webhookID && delivery.State == DeliveryPending {
+			delivery.NextAttempt = at
+			store.deliveries[id] = delivery
+		}
+	}
+	return nil
+}
+
+func (store *outboxMap) removeDelivery(id bson.ObjectId) error {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.deliveries, id)
+	return nil
+}
+
+func (store *outboxMap) recordFailure(delivery Delivery, attempt Attempt) error {
+	store.Lock()
+	defer store.Unlock()
+	current, ok := store.deliveries[delivery.ID]
+	if !ok {
+		return ErrDeliveryNotFound
+	}
+	current.State = delivery.State
+	current.Attempts = delivery.Attempts
+	current.NextAttempt = delivery.NextAttempt
+	current.LastError = delivery.LastError
+	current.Log = appendLog(current.Log, attempt)
+	store.deliveries[delivery.ID] = current
+	return nil
+}
+
+func (store *outboxMap) markDelivered(delivery Delivery, attempt Attempt) (bool, error) {
+	store.Lock()
+	defer store.Unlock()
+	current, ok := store.deliveries[delivery.ID]
+	if !ok || !current.Latest.Equal(delivery.Latest) {
+		return false, nil
+	}
+	current.State = DeliveryDelivered
+	current.Log = appendLog(current.Log, attempt)
+	store.deliveries[delivery.ID] = current
+	return true, nil
+}
+
+func (store *outboxMap) restartDelivery(id bson.ObjectId, attempt Attempt, at time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+	if delivery, ok := store.deliveries[id]; ok {
+		delivery.Attempts = 0
+		delivery.NextAttempt = at
+		delivery.Log = appendLog(delivery.Log, attempt)
+		store.deliveries[id] = delivery
+	}
+	return nil
+}
+
+func (store *outboxMap) reviveDelivery(webhookID WebhookID, id bson.ObjectId, at time.Time) (delivery Delivery, err error) {
+	store.Lock()
+	defer store.Unlock()
+	delivery, ok := store.deliveries[id]
+	if !ok || delivery.WebhookID != webhookID || delivery.State != DeliveryDead {
+		return Delivery{}, ErrDeliveryNotFound
+	}
+	delivery.State = DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttempt = at
+	store.deliveries[id] = delivery
+	return
+}
+
+// delivery fetches the current state of a delivery in the outbox
+func (store *outboxMap) delivery(t *testing.T, id bson.ObjectId) Delivery {
+	store.Lock()
+	defer store.Unlock()
+	delivery, ok := store.deliveries[id]
+	if !ok {
+		t.Fatalf("expected delivery '%s' to be in the outbox", id.Hex())
+	}
+	return delivery
+}
+
+// makeOutboxTestData creates an outbox with a single webhook pointing at the
+// receiver and a pending update to it
+func makeOutboxTestData(receiver *httptest.Server) (*outboxMap, WebhookInfo, Delivery) {
+	store := newOutboxMap()
+	webhook := WebhookInfo{ID: 1, URLstr: receiver.URL, TriggerRate: 1}
+	store.webhooks[webhook.ID] = webhook
+	delivery := NewDelivery(webhook.ID, []byte("{}"), time.Now().Add(-time.Minute).Truncate(time.Millisecond))
+	store.deliveries[delivery.ID] = delivery
+	return store, webhook, delivery
+}
+
+// Test that a successful delivery advances the last triggered timestamp of
+// the webhook, while failed deliveries are retried until they become dead
+// letters
+func TestAttemptDelivery(t *testing.T) {
+	status := http.StatusOK
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	events := NewEventBus()
+	failed := events.Subscribe()
+	defer events.Unsubscribe(failed)
+	hosts := newHostLimiter(webhookHostConcurrency)
+
+	for _, data := range []struct {
+		status    int
+		attempts  int
+		exptState string
+		exptCount int
+	}{
+		{http.StatusOK, 0, DeliveryDelivered, 0},
+		{http.StatusServiceUnavailable, 0, DeliveryPending, 1},
+		{http.StatusServiceUnavailable, webhookMaxAttempts - 1, DeliveryDead, webhookMaxAttempts},
+		{http.StatusBadRequest, 0, DeliveryDead, 1},
+	} {
+		status = data.status
+		store, webhook, delivery := makeOutboxTestData(receiver)
+		delivery.Attempts = data.attempts
+		store.deliveries[delivery.ID] = delivery
+
+		attemptDelivery(store, hosts, receiver.Client(), events, delivery)
+
+		got := store.delivery(t, delivery.ID)
+		if got.State != data.exptState || got.Attempts != data.exptCount || len(got.Log) != 1 {
+			t.Errorf("expected status %d to give state '%s' after %d attempts, got %v", data.status, data.exptState, data.exptCount, got)
+		}
+		webhook, _ = store.getWebhook(webhook.ID)
+		if succeeded := data.status == http.StatusOK; webhook.LastTriggered.Equal(delivery.Latest) != succeeded {
+			t.Errorf("expected last triggered to advance only after success, got '%s' with status %d", webhook.LastTriggered, data.status)
+		}
+		if data.exptState == DeliveryPending && !got.NextAttempt.After(delivery.NextAttempt) {
+			t.Errorf("expected retry to be postponed, got next attempt '%s'", got.NextAttempt)
+		}
+		if data.status != http.StatusOK {
+			select {
+			case event := <-failed:
+				if event.Type != EventWebhookDeliveryFailed || event.WebhookID != webhook.ID {
+					t.Errorf("expected delivery failed event, got %v", event)
+				}
+			default:
+				t.Errorf("expected delivery failed event after status %d", data.status)
+			}
+		}
+	}
+}
+
+// Test that a delivery which was replaced with newer tracks while it was sent
+// is attempted again instead of being marked as delivered
+func TestAttemptDeliveryReplaced(t *testing.T) {
+	var store *outboxMap
+	var webhook WebhookInfo
+	latest := time.Now().Truncate(time.Millisecond)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store.putUpdate(NewDelivery(webhook.ID, []byte("{\"tracks\":[2]}"), latest))
+	}))
+	defer receiver.Close()
+
+	store, webhook, delivery := makeOutboxTestData(receiver)
+	attemptDelivery(store, newHostLimiter(1), receiver.Client(), NewEventBus(), delivery)
+
+	got := store.delivery(t, delivery.ID)
+	if got.State != DeliveryPending || got.Attempts != 0 || !got.Latest.Equal(latest) || len(got.Log) != 1 {
+		t.Errorf("expected replaced delivery to be pending with the new tracks, got %v", got)
+	}
+	if got.NextAttempt.After(time.Now()) {
+		t.Errorf("expected replaced delivery to be due right away, got '%s'", got.NextAttempt)
+	}
+	if webhook, _ = store.getWebhook(webhook.ID); !webhook.LastTriggered.Equal(delivery.Latest) {
+		t.Errorf("expected last triggered to advance to the sent tracks, got '%s'", webhook.LastTriggered)
+	}
+}
+
+// Test that only due deliveries are claimed and queued, that a claimed
+// delivery is not claimed again and that a full queue is left for later
+func TestDeliverOutbox(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	defer receiver.Close()
+
+	store, _, delivery := makeOutboxTestData(receiver)
+	later := NewDelivery(delivery.WebhookID, []byte("{}"), time.Now())
+	later.NextAttempt = time.Now().Add(time.Hour)
+	store.deliveries[later.ID] = later
+
+	queue := make(chan webhookJob, 1)
+	deliverOutbox(store, queue, newHostLimiter(1), receiver.Client(), NewEventBus())
+	if len(queue) != 1 {
+		t.Fatalf("expected only the due delivery to be queued, got %d", len(queue))
+	}
+	if got := store.delivery(t, delivery.ID); !got.NextAttempt.After(time.Now()) {
+		t.Errorf("expected queued delivery to be claimed, got next attempt '%s'", got.NextAttempt)
+	}
+	if claimed, _ := store.claimDelivery(delivery, time.Now()); claimed {
+		t.Errorf("expected claimed delivery not to be claimed again")
+	}
+
+	// The queue is full, so the released delivery is not claimed
+	store.releaseDelivery(delivery.ID, time.Now())
+	deliverOutbox(store, queue, newHostLimiter(1), receiver.Client(), NewEventBus())
+	if got := store.delivery(t, delivery.ID); got.NextAttempt.After(time.Now()) {
+		t.Errorf("expected delivery not to be claimed while the queue is full, got next attempt '%s'", got.NextAttempt)
+	}
+}
+
+// Test that a delivery to a host which already has too many deliveries is
+// postponed without being attempted
+func TestAttemptDeliveryHostLimit(t *testing.T) {
+	received := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer receiver.Close()
+
+	store, _, delivery := makeOutboxTestData(receiver)
+	claimed := time.Now().Add(webhookClaimTimeout)
+	store.claimDelivery(delivery, claimed)
+
+	hosts := newHostLimiter(1)
+	host := receiver.Listener.Addr().String()
+	hosts.acquire(host)
+	attemptDelivery(store, hosts, receiver.Client(), NewEventBus(), store.delivery(t, delivery.ID))
+
+	got := store.delivery(t, delivery.ID)
+	if received != 0 || got.Attempts != 0 || len(got.Log) != 0 {
+		t.Errorf("expected postponed delivery not to be attempted, got %v", got)
+	}
+	if !got.NextAttempt.Before(claimed) {
+		t.Errorf("expected claim of postponed delivery to be released, got next attempt '%s'", got.NextAttempt)
+	}
+
+	hosts.release(host)
+	attemptDelivery(store, hosts, receiver.Client(), NewEventBus(), got)
+	if got = store.delivery(t, delivery.ID); received != 1 || got.State != DeliveryDelivered {
+		t.Errorf("expected delivery once the host is free, got %v", got)
+	}
+}
+
+// Test that deliveries to a paused webhook stay claimed without being
+// attempted, and are released when it is resumed
+func TestAttemptDeliveryPaused(t *testing.T) {
+	received := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer receiver.Close()
+
+	store, webhook, delivery := makeOutboxTestData(receiver)
+	if _, err := setWebhookPaused(store, webhook.ID, true); err != nil {
+		t.Fatalf("unable to pause webhook: %s", err)
+	}
+	claimed := time.Now().Add(webhookClaimTimeout)
+	store.claimDelivery(delivery, claimed)
+	attemptDelivery(store, newHostLimiter(1), receiver.Client(), NewEventBus(), store.delivery(t, delivery.ID))
+
+	got := store.delivery(t, delivery.ID)
+	if received != 0 || got.Attempts != 0 || !got.NextAttempt.Equal(claimed) {
+		t.Errorf("expected delivery to paused webhook to stay claimed, got %v", got)
+	}
+
+	if webhook, err := setWebhookPaused(store, webhook.ID, false); err != nil || webhook.Paused {
+		t.Fatalf("expected webhook to be resumed, got %v (%v)", webhook, err)
+	}
+	if got = store.delivery(t, delivery.ID); got.NextAttempt.After(time.Now()) {
+		t.Errorf("expected claim to be released when the webhook is resumed, got next attempt '%s'", got.NextAttempt)
+	}
+	if _, err := setWebhookPaused(store, 2, false); err != ErrWebhookNotFound {
+		t.Errorf("expected resuming unknown webhook to fail, got %v", err)
+	}
+}
+
+// Test that deliveries of deleted webhooks are removed from the outbox
+func TestAttemptDeliveryDeleted(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	defer receiver.Close()
+
+	store, webhook, delivery := makeOutboxTestData(receiver)
+	delete(store.webhooks, webhook.ID)
+	attemptDelivery(store, newHostLimiter(1), receiver.Client(), NewEventBus(), delivery)
+	if _, err := store.getDelivery(webhook.ID, delivery.ID); err != ErrDeliveryNotFound {
+		t.Errorf("expected delivery of deleted webhook to be removed, got %v", err)
+	}
+}
+
+// Test that a dead letter is moved back to the outbox, while other deliveries
+// are sent again as new deliveries
+func TestRedeliver(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	defer receiver.Close()
+
+	store, webhook, dead := makeOutboxTestData(receiver)
+	dead.State = DeliveryDead
+	dead.Attempts = webhookMaxAttempts
+	dead.NextAttempt = time.Now().Add(time.Hour)
+	store.deliveries[dead.ID] = dead
+
+	revived, err := redeliver(store, webhook.ID, dead.ID)
+	if err != nil {
+		t.Fatalf("unable to redeliver dead letter: %s", err)
+	}
+	if revived.ID != dead.ID || revived.State != DeliveryPending || revived.Attempts != 0 || revived.NextAttempt.After(time.Now()) {
+		t.Errorf("expected dead letter to be due again, got %v", revived)
+	}
+
+	delivered := store.delivery(t, dead.ID)
+	delivered.State = DeliveryDelivered
+	store.deliveries[delivered.ID] = delivered
+	redelivery, err := redeliver(store, webhook.ID, delivered.ID)
+	if err != nil {
+		t.Fatalf("unable to redeliver delivery: %s", err)
+	}
+	if redelivery.ID == delivered.ID || !redelivery.Redelivery || redelivery.Payload != delivered.Payload {
+		t.Errorf("expected a new delivery with the same payload, got %v", redelivery)
+	}
+	if got := store.delivery(t, redelivery.ID); got.State != DeliveryPending {
+		t.Errorf("expected redelivery to be pending, got %v", got)
+	}
+
+	if _, err := redeliver(store, webhook.ID, bson.NewObjectId()); err != ErrDeliveryNotFound {
+		t.Errorf("expected redelivering unknown delivery to fail, got %v", err)
+	}
+	if _, err := redeliver(store, 2, dead.ID); err != ErrWebhookNotFound {
+		t.Errorf("expected redelivering to unknown webhook to fail, got %v", err)
+	}
+}
+
+// Test that an update is only added when a webhook is due, and that it
+// replaces the pending update instead of adding another one
+func TestUpdateWebhook(t *testing.T) {
+	store := newOutboxMap()
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		store.tracks = append(store.tracks, TrackMeta{ID: TrackID(i + 1), Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+	webhook := WebhookInfo{ID: 1, TriggerRate: 4, Format: WebhookFormatJSON}
+	store.webhooks[webhook.ID] = webhook
+
+	updateWebhook(store, webhook)
+	if len(store.deliveries) != 0 {
+		t.Fatalf("expected no update before the trigger value is reached, got %v", store.deliveries)
+	}
+
+	webhook.TriggerRate = 2
+	store.tracks = store.tracks[:2]
+	updateWebhook(store, webhook)
+	store.tracks = append(store.tracks, TrackMeta{ID: 3, Timestamp: start.Add(2 * time.Second)})
+	updateWebhook(store, webhook)
+	if len(store.deliveries) != 1 {
+		t.Fatalf("expected pending update to be replaced, got %v", store.deliveries)
+	}
+	for _, delivery := range store.deliveries {
+		var msg WebhookEventMsg
+		json.Unmarshal([]byte(delivery.Payload), &msg)
+		if len(msg.Tracks) != 3 || !delivery.Latest.Equal(start.Add(2*time.Second)) {
+			t.Errorf("expected update to contain all new tracks, got %v", msg)
+		}
+	}
+}
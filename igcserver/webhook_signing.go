@@ -0,0 +1,104 @@
+package igcserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// WebhookSignatureHeader is the header containing the signature of a
+	// webhook delivery, formatted as `sha256=<hex encoded hmac>`
+	WebhookSignatureHeader = "X-Paragliding-Signature"
+
+	// WebhookTimestampHeader is the header containing the unix timestamp of
+	// when a webhook delivery was signed
+	WebhookTimestampHeader = "X-Paragliding-Timestamp"
+
+	// WebhookSecretHeader is the header used to return a generated secret
+	// when a webhook is registered
+	WebhookSecretHeader = "X-Paragliding-Secret"
+
+	// DefaultSignatureTolerance is the recommended maximum age of a signed
+	// delivery before it is rejected as a replay
+	DefaultSignatureTolerance = 5 * time.Minute
+
+	// webhookSecretSize is the number of random bytes in a generated secret
+	webhookSecretSize = 32
+)
+
+var (
+	// ErrInvalidSignature is returned if the signature of a delivery does not
+	// match its body
+	ErrInvalidSignature = errors.New("invalid signature")
+
+	// ErrSignatureExpired is returned if the timestamp of a delivery is
+	// outside of the tolerance, which can indicate a replay
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+// NewWebhookSecret generates a random hex encoded secret
+func NewWebhookSecret() (string, error) {
+	buf := make([]byte, webhookSecretSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// SignWebhookPayload signs the timestamp and body of a delivery using the
+// secret of the webhook. The timestamp is included so that a captured
+// delivery cannot be replayed later.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature verifies the signature and timestamp headers of a
+// delivery against the body, rejecting deliveries signed longer than the
+// tolerance ago
+func VerifyWebhookSignature(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	signature := header.Get(WebhookSignatureHeader)
+	if !strings.HasPrefix(signature, "sha256=") {
+		return ErrInvalidSignature
+	}
+	expt := SignWebhookPayload(secret, timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expt)) {
+		return ErrInvalidSignature
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+// newWebhookRequest creates a json post request to the webhook, which is
+// signed if the webhook has a secret
+func newWebhookRequest(webhook WebhookInfo, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", webhook.URLstr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhook.Secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(webhook.Secret, timestamp, body))
+	}
+	return req, nil
+}
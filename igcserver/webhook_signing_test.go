@@ -0,0 +1,106 @@
+package igcserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Test that signatures are verified and that tampered or old deliveries are
+// rejected
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte("{\"content\":\"hello\"}")
+	now := time.Now().Unix()
+	signed := func(secret string, timestamp int64) http.Header {
+		header := http.Header{}
+		header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+		header.Set(WebhookSignatureHeader, SignWebhookPayload(secret, timestamp, body))
+		return header
+	}
+	tampered := signed("secret", now)
+	tampered.Set(WebhookTimestampHeader, strconv.FormatInt(now+1, 10))
+
+	for _, data := range []struct {
+		name   string
+		header http.Header
+		body   []byte
+		expt   error
+	}{
+		{"valid", signed("secret", now), body, nil},
+		{"wrong secret", signed("other", now), body, ErrInvalidSignature},
+		{"tampered body", signed("secret", now), []byte("{}"), ErrInvalidSignature},
+		{"tampered timestamp", tampered, body, ErrInvalidSignature},
+		{"replayed", signed("secret", now-3600), body, ErrSignatureExpired},
+		{"missing headers", http.Header{}, body, ErrInvalidSignature},
+	} {
+		if err := VerifyWebhookSignature("secret", data.header, data.body, DefaultSignatureTolerance); err != data.expt {
+			t.Errorf("expected %s delivery to give '%v', got '%v'", data.name, data.expt, err)
+		}
+	}
+}
+
+// Test that deliveries to webhooks with a secret are signed
+func TestNewWebhookRequest(t *testing.T) {
+	body := []byte("{\"content\":\"hello\"}")
+
+	req, err := newWebhookRequest(WebhookInfo{URLstr: "http://example.com", Secret: "secret"}, body)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	got, _ := ioutil.ReadAll(req.Body)
+	if !bytes.Equal(got, body) {
+		t.Errorf("expected body '%s', got '%s'", body, got)
+	}
+	if err := VerifyWebhookSignature("secret", req.Header, body, DefaultSignatureTolerance); err != nil {
+		t.Errorf("expected request to be signed, got '%s'", err)
+	}
+
+	req, err = newWebhookRequest(WebhookInfo{URLstr: "http://example.com"}, body)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	if req.Header.Get(WebhookSignatureHeader) != "" {
+		t.Errorf("expected request to webhook without secret to be unsigned")
+	}
+}
+
+// Test that a secret is generated and returned once if not given when
+// registering a webhook
+func TestRegWebhookSecret(t *testing.T) {
+	webhooksMap := NewWebhooksMap()
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
+
+	register := func(body string) (WebhookInfo, string) {
+		req := httptest.NewRequest("POST", "/webhook/new_track", bytes.NewReader([]byte(body)))
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != 200 {
+			t.Fatalf("expected `POST /webhook/new_track` to return 200, got '%d'", code)
+		}
+		id, err := strconv.Atoi(res.Body.String())
+		if err != nil {
+			t.Fatalf("unable to decode response as integer")
+		}
+		webhook, err := webhooksMap.Get(WebhookID(id))
+		if err != nil {
+			t.Fatalf("unable to get registered webhook: %s", err)
+		}
+		return webhook, res.Header().Get(WebhookSecretHeader)
+	}
+
+	webhook, secret := register("{\"webhookURL\":\"http://generated.com\"}")
+	if secret == "" || webhook.Secret != secret {
+		t.Errorf("expected generated secret '%s' to be returned, got '%s'", webhook.Secret, secret)
+	}
+
+	webhook, secret = register("{\"webhookURL\":\"http://given.com\",\"secret\":\"hunter2\"}")
+	if secret != "" || webhook.Secret != "hunter2" {
+		t.Errorf("expected given secret to be stored and not returned, got '%s' and '%s'", webhook.Secret, secret)
+	}
+}
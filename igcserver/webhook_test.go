@@ -1,9 +1,18 @@
 package igcserver
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/globalsign/mgo/bson"
+	"github.com/google/go-cmp/cmp"
 	"math/rand"
+	"net/http/httptest"
+	"sort"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 // Test that all returned ids from 'Append' are found when using 'Get'
@@ -34,7 +43,8 @@ func TestWebhooksGetConcurr(t *testing.T) {
 	for i := 0; i < hookCount; i++ {
 		rand.Read(buf)
 		pureHooks[i] = WebhookInfo{
-			ID: NewWebhookID(buf),
+			ID:     NewWebhookID(buf),
+			URLstr: fmt.Sprintf("http://a.com/%d", i),
 		}
 	}
 
@@ -70,7 +80,8 @@ func TestWebhookDeletion(t *testing.T) {
 	for i := 0; i < hookCount; i++ {
 		rand.Read(buf)
 		pureHooks[i] = WebhookInfo{
-			ID: NewWebhookID(buf),
+			ID:     NewWebhookID(buf),
+			URLstr: fmt.Sprintf("http://a.com/%d", i),
 		}
 	}
 
@@ -103,26 +114,343 @@ func TestWebhookDeletionOfNonexisting(t *testing.T) {
 	}
 }
 
+// Test that webhooks only receive the event types they are registered for
+func TestWebhookEvents(t *testing.T) {
+	server, fileserver := makeTestServers()
+	defer fileserver.Close()
+	webhooks := server.webhooks.(*WebhooksMap)
+
+	do := func(method, path, body string, exptCode int) string {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+testWebhookToken)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != exptCode {
+			t.Fatalf("expected `%s %s` to return %d, got '%d'", method, path, exptCode, code)
+		}
+		return res.Body.String()
+	}
+	deliveries := func(idStr string) (events []string) {
+		id, _ := strconv.Atoi(idStr)
+		deliveries, _ := webhooks.Deliveries(WebhookID(id), "")
+		for _, delivery := range deliveries {
+			events = append(events, delivery.Event)
+		}
+		sort.Strings(events)
+		return
+	}
+
+	do("POST", "/webhook/new_track", "{\"webhookURL\":\"http://a.com\",\"events\":[\"landed\"]}", 400)
+	failures := do("POST", "/webhook/new_track", "{\"webhookURL\":\"http://a.com\",\"events\":[\"track_ingestion_failed\"]}", 200)
+	bests := do("POST", "/webhook/new_track", "{\"webhookURL\":\"http://b.com\",\"events\":[\"personal_best\",\"track_deleted\"]}", 200)
+	tracks := do("POST", "/webhook/new_track", "{\"webhookURL\":\"http://c.com\"}", 200)
+	changes := do("POST", "/webhook/new_track", "{\"webhookURL\":\"http://d.com\",\"events\":[\"track_refreshed\",\"leaderboard_change\"]}", 200)
+
+	do("POST", "/track", fmt.Sprintf("{\"url\":\"%s\"}", fileserver.URL+"/invalid.igc"), 400)
+	body := do("POST", "/track", fmt.Sprintf("{\"url\":\"%s\"}", fileserver.URL+"/test.igc"), 200)
+	var track map[string]TrackID
+	json.Unmarshal([]byte(body), &track)
+	do("POST", fmt.Sprintf("/track/%d/refresh", track["id"]), "", 200)
+	do("DELETE", fmt.Sprintf("/track/%d", track["id"]), "", 200)
+
+	for _, data := range []struct {
+		id   string
+		expt []string
+	}{
+		{failures, []string{EventTrackIngestionFailed}},
+		{bests, []string{EventPersonalBest, EventTrackDeleted}},
+		{tracks, nil},
+		{changes, []string{EventLeaderboardChange, EventTrackRefreshed}},
+	} {
+		if got := deliveries(data.id); !cmp.Equal(got, data.expt) {
+			t.Errorf("expected webhook '%s' to get events %v, got %v", data.id, data.expt, got)
+		}
+	}
+}
+
+// Test that filters of webhooks are validated when registering
+func TestRegWebhookFilter(t *testing.T) {
+	webhooksMap := NewWebhooksMap()
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
+
+	for _, data := range []struct {
+		filter string
+		expt   int
+	}{
+		{"{\"pilot\":\"John Normal\",\"min_length\":50}", 200},
+		{"{\"site\":{\"lat\":60,\"lng\":10,\"radius\":5},\"date_from\":\"2018-06-01T00:00:00Z\"}", 200},
+		{"{\"min_length\":50,\"max_length\":10}", 400},
+		{"{\"site\":{\"lat\":100,\"lng\":10,\"radius\":5}}", 400},
+		{"{\"date_from\":\"2018-06-02T00:00:00Z\",\"date_to\":\"2018-06-01T00:00:00Z\"}", 400},
+		{"{\"pilots\":[]}", 400},
+	} {
+		body := fmt.Sprintf("{\"webhookURL\":\"http://%d.com\",\"filter\":%s}", rand.Int(), data.filter)
+		req := httptest.NewRequest("POST", "/webhook/new_track", bytes.NewReader([]byte(body)))
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != data.expt {
+			t.Errorf("expected filter '%s' to give '%d', got '%d'", data.filter, data.expt, code)
+		}
+	}
+}
+
+// Test that webhooks are due after enough tracks or when the oldest track
+// has waited for the max delay
+func TestWebhookDue(t *testing.T) {
+	now := time.Now()
+	pending := func(ages ...time.Duration) (metas []TrackMeta) {
+		for i, age := range ages {
+			metas = append(metas, TrackMeta{ID: TrackID(i), Timestamp: now.Add(-age)})
+		}
+		return
+	}
+
+	for i, data := range []struct {
+		webhook WebhookInfo
+		pending []TrackMeta
+		expt    bool
+	}{
+		{WebhookInfo{TriggerRate: 2}, pending(), false},
+		{WebhookInfo{TriggerRate: 2}, pending(time.Hour), false},
+		{WebhookInfo{TriggerRate: 2}, pending(time.Hour, time.Minute), true},
+		{WebhookInfo{TriggerRate: 2, MaxDelay: "PT1H"}, pending(), false},
+		{WebhookInfo{TriggerRate: 2, MaxDelay: "PT1H"}, pending(time.Minute), false},
+		{WebhookInfo{TriggerRate: 2, MaxDelay: "PT1H"}, pending(time.Hour), true},
+		{WebhookInfo{TriggerRate: 5, MaxDelay: "P1D"}, pending(25*time.Hour, time.Minute), true},
+	} {
+		if got := data.webhook.Due(data.pending, now); got != data.expt {
+			t.Errorf("expected case %d to give %t, got %t", i, data.expt, got)
+		}
+	}
+}
+
+// Test that the max delay of webhooks is validated when registering
+func TestRegWebhookMaxDelay(t *testing.T) {
+	webhooksMap := NewWebhooksMap()
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
+
+	for _, data := range []struct {
+		maxDelay string
+		expt     int
+	}{
+		{"PT30M", 200},
+		{"P1W", 200},
+		{"P1DT12H", 200},
+		{"PT0S", 400},
+		{"30m", 400},
+		{"P1H", 400},
+	} {
+		body := fmt.Sprintf("{\"webhookURL\":\"http://%d.com\",\"maxDelay\":\"%s\"}", rand.Int(), data.maxDelay)
+		req := httptest.NewRequest("POST", "/webhook/new_track", bytes.NewReader([]byte(body)))
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != data.expt {
+			t.Errorf("expected max delay '%s' to give '%d', got '%d'", data.maxDelay, data.expt, code)
+		}
+	}
+}
+
+// Test that webhooks are listed for their owner, and that they can be
+// updated, paused and resumed
+func TestWebhookManagement(t *testing.T) {
+	webhooksMap := NewWebhooksMap()
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
+
+	do := func(method, path, token, body string, exptCode int) string {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != exptCode {
+			t.Fatalf("expected `%s %s` to return %d, got '%d'", method, path, exptCode, code)
+		}
+		return res.Body.String()
+	}
+	list := func(token string) (ids []WebhookID) {
+		json.Unmarshal([]byte(do("GET", "/webhook/new_track", token, "", 200)), &ids)
+		return
+	}
+
+	a := do("POST", "/webhook/new_track", "alice", "{\"webhookURL\":\"http://a.com\"}", 200)
+	do("POST", "/webhook/new_track", "bob", "{\"webhookURL\":\"http://b.com\"}", 200)
+	do("POST", "/webhook/new_track", "", "{\"webhookURL\":\"http://c.com\"}", 200)
+
+	id, _ := strconv.Atoi(a)
+	if got := list("alice"); !cmp.Equal(got, []WebhookID{WebhookID(id)}) {
+		t.Errorf("expected only the webhook of the caller to be listed, got %v", got)
+	}
+	if got := list("eve"); len(got) != 0 {
+		t.Errorf("expected no webhooks of unknown caller, got %v", got)
+	}
+	do("GET", "/webhook/new_track", "", "", 401)
+
+	path := "/webhook/new_track/" + a
+	body := "{\"webhookURL\":\"http://d.com\",\"minTriggerValue\":3,\"filter\":{\"pilot\":\"John Normal\"}}"
+	do("PATCH", path, "alice", body, 200)
+	webhook, _ := webhooksMap.Get(WebhookID(id))
+	if webhook.URLstr != "http://d.com" || webhook.TriggerRate != 3 || webhook.Filter == nil || webhook.Filter.Pilot != "John Normal" {
+		t.Errorf("expected webhook to be updated, got %v", webhook)
+	}
+	// The url of a webhook can not be changed to the url of another webhook,
+	// and the old url can be registered again
+	do("PATCH", path, "alice", "{\"webhookURL\":\"http://b.com\"}", 403)
+	do("POST", "/webhook/new_track", "alice", "{\"webhookURL\":\"http://d.com\"}", 403)
+	do("POST", "/webhook/new_track", "alice", "{\"webhookURL\":\"http://a.com\"}", 200)
+	do("PATCH", path, "alice", "{\"filter\":{}}", 200)
+	webhook, _ = webhooksMap.Get(WebhookID(id))
+	if webhook.Filter != nil || webhook.TriggerRate != 3 {
+		t.Errorf("expected only the filter to be removed, got %v", webhook)
+	}
+	do("PATCH", path, "alice", "{\"minTriggerValue\":0}", 400)
+	do("PATCH", path, "alice", "{\"events\":[]}", 400)
+	do("PATCH", "/webhook/new_track/1", "alice", "{}", 404)
+
+	do("POST", path+"/pause", "alice", "", 200)
+	if webhook, _ = webhooksMap.Get(WebhookID(id)); !webhook.Paused {
+		t.Errorf("expected webhook to be paused")
+	}
+	do("POST", path+"/resume", "alice", "", 200)
+	if webhook, _ = webhooksMap.Get(WebhookID(id)); webhook.Paused {
+		t.Errorf("expected webhook to be resumed")
+	}
+	do("POST", "/webhook/new_track/1/pause", "alice", "", 404)
+}
+
+// Test that webhooks can only be managed with the token returned when they
+// were registered, and that only a hash of the token is stored
+func TestWebhookToken(t *testing.T) {
+	webhooksMap := NewWebhooksMap()
+	server := NewServer(nil, nil, nil, &webhooksMap, nil, nil)
+
+	do := func(method, path, token string, exptCode int) *httptest.ResponseRecorder {
+		body := bytes.NewReader([]byte("{\"webhookURL\":\"http://a.com\"}"))
+		req := httptest.NewRequest(method, path, body)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != exptCode {
+			t.Fatalf("expected `%s %s` to return %d, got '%d'", method, path, exptCode, code)
+		}
+		return res
+	}
+
+	res := do("POST", "/webhook/new_track", "", 200)
+	token := res.Header().Get(TokenHeader)
+	if token == "" {
+		t.Fatalf("expected a management token to be returned")
+	}
+	id, _ := strconv.Atoi(res.Body.String())
+	if webhook, _ := webhooksMap.Get(WebhookID(id)); webhook.Owner != hashToken(token) {
+		t.Errorf("expected only the hash of the token to be stored, got '%s'", webhook.Owner)
+	}
+
+	path := "/webhook/new_track/" + res.Body.String()
+	for _, method := range []string{"GET", "PATCH", "DELETE"} {
+		do(method, path, "", 401)
+		do(method, path, "wrong", 404)
+	}
+	do("POST", path+"/pause", "wrong", 404)
+	do("GET", path+"/deliveries", "wrong", 404)
+	do("GET", path, token, 200)
+	do("DELETE", path, token, 200)
+	do("GET", path, token, 404)
+}
+
+// Test that a track is only a personal best if no other track of the pilot
+// is at least as long
+func TestIsPersonalBest(t *testing.T) {
+	tracks := NewTrackMetasMap()
+	server := NewServer(nil, &tracks, nil, nil, nil, nil)
+
+	for _, meta := range []TrackMeta{
+		{ID: 1, Pilot: "John Normal", TrackLength: 10},
+		{ID: 2, Pilot: "John Normal", TrackLength: 20},
+		{ID: 3, Pilot: "Aladin Special", TrackLength: 30},
+	} {
+		tracks.Append(meta)
+	}
+	for _, data := range []struct {
+		meta TrackMeta
+		expt bool
+	}{
+		{TrackMeta{ID: 4, Pilot: "John Normal", TrackLength: 25}, true},
+		{TrackMeta{ID: 5, Pilot: "john normal", TrackLength: 20}, false},
+		{TrackMeta{ID: 6, Pilot: "John Normal", TrackLength: 15}, false},
+		{TrackMeta{ID: 7, Pilot: "", TrackLength: 100}, false},
+	} {
+		tracks.Append(data.meta)
+		if got := server.isPersonalBest(data.meta); got != data.expt {
+			t.Errorf("expected track of %.0f km by '%s' to give %t, got %t", data.meta.TrackLength, data.meta.Pilot, data.expt, got)
+		}
+		tracks.Delete(data.meta.ID)
+	}
+}
+
 // WebhooksMap contains a map to many WebhookInfo objects which are protected
 // by a RWMutex and indexed by a unique id
 type WebhooksMap struct {
 	sync.RWMutex
-	data    map[WebhookID]WebhookInfo
-	trigger chan bool
+	data       map[WebhookID]WebhookInfo
+	deliveries map[bson.ObjectId]Delivery
+	trigger    chan bool
 }
 
 // NewWebhooksMap creates a new mutex and mapping from ID to WebhookInfo
 func NewWebhooksMap() WebhooksMap {
-	trigger := make(chan bool, 3)
-	go func() {
-		<-trigger
-	}()
-	return WebhooksMap{sync.RWMutex{}, make(map[WebhookID]WebhookInfo), trigger}
+	trigger := make(chan bool, 1)
+	return WebhooksMap{
+		sync.RWMutex{},
+		make(map[WebhookID]WebhookInfo),
+		make(map[bson.ObjectId]Delivery),
+		trigger,
+	}
 }
 
-// Trigger returns a channel to trigger webhooks based on the number of tracks
+// Trigger records that webhooks should be checked, coalescing triggers
 func (db *WebhooksMap) Trigger() {
-	db.trigger <- true
+	coalesce(db.trigger)
+}
+
+// QueueDepth returns the number of pending deliveries
+func (db *WebhooksMap) QueueDepth() int {
+	db.RLock()
+	defer db.RUnlock()
+	depth := 0
+	for _, delivery := range db.deliveries {
+		if delivery.State == DeliveryPending {
+			depth++
+		}
+	}
+	return depth
+}
+
+// Dispatch adds a delivery of the event for every webhook registered for it
+func (db *WebhooksMap) Dispatch(event Event) {
+	db.Lock()
+	defer db.Unlock()
+	for _, webhook := range db.data {
+		if webhook.Paused || webhook.Pending || !webhook.Subscribes(event.Type) {
+			continue
+		}
+		if payload, err := formatEventPayload(webhook, event); err == nil {
+			delivery := NewEventDelivery(webhook.ID, payload, event)
+			db.deliveries[delivery.ID] = delivery
+		}
+	}
 }
 
 // Get fetches the webhook of a specific id if it exists
@@ -136,11 +464,23 @@ func (db *WebhooksMap) Get(id WebhookID) (webhook WebhookInfo, err error) {
 	return
 }
 
-// Append appends a webhook and returns the given id
+// urlTaken checks if another webhook than the given id has the url, while
+// the map is locked
+func (db *WebhooksMap) urlTaken(id WebhookID, url string) bool {
+	for _, other := range db.data {
+		if other.ID != id && other.URLstr == url {
+			return true
+		}
+	}
+	return false
+}
+
+// Append appends a webhook, unless a webhook with the same id or url already
+// exists
 func (db *WebhooksMap) Append(webhook WebhookInfo) (err error) {
 	db.Lock()
 	defer db.Unlock()
-	if _, exists := db.data[webhook.ID]; exists {
+	if _, exists := db.data[webhook.ID]; exists || db.urlTaken(webhook.ID, webhook.URLstr) {
 		err = ErrWebhookAlreadyExists
 	} else {
 		db.data[webhook.ID] = webhook
@@ -160,3 +500,114 @@ func (db *WebhooksMap) Delete(id WebhookID) (webhook WebhookInfo, err error) {
 	}
 	return
 }
+
+// List returns all webhooks registered by the owner
+func (db *WebhooksMap) List(owner string) (webhooks []WebhookInfo, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	webhooks = make([]WebhookInfo, 0)
+	for _, webhook := range db.data {
+		if webhook.Owner == owner {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ID < webhooks[j].ID
+	})
+	return
+}
+
+// Update changes the url, trigger value, filter and max delay of a webhook
+func (db *WebhooksMap) Update(webhook WebhookInfo) (err error) {
+	db.Lock()
+	defer db.Unlock()
+	old, ok := db.data[webhook.ID]
+	if !ok {
+		return ErrWebhookNotFound
+	}
+	if db.urlTaken(webhook.ID, webhook.URLstr) {
+		return ErrWebhookAlreadyExists
+	}
+	old.URLstr = webhook.URLstr
+	old.TriggerRate = webhook.TriggerRate
+	old.Filter = webhook.Filter
+	old.MaxDelay = webhook.MaxDelay
+	db.data[webhook.ID] = old
+	return
+}
+
+// SetPaused pauses or resumes a webhook
+func (db *WebhooksMap) SetPaused(id WebhookID, paused bool) (webhook WebhookInfo, err error) {
+	db.Lock()
+	defer db.Unlock()
+	webhook, ok := db.data[id]
+	if !ok {
+		err = ErrWebhookNotFound
+		return
+	}
+	webhook.Paused = paused
+	db.data[id] = webhook
+	return
+}
+
+// Activate marks a pending webhook as verified unless it has expired
+func (db *WebhooksMap) Activate(id WebhookID) (webhook WebhookInfo, err error) {
+	db.Lock()
+	defer db.Unlock()
+	webhook, ok := db.data[id]
+	if !ok || (webhook.Pending && webhook.VerifyBefore.Before(time.Now())) {
+		err = ErrWebhookNotFound
+		return
+	}
+	webhook.Pending = false
+	webhook.VerifyBefore = time.Time{}
+	db.data[id] = webhook
+	return
+}
+
+// Deliveries returns the deliveries to a webhook in a state, or all
+// deliveries if the state is empty, newest first
+func (db *WebhooksMap) Deliveries(id WebhookID, state string) (deliveries []Delivery, err error) {
+	db.RLock()
+	defer db.RUnlock()
+	if _, ok := db.data[id]; !ok {
+		err = ErrWebhookNotFound
+		return
+	}
+	deliveries = make([]Delivery, 0)
+	for _, delivery := range db.deliveries {
+		if delivery.WebhookID == id && (state == "" || delivery.State == state) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Created.After(deliveries[j].Created)
+	})
+	return
+}
+
+// Redeliver moves a dead delivery back to pending, or adds a new delivery
+// with the payload of any other previous delivery
+func (db *WebhooksMap) Redeliver(id WebhookID, deliveryID bson.ObjectId) (redelivery Delivery, err error) {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.data[id]; !ok {
+		err = ErrWebhookNotFound
+		return
+	}
+	delivery, ok := db.deliveries[deliveryID]
+	if !ok || delivery.WebhookID != id {
+		err = ErrDeliveryNotFound
+		return
+	}
+	if delivery.State == DeliveryDead {
+		redelivery = delivery
+		redelivery.State = DeliveryPending
+		redelivery.Attempts = 0
+		redelivery.NextAttempt = time.Now()
+	} else {
+		redelivery = NewRedelivery(delivery)
+	}
+	db.deliveries[redelivery.ID] = redelivery
+	return
+}
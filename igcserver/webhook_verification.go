@@ -0,0 +1,87 @@
+package igcserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// WebhookVerificationType is the type of the message sent to a webhook
+	// to verify it
+	WebhookVerificationType = "verification"
+
+	// webhookChallengeTimeout is how long a webhook has to respond to a
+	// challenge
+	webhookChallengeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrChallengeFailed is returned if a webhook did not echo the challenge
+	// sent to it
+	ErrChallengeFailed = errors.New("webhook did not echo the challenge")
+)
+
+// WebhookVerificationConfig decides if webhooks have to echo a challenge
+// before they are notified, and how long a webhook may be pending before it
+// is removed
+type WebhookVerificationConfig struct {
+	Enabled bool
+	Timeout time.Duration
+}
+
+// DefaultWebhookVerificationConfig is the configuration used by a server
+// unless another configuration is set
+var DefaultWebhookVerificationConfig = WebhookVerificationConfig{
+	Enabled: false,
+	Timeout: time.Hour,
+}
+
+// VerificationMsg is the message sent to a webhook to verify that the
+// receiver wants to be notified
+type VerificationMsg struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+}
+
+// challengeWebhook sends a random challenge to the webhook, which has to
+// respond with the challenge either as the plain body or as the `challenge`
+// field of a json object
+func challengeWebhook(httpClient *http.Client, webhook WebhookInfo) error {
+	challenge, err := NewWebhookSecret()
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(VerificationMsg{WebhookVerificationType, challenge})
+	req, err := newWebhookRequest(webhook, body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookChallengeTimeout)
+	defer cancel()
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	response, err := ioutil.ReadAll(io.LimitReader(res.Body, webhookResponseLimit))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		return ErrChallengeFailed
+	}
+	var echo VerificationMsg
+	if strings.TrimSpace(string(response)) == challenge {
+		return nil
+	} else if json.NewDecoder(bytes.NewReader(response)).Decode(&echo) == nil && echo.Challenge == challenge {
+		return nil
+	}
+	return ErrChallengeFailed
+}
@@ -0,0 +1,126 @@
+package igcserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Test that a webhook is only verified if it echoes the challenge
+func TestChallengeWebhook(t *testing.T) {
+	for _, data := range []struct {
+		name    string
+		respond func(w http.ResponseWriter, msg VerificationMsg)
+		expt    bool
+	}{
+		{"plain", func(w http.ResponseWriter, msg VerificationMsg) {
+			io.WriteString(w, msg.Challenge+"\n")
+		}, true},
+		{"json", func(w http.ResponseWriter, msg VerificationMsg) {
+			json.NewEncoder(w).Encode(msg)
+		}, true},
+		{"wrong", func(w http.ResponseWriter, msg VerificationMsg) {
+			io.WriteString(w, "hello")
+		}, false},
+		{"empty", func(w http.ResponseWriter, msg VerificationMsg) {}, false},
+		{"error", func(w http.ResponseWriter, msg VerificationMsg) {
+			http.Error(w, msg.Challenge, http.StatusInternalServerError)
+		}, false},
+	} {
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var msg VerificationMsg
+			json.NewDecoder(r.Body).Decode(&msg)
+			if msg.Type != WebhookVerificationType || r.Header.Get(WebhookSignatureHeader) == "" {
+				t.Errorf("expected a signed verification message, got %v", msg)
+			}
+			data.respond(w, msg)
+		}))
+
+		err := challengeWebhook(receiver.Client(), WebhookInfo{URLstr: receiver.URL, Secret: "secret"})
+		if data.expt && err != nil {
+			t.Errorf("expected '%s' echo to verify the webhook, got '%s'", data.name, err)
+		} else if !data.expt && err == nil {
+			t.Errorf("expected '%s' echo not to verify the webhook", data.name)
+		}
+		receiver.Close()
+	}
+}
+
+// Test that webhooks are pending until they have echoed a challenge when
+// verification is enabled, and that new urls are verified
+func TestWebhookVerification(t *testing.T) {
+	echo := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg VerificationMsg
+		json.NewDecoder(r.Body).Decode(&msg)
+		if echo {
+			io.WriteString(w, msg.Challenge)
+		}
+	}))
+	defer receiver.Close()
+
+	webhooksMap := NewWebhooksMap()
+	config := DefaultConfig
+	config.WebhookVerification = WebhookVerificationConfig{Enabled: true, Timeout: time.Hour}
+	server := NewServerWithConfig(receiver.Client(), nil, nil, &webhooksMap, nil, nil, config)
+
+	do := func(method, path, body string, exptCode int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+testWebhookToken)
+		res := httptest.NewRecorder()
+
+		server.ServeHTTP(res, req)
+
+		if code := res.Result().StatusCode; code != exptCode {
+			t.Fatalf("expected `%s %s` to return %d, got '%d'", method, path, exptCode, code)
+		}
+		return res
+	}
+	get := func(idStr string) WebhookInfo {
+		id, _ := strconv.Atoi(idStr)
+		webhook, _ := webhooksMap.Get(WebhookID(id))
+		return webhook
+	}
+
+	verified := do("POST", "/webhook/new_track", "{\"webhookURL\":\""+receiver.URL+"/a\"}", 200).Body.String()
+	if webhook := get(verified); webhook.Pending {
+		t.Errorf("expected webhook which echoed the challenge to be active, got %v", webhook)
+	}
+
+	echo = false
+	body := "{\"webhookURL\":\"" + receiver.URL + "/b\",\"events\":[\"track_deleted\"]}"
+	pending := do("POST", "/webhook/new_track", body, 202).Body.String()
+	webhook := get(pending)
+	if !webhook.Pending || webhook.VerifyBefore.IsZero() {
+		t.Errorf("expected webhook which did not echo the challenge to be pending, got %v", webhook)
+	}
+	webhooksMap.Dispatch(NewTrackEvent(EventTrackDeleted, TrackMeta{ID: 1}))
+	if deliveries, _ := webhooksMap.Deliveries(webhook.ID, ""); len(deliveries) != 0 {
+		t.Errorf("expected pending webhook not to get events, got %v", deliveries)
+	}
+	do("POST", "/webhook/new_track/"+pending+"/verify", "", 502)
+	do("PATCH", "/webhook/new_track/"+verified, "{\"webhookURL\":\""+receiver.URL+"/c\"}", 502)
+	if webhook := get(verified); webhook.URLstr != receiver.URL+"/a" {
+		t.Errorf("expected url not to change without verification, got %v", webhook)
+	}
+
+	echo = true
+	do("POST", "/webhook/new_track/"+pending+"/verify", "", 200)
+	if webhook := get(pending); webhook.Pending {
+		t.Errorf("expected webhook to be active after echoing the challenge, got %v", webhook)
+	}
+	do("PATCH", "/webhook/new_track/"+verified, "{\"webhookURL\":\""+receiver.URL+"/c\"}", 200)
+
+	// Pending webhooks can not be verified after they have expired
+	echo = false
+	config.WebhookVerification.Timeout = -time.Second
+	server = NewServerWithConfig(receiver.Client(), nil, nil, &webhooksMap, nil, nil, config)
+	expired := do("POST", "/webhook/new_track", "{\"webhookURL\":\""+receiver.URL+"/d\"}", 202).Body.String()
+	echo = true
+	do("POST", "/webhook/new_track/"+expired+"/verify", "", 404)
+}
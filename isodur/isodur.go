@@ -2,6 +2,7 @@ package isodur
 
 import (
 	"bytes"
+	"errors"
 	"strconv"
 	"time"
 )
@@ -9,6 +10,15 @@ import (
 // Defines how many days are in a month (approximately 365 / 12)
 const daysInMonth = 30.415875
 
+// ErrInvalidDuration is returned if a string is not a valid ISO8601 duration
+var ErrInvalidDuration = errors.New("invalid ISO8601 duration")
+
+// unit is the postfix and the length of a ISO8601 duration element
+type unit struct {
+	postfix byte
+	length  time.Duration
+}
+
 // FormatAsISO8601 converts a duration into a ISO8601 compliant bytestring
 //
 // It will use the least amount of necessary terms, so if the duration is 5
@@ -87,3 +97,80 @@ func FormatAsISO8601(d time.Duration) string {
 
 	return buffer.String()
 }
+
+// ParseISO8601 parses a ISO8601 duration such as `P1DT12H` into a duration
+//
+// A year is 365 days and a month is about a twelfth of a year, since a
+// duration is not relative to a date. Only the last term may have a
+// fraction, e.g. `PT1.5S`.
+func ParseISO8601(s string) (time.Duration, error) {
+	day := 24 * time.Hour
+	month := time.Duration(daysInMonth * float64(day))
+
+	// The units of the elements in the order they must appear in, where the
+	// date part is before 'T' and the time part after it
+	var dates = [...]unit{
+		{'Y', 365 * day},
+		{'M', month},
+		{'W', 7 * day},
+		{'D', day},
+	}
+	var times = [...]unit{
+		{'H', time.Hour},
+		{'M', time.Minute},
+		{'S', time.Second},
+	}
+
+	if len(s) < 3 || s[0] != 'P' || s[len(s)-1] == 'T' {
+		return 0, ErrInvalidDuration
+	}
+	s = s[1:]
+
+	var d time.Duration
+	// Parses elements of the given units from the start of s, returning the
+	// rest of the string
+	parse := func(s string, units []unit) (string, error) {
+		next := 0
+		for len(s) > 0 && s[0] != 'T' {
+			i := 0
+			for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+				i++
+			}
+			if i == 0 || i == len(s) {
+				return s, ErrInvalidDuration
+			}
+			// Find the unit of the element, which must come after the
+			// previous element
+			for next < len(units) && units[next].postfix != s[i] {
+				next++
+			}
+			if next == len(units) {
+				return s, ErrInvalidDuration
+			}
+			value, err := strconv.ParseFloat(s[:i], 64)
+			if err != nil {
+				return s, ErrInvalidDuration
+			}
+			// A fraction is only allowed in the last element
+			if value != float64(int64(value)) && i+1 != len(s) {
+				return s, ErrInvalidDuration
+			}
+			d += time.Duration(value * float64(units[next].length))
+			next++
+			s = s[i+1:]
+		}
+		return s, nil
+	}
+
+	s, err := parse(s, dates[:])
+	if err != nil {
+		return 0, err
+	}
+	if len(s) > 0 {
+		// Skip the 'T' separating the date and the time part
+		if s, err = parse(s[1:], times[:]); err != nil || len(s) > 0 {
+			return 0, ErrInvalidDuration
+		}
+	}
+	return d, nil
+}
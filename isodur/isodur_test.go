@@ -85,3 +85,52 @@ func TestISO8601DurationDatesWithTimes(t *testing.T) {
 		}
 	}
 }
+
+func TestParseISO8601(t *testing.T) {
+	var tests = [...]struct {
+		str  string
+		expt time.Duration
+	}{
+		{"PT0S", 0},
+		{"PT5S", 5 * time.Second},
+		{"PT1.5S", 1500 * time.Millisecond},
+		{"PT2M5S", 125 * time.Second},
+		{"PT23H59M59S", 86399 * time.Second},
+		{"P1D", 24 * time.Hour},
+		{"P1W", 7 * 24 * time.Hour},
+		{"P1DT12H", 36 * time.Hour},
+		{"P0.5D", 12 * time.Hour},
+	}
+
+	for _, v := range tests {
+		res, err := ParseISO8601(v.str)
+		if err != nil {
+			t.Errorf("unable to parse '%s': %s", v.str, err)
+		} else if res != v.expt {
+			t.Errorf("expected '%s' to be '%s' but got '%s'", v.str, v.expt, res)
+		}
+	}
+}
+
+func TestParseISO8601Invalid(t *testing.T) {
+	for _, v := range [...]string{
+		"", "P", "PT", "1D", "P1", "PD", "P1DT", "PT1D", "P1H", "PT5S1M",
+		"P1D1D", "P1.5DT2H", "P1DT1HT1M", "P-1D", "P1..5D",
+	} {
+		if _, err := ParseISO8601(v); err == nil {
+			t.Errorf("expected '%s' to be rejected", v)
+		}
+	}
+}
+
+// Test that formatting a parsed duration gives the same duration back
+func TestParseISO8601Format(t *testing.T) {
+	for _, v := range [...]string{"PT0S", "PT16M40S", "PT23H59M59S", "P1Y", "P5D", "P1DT5H3S"} {
+		res, err := ParseISO8601(v)
+		if err != nil {
+			t.Errorf("unable to parse '%s': %s", v, err)
+		} else if got := FormatAsISO8601(res); got != v {
+			t.Errorf("expected '%s' to be formatted the same way after parsing, got '%s'", v, got)
+		}
+	}
+}
@@ -2,26 +2,40 @@ package main
 
 import (
 	"fmt"
+	"github.com/barskern/paragliding/clocktrigger"
 	"github.com/barskern/paragliding/igcserver"
+	"github.com/barskern/paragliding/isodur"
 	"github.com/globalsign/mgo"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 func main() {
+	clocktriggerMode := false
 	for _, v := range os.Args {
 		switch v {
+		case "clocktrigger":
+			clocktriggerMode = true
 		case "-v":
 			log.SetLevel(log.DebugLevel)
 		case "-q":
 			log.SetLevel(log.WarnLevel)
 		case "-h":
-			fmt.Println("Usage: paragliding [-q][-v][-h]\n\n-q Quiet mode (only warn and error)\n-v Verbose mode (all logs)")
+			fmt.Println("Usage: paragliding [clocktrigger] [-q][-v][-h]\n\nclocktrigger Poll the ticker of a service and post new tracks to a webhook\n\n-q Quiet mode (only warn and error)\n-v Verbose mode (all logs)")
 			os.Exit(0)
 		}
 	}
 
+	if clocktriggerMode {
+		runClocktrigger()
+		return
+	}
+
 	// Get port from env
 	port, ok := os.LookupEnv("PORT")
 	if !ok {
@@ -53,15 +67,81 @@ func main() {
 	// all igctracks
 	trackMetas := igcserver.NewTrackMetasDB(mongoSession.Copy())
 
+	// Create a bus which distributes events between all parts of the server
+	events := igcserver.NewEventBus()
+
 	// Create a webhooks abstraction which will connect to a mongodb to store
 	// all webhooks
-	webhooks := igcserver.NewWebhooksDB(mongoSession.Copy(), &httpClient)
+	webhooks := igcserver.NewWebhooksDB(mongoSession.Copy(), &httpClient, events)
+
+	// Create a live tracks abstraction which will connect to mongodb to store
+	// the tracks which are still being flown
+	live := igcserver.NewLiveTracksDB(mongoSession.Copy())
 
 	// Make simple ticker for database
 	ticker := igcserver.NewTickerDB(mongoSession.Copy(), 10)
 
+	// The configuration of the server is fixed when it is created
+	config := igcserver.DefaultConfig
+
+	// Get group flight configuration from env if present
+	groupFlight := &config.GroupFlight
+	if distanceStr, ok := os.LookupEnv("GROUP_FLIGHT_DISTANCE"); ok {
+		if groupFlight.Distance, err = strconv.ParseFloat(distanceStr, 64); err != nil {
+			log.WithField("error", err).Fatal("unable to parse envvar 'GROUP_FLIGHT_DISTANCE'")
+		}
+	}
+	if portionStr, ok := os.LookupEnv("GROUP_FLIGHT_PORTION"); ok {
+		if groupFlight.Portion, err = strconv.ParseFloat(portionStr, 64); err != nil {
+			log.WithField("error", err).Fatal("unable to parse envvar 'GROUP_FLIGHT_PORTION'")
+		}
+	}
+
+	// Get webhook verification configuration from env if present
+	webhookVerification := &config.WebhookVerification
+	if enabledStr, ok := os.LookupEnv("WEBHOOK_VERIFICATION"); ok {
+		if webhookVerification.Enabled, err = strconv.ParseBool(enabledStr); err != nil {
+			log.WithField("error", err).Fatal("unable to parse envvar 'WEBHOOK_VERIFICATION'")
+		}
+	}
+	if timeoutStr, ok := os.LookupEnv("WEBHOOK_VERIFICATION_TIMEOUT"); ok {
+		if webhookVerification.Timeout, err = isodur.ParseISO8601(timeoutStr); err != nil {
+			log.WithField("error", err).Fatal("unable to parse envvar 'WEBHOOK_VERIFICATION_TIMEOUT'")
+		}
+	}
+
+	// Get the restricted airspaces which tracks are checked against from a
+	// json file if present
+	if airspacePath, ok := os.LookupEnv("AIRSPACES_FILE"); ok {
+		f, err := os.Open(airspacePath)
+		if err != nil {
+			log.WithField("error", err).Fatal("unable to open file of envvar 'AIRSPACES_FILE'")
+		}
+		config.Airspaces, err = igcserver.LoadAirspaces(f)
+		f.Close()
+		if err != nil {
+			log.WithField("error", err).Fatal("unable to parse file of envvar 'AIRSPACES_FILE'")
+		}
+	}
+
+	// Get the token which can manage every track from env if present
+	config.AdminToken = os.Getenv("ADMIN_TOKEN")
+
 	// Create a new server which encompasses all routing and server state
-	server := igcserver.NewServer(&httpClient, &trackMetas, &ticker, &webhooks)
+	server := igcserver.NewServerWithConfig(&httpClient, &trackMetas, &ticker, &webhooks, &live, events, config)
+
+	// Register validation programs used to verify signatures of igc files,
+	// given as `<manufacturer>=<path>` separated by commas, which replace the
+	// built-in verification of the manufacturer if there is one
+	if programs, ok := os.LookupEnv("VALI_PROGRAMS"); ok {
+		for _, program := range strings.Split(programs, ",") {
+			parts := strings.SplitN(program, "=", 2)
+			if len(parts) != 2 {
+				log.WithField("program", program).Fatal("unable to parse envvar 'VALI_PROGRAMS'")
+			}
+			igcserver.RegisterSignatureVerifier(parts[0], igcserver.NewValiVerifier(parts[1]))
+		}
+	}
 
 	// Route all requests to `paragliding/api/` to the server and remove prefix
 	http.Handle("/paragliding/api/", http.StripPrefix("/paragliding/api", &server))
@@ -70,6 +150,7 @@ func main() {
 	// This function will block the current thread
 	err = http.ListenAndServe(":"+port, nil)
 
+	ticker.Close()
 	mongoSession.Close()
 
 	// We will only get to this statement if the server unexpectedly crashes
@@ -77,3 +158,41 @@ func main() {
 		"error": err,
 	}).Fatal("server error occurred")
 }
+
+// runClocktrigger polls the ticker of the service configured in the env and
+// posts summaries of new tracks to a webhook until interrupted
+func runClocktrigger() {
+	config, err := clocktrigger.ConfigFromEnv()
+	if err != nil {
+		log.WithField("error", err).Fatal("unable to get clocktrigger configuration")
+	}
+
+	log.WithFields(log.Fields{
+		"url":      config.BaseURL,
+		"interval": config.Interval,
+		"state":    config.StatePath,
+		"logLevel": log.GetLevel(),
+	}).Info("initializing clocktrigger")
+
+	trigger, err := clocktrigger.New(config)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"state": config.StatePath,
+			"error": err,
+		}).Fatal("unable to load clocktrigger state")
+	}
+
+	// Stop polling when the process is interrupted
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+
+	// This function will block the current thread
+	trigger.Run(stop)
+
+	log.WithField("lastSeen", trigger.LastSeen()).Info("clocktrigger stopped")
+}